@@ -0,0 +1,176 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+)
+
+// addressFor returns the Elastic IP allocated for the host name, nil if none.
+func (r *Region2) addressFor(name string) *types.Address {
+	for _, a := range r.EIps {
+		if TagValue(a.Tags, "xbee.id") == provider.EnvId() && TagValue(a.Tags, "xbee.name") == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// wantsElasticIp tells whether the provider manages an Elastic IP for h, an ExternalIp given to xbee wins.
+func (h *Host) wantsElasticIp() bool {
+	return h.Specification.ElasticIp && h.ExternalIp == ""
+}
+
+// ensureAddress allocates the tagged Elastic IP of h on its first Up, it tells whether the address was allocated.
+func (r *Region2) ensureAddress(ctx context.Context, h *Host) (*types.Address, bool, error) {
+	if a := r.addressFor(h.Name); a != nil {
+		return a, false, nil
+	}
+	out, err := r.Svc.AllocateAddress(ctx, &ec2.AllocateAddressInput{
+		Domain:            types.DomainTypeVpc,
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeElasticIp, h.Name),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot allocate Elastic IP for host %s in region %s : %v", h.Name, r.Name, err)
+	}
+	r.journal.record(r, resourceAddress, *out.AllocationId, h.Name)
+	a := &types.Address{
+		AllocationId: out.AllocationId,
+		PublicIp:     out.PublicIp,
+		Domain:       out.Domain,
+		Tags:         TagsForResource(h.Name),
+	}
+	r.EIps = append(r.EIps, a)
+	log2.Infof("allocated Elastic IP %s for host %s", *out.PublicIp, h.Name)
+	return a, true, nil
+}
+
+// reconcileAddresses gives their public ip to the running instances of the named hosts, the ExternalIp given to xbee
+// or their Elastic IP. It is the only place where addresses get associated, once per Up, and reports each host.
+func (r *Region2) reconcileAddresses(ctx context.Context, names ...string) (result []*OperationStatus) {
+	for _, name := range names {
+		h := r.Hosts[name]
+		ip, err := r.associateAddress(ctx, h)
+		if err != nil {
+			log2.Errorf("%v", err)
+		} else if ip != "" {
+			log2.Infof("associated ip %s to host %s", ip, name)
+		}
+		result = append(result, &OperationStatus{
+			Host:    h,
+			InError: err != nil,
+		})
+	}
+	return
+}
+
+// associateAddress associates the public ip h asks for to its instance, it returns the ip when an association was made.
+func (r *Region2) associateAddress(ctx context.Context, h *Host) (string, error) {
+	instance, ok := r.Instances[h.Name]
+	if !ok || instance.State.Name != types.InstanceStateNameRunning {
+		return "", nil
+	}
+	in := &ec2.AssociateAddressInput{
+		InstanceId: instance.InstanceId,
+	}
+	var a *types.Address
+	ip := h.ExternalIp
+	switch {
+	case h.ExternalIp != "":
+		if aws.ToString(instance.PublicIpAddress) == h.ExternalIp {
+			return "", nil
+		}
+		in.PublicIp = aws.String(h.ExternalIp)
+	case h.wantsElasticIp():
+		var allocated bool
+		var err error
+		if a, allocated, err = r.ensureAddress(ctx, h); err != nil {
+			return "", err
+		}
+		if allocated {
+			ctx = afterCreate(ctx)
+		}
+		if aws.ToString(a.InstanceId) == *instance.InstanceId {
+			return "", nil
+		}
+		in.AllocationId = a.AllocationId
+		ip = *a.PublicIp
+	default:
+		return "", nil
+	}
+	out, err := r.Svc.AssociateAddress(ctx, in)
+	if err != nil {
+		return "", fmt.Errorf("cannot associate ip %s to host %s : %v", ip, h.Name, err)
+	}
+	if a != nil {
+		a.InstanceId = instance.InstanceId
+		a.AssociationId = out.AssociationId
+	}
+	instance.PublicIpAddress = aws.String(ip)
+	return ip, nil
+}
+
+// releaseAddresses releases the Elastic IPs of the named hosts, their instances being terminated.
+func (r *Region2) releaseAddresses(ctx context.Context, names ...string) error {
+	var errs []error
+	for _, name := range names {
+		if a := r.addressFor(name); a != nil {
+			if err := r.releaseAddress(ctx, a); err != nil {
+				errs = append(errs, err)
+			} else {
+				log2.Infof("released Elastic IP %s of host %s", *a.PublicIp, name)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Region2) releaseAddress(ctx context.Context, a *types.Address) error {
+	if a.AssociationId != nil {
+		if _, err := r.Svc.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{
+			AssociationId: a.AssociationId,
+		}); err != nil && !isNotFound(err) {
+			return fmt.Errorf("cannot disassociate Elastic IP %s : %v", *a.PublicIp, err)
+		}
+	}
+	if _, err := r.Svc.ReleaseAddress(ctx, &ec2.ReleaseAddressInput{
+		AllocationId: a.AllocationId,
+	}); err != nil && !isNotFound(err) {
+		return fmt.Errorf("cannot release Elastic IP %s : %v", *a.PublicIp, err)
+	}
+	r.forgetAddress(a)
+	return nil
+}
+
+// forgetAddress removes a released address from r.EIps.
+func (r *Region2) forgetAddress(a *types.Address) {
+	var kept []*types.Address
+	for _, other := range r.EIps {
+		if aws.ToString(other.AllocationId) != aws.ToString(a.AllocationId) {
+			kept = append(kept, other)
+		}
+	}
+	r.EIps = kept
+}
+
+// orphanedAddresses returns the Elastic IPs of the env allocated for a host the env does not declare anymore, or for
+// a host without instance when they are not associated.
+func (r *Region2) orphanedAddresses() (result []*types.Address) {
+	for _, a := range r.EIps {
+		if TagValue(a.Tags, "xbee.id") != provider.EnvId() {
+			continue
+		}
+		name := TagValue(a.Tags, "xbee.name")
+		_, declared := r.Hosts[name]
+		_, exists := r.Instances[name]
+		if !declared || (!exists && a.InstanceId == nil) {
+			result = append(result, a)
+		}
+	}
+	return
+}
@@ -2,12 +2,15 @@ package aws
 
 import (
 	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/util"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Admin struct {
@@ -15,12 +18,14 @@ type Admin struct {
 
 func (pv Admin) DestroyVolumes(names []string) *cmd.XbeeError {
 	log2.Infof("asked to destroy volumes %v ...", names)
-	ctx := context.Background()
-	if regions, err := pv.regionsFromVolumes(ctx); err != nil {
+	ctx, stop := commandContext()
+	defer stop()
+	if regions, failed, err := pv.regionsFromVolumes(ctx); err != nil {
 		return err
 	} else {
 		var wg sync.WaitGroup
-		var allExistingNames []string
+		var mu sync.Mutex
+		var allExistingNames, notDestroyed []string
 		for _, r := range regions {
 			existingVolumes, existingNames := r.existingVolumesForNames(names)
 			allExistingNames = append(allExistingNames, existingNames...)
@@ -38,8 +43,10 @@ func (pv Admin) DestroyVolumes(names []string) *cmd.XbeeError {
 						log2.Infof("successfully destroyed volume %s", name)
 					} else {
 						log2.Errorf("could not remove volume %s:\n%v", name, err)
+						mu.Lock()
+						notDestroyed = append(notDestroyed, name)
+						mu.Unlock()
 					}
-
 				}(r, vol, existingNames[index])
 			}
 		}
@@ -50,28 +57,226 @@ func (pv Admin) DestroyVolumes(names []string) *cmd.XbeeError {
 				log2.Warnf("volume %s already do not exist", aName)
 			}
 		}
-		return nil
+		if len(notDestroyed) > 0 {
+			sort.Strings(notDestroyed)
+			return cmd.Error("volumes %v could not be destroyed", notDestroyed)
+		}
+		return failed.XbeeError()
 	}
 }
 
-func (pv Admin) regionsFromVolumes(ctx context.Context) (map[string]*Region2, *cmd.XbeeError) {
-	volumes, err := VolumesFrom()
+func (pv Admin) regionsFromVolumes(ctx context.Context) (map[string]*Region2, RegionErrors, *cmd.XbeeError) {
+	volumes, err := envVolumes()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var channels []<-chan *response
 	for regionName, volumesForRegion := range volumes {
 		channels = append(channels, newRegion(ctx, regionName, nil, volumesForRegion))
 	}
-	ch := util.Multiplex(ctx, channels...)
-	result := map[string]*Region2{}
-	for resp := range ch {
-		if resp.err != nil {
-			log2.Errorf("%v", resp.err)
-		} else {
-			result[resp.r.Name] = resp.r
+	return collectRegions(ctx, channels)
+}
+
+// ListOrphanedAddresses logs the Elastic IPs of the env left behind by hosts which are gone, in every region of the
+// account, so that addresses of regions the env no longer uses are found too.
+func (pv Admin) ListOrphanedAddresses() *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := regionsOfAccount(ctx)
+	if err != nil {
+		return err
+	}
+	var count int
+	for _, r := range regions {
+		for _, a := range r.orphanedAddresses() {
+			count++
+			log2.Infof("Elastic IP %s (%s) of host %s in region %s", aws.ToString(a.PublicIp), aws.ToString(a.AllocationId), TagValue(a.Tags, "xbee.name"), r.Name)
 		}
 	}
-	return result, nil
+	if count == 0 {
+		log2.Infof("no orphaned Elastic IP")
+	}
+	return failed.XbeeError()
+}
+
+// ReleaseOrphanedAddresses releases the Elastic IPs listed by ListOrphanedAddresses.
+func (pv Admin) ReleaseOrphanedAddresses() *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := regionsOfAccount(ctx)
+	if err != nil {
+		return err
+	}
+	var inError bool
+	for _, r := range regions {
+		for _, a := range r.orphanedAddresses() {
+			if err := r.releaseAddress(ctx, a); err != nil {
+				log2.Errorf("%v", err)
+				inError = true
+			} else {
+				log2.Infof("released Elastic IP %s of host %s in region %s", aws.ToString(a.PublicIp), TagValue(a.Tags, "xbee.name"), r.Name)
+			}
+		}
+	}
+	if inError {
+		return cmd.Error("some orphaned Elastic IPs could not be released")
+	}
+	return failed.XbeeError()
+}
+
+// EncryptionStatus logs the encryption of the root and data volumes of every host, and fails when a volume required
+// to be encrypted is not.
+func (pv Admin) EncryptionStatus() *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := regionsForHosts(ctx)
+	if err != nil {
+		return err
+	}
+	var notCompliant []string
+	for _, e := range encryptionReport(regions) {
+		e.log()
+		if !e.Compliant() {
+			notCompliant = append(notCompliant, e.VolumeId)
+		}
+	}
+	if len(notCompliant) > 0 {
+		return cmd.Error("volumes %v are not encrypted, though encryption is required", notCompliant)
+	}
+	return failed.XbeeError()
+}
+
+// VolumeDevices writes as JSON, for every host, the volume id, device and /dev/disk/by-id path of its data volumes,
+// so that tooling on the hosts can find them. It goes to the XBEE_AWS_VOLUME_DEVICES_FILE file, or to the log.
+func (pv Admin) VolumeDevices() *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := regionsForHosts(ctx)
+	if err != nil {
+		return err
+	}
+	if err := writeJson(volumeDevicesFileEnv, "volume devices", volumeDevices(regions)); err != nil {
+		return err
+	}
+	return failed.XbeeError()
+}
+
+// MoveVolume detaches the volume volName from the host it is attached to and attaches it to hostName, in the same
+// zone. Declare the volume in hostName, or the next up detaches it again.
+func (pv Admin) MoveVolume(volName string, hostName string) *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := regionsForHosts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		h, ok := r.Hosts[hostName]
+		if !ok {
+			continue
+		}
+		if err := r.moveVolume(ctx, volName, hostName); err != nil {
+			return cmd.Error("%v", err)
+		}
+		if !containsString(h.Volumes, volName) {
+			log2.Warnf("host %s does not declare volume %s, the next up detaches it again", hostName, volName)
+		}
+		return failed.XbeeError()
+	}
+	if err := failed.XbeeError(); err != nil {
+		return err
+	}
+	return cmd.Error("host %s does not exist in env", hostName)
+}
+
+// SnapshotVolumes snapshots the named volumes, every volume of the env when none is given.
+func (pv Admin) SnapshotVolumes(names []string) *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := pv.regionsFromVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	var inError bool
+	for _, r := range regions {
+		volNames := names
+		if len(volNames) == 0 {
+			for name := range r.Volumes {
+				volNames = append(volNames, name)
+			}
+		}
+		_, existingNames := r.existingVolumesForNames(volNames)
+		for _, name := range existingNames {
+			out, err := r.createSnapshot(ctx, name)
+			if err != nil {
+				log2.Errorf("%v", err)
+				inError = true
+				continue
+			}
+			log2.Infof("snapshot %s of volume %s started in region %s", *out.SnapshotId, name, r.Name)
+		}
+	}
+	if inError {
+		return cmd.Error("some volumes could not be snapshotted")
+	}
+	return failed.XbeeError()
+}
+
+// ListSnapshots logs the snapshots of the named volumes, every volume of the env when none is given, newest first.
+func (pv Admin) ListSnapshots(names []string) *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	regions, failed, err := pv.regionsFromVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		snapshots, err := r.snapshots(ctx, names...)
+		if err != nil {
+			return cmd.Error("%v", err)
+		}
+		for _, snap := range snapshots {
+			log2.Infof("volume %s snapshot %s of %s, %d GiB, %s in region %s", TagValue(snap.Tags, "xbee.name"), *snap.SnapshotId,
+				TagValue(snap.Tags, snapshotTimeTag), aws.ToInt32(snap.VolumeSize), snap.State, r.Name)
+		}
+	}
+	return failed.XbeeError()
+}
+
+// PruneSnapshots deletes the snapshots of the named volumes, every volume of the env when none is given, beyond the
+// retention policy given by XBEE_AWS_SNAPSHOT_KEEP and XBEE_AWS_SNAPSHOT_MAX_AGE. Dry run only lists them.
+func (pv Admin) PruneSnapshots(names []string) *cmd.XbeeError {
+	ctx, stop := commandContext()
+	defer stop()
+	keep := intOption(snapshotKeepEnv, 7)
+	maxAge := durationOption(snapshotMaxAgeEnv, 0)
+	regions, failed, err := pv.regionsFromVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	var inError bool
+	for _, r := range regions {
+		snapshots, err := r.snapshots(ctx, names...)
+		if err != nil {
+			return cmd.Error("%v", err)
+		}
+		for _, snap := range prunedSnapshots(snapshots, keep, maxAge, time.Now()) {
+			name := TagValue(snap.Tags, "xbee.name")
+			if dryRun() {
+				log2.Infof("snapshot %s of volume %s taken at %s would be deleted", *snap.SnapshotId, name, TagValue(snap.Tags, snapshotTimeTag))
+				continue
+			}
+			if _, err := r.Svc.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: snap.SnapshotId}); err != nil && !isNotFound(err) {
+				log2.Errorf("cannot delete snapshot %s of volume %s : %v", *snap.SnapshotId, name, err)
+				inError = true
+				continue
+			}
+			log2.Infof("deleted snapshot %s of volume %s taken at %s", *snap.SnapshotId, name, TagValue(snap.Tags, snapshotTimeTag))
+		}
+	}
+	if inError {
+		return cmd.Error("some snapshots could not be deleted")
+	}
+	return failed.XbeeError()
 }
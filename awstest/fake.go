@@ -0,0 +1,528 @@
+// Package awstest provides an in-memory EC2 implementation satisfying aws.EC2API,
+// so that Region2 code paths can be exercised offline.
+package awstest
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeCloud holds one FakeEC2 per region.
+type FakeCloud struct {
+	mu      sync.Mutex
+	regions map[string]*FakeEC2
+}
+
+func NewFakeCloud(regions ...string) *FakeCloud {
+	c := &FakeCloud{regions: map[string]*FakeEC2{}}
+	for _, name := range regions {
+		c.Region(name)
+	}
+	return c
+}
+
+// Region returns the fake for a region, creating it if needed.
+// The empty name returns the first region, like a client with no region override.
+func (c *FakeCloud) Region(name string) *FakeEC2 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name == "" {
+		names := c.regionNames()
+		if len(names) > 0 {
+			return c.regions[names[0]]
+		}
+		name = "us-east-1"
+	}
+	if f, ok := c.regions[name]; ok {
+		return f
+	}
+	f := NewFakeEC2(name)
+	f.cloud = c
+	c.regions[name] = f
+	return f
+}
+
+func (c *FakeCloud) regionNames() (result []string) {
+	for name := range c.regions {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return
+}
+
+// FakeEC2 is an in-memory EC2 region.
+// Transient states (pending, stopping, shutting-down) complete on the next describe call.
+type FakeEC2 struct {
+	mu     sync.Mutex
+	cloud  *FakeCloud
+	Region string
+	seq    int
+
+	Instances      map[string]*types.Instance
+	Volumes        map[string]*types.Volume
+	SecurityGroups map[string]*types.SecurityGroup
+	Images         map[string]*types.Image
+	Addresses      map[string]*types.Address
+	Vpcs           map[string]*types.Vpc
+	Subnets        map[string]*types.Subnet
+	Gateways       map[string]*types.InternetGateway
+	RouteTables    map[string]*types.RouteTable
+	Snapshots      map[string]*types.Snapshot
+	// last modification of each volume, by volume id
+	Modifications map[string]*types.VolumeModification
+
+	// Calls counts calls per operation name, e.g. Calls["RunInstances"].
+	Calls map[string]int
+
+	// PageSize, when positive, splits describe results into pages linked by NextToken.
+	PageSize int
+
+	failures map[string][]error
+	// resource id by client token
+	tokens map[string]string
+	// rule ids of each security group, in the order of its IpPermissions
+	ruleIds map[string][]string
+}
+
+func NewFakeEC2(region string) *FakeEC2 {
+	return &FakeEC2{
+		Region:         region,
+		Instances:      map[string]*types.Instance{},
+		Volumes:        map[string]*types.Volume{},
+		SecurityGroups: map[string]*types.SecurityGroup{},
+		Images:         map[string]*types.Image{},
+		Addresses:      map[string]*types.Address{},
+		Vpcs:           map[string]*types.Vpc{},
+		Subnets:        map[string]*types.Subnet{},
+		Gateways:       map[string]*types.InternetGateway{},
+		RouteTables:    map[string]*types.RouteTable{},
+		Snapshots:      map[string]*types.Snapshot{},
+		Modifications:  map[string]*types.VolumeModification{},
+		Calls:          map[string]int{},
+		failures:       map[string][]error{},
+		tokens:         map[string]string{},
+		ruleIds:        map[string][]string{},
+	}
+}
+
+func (f *FakeEC2) nextId(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s-%017x", prefix, f.seq)
+}
+
+// call records a call to op and returns the next injected failure for it, if any.
+func (f *FakeEC2) call(op string) error {
+	f.Calls[op]++
+	if errs := f.failures[op]; len(errs) > 0 {
+		f.failures[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// FailNext makes the next calls to op return errs, one per call, before behaving normally again.
+func (f *FakeEC2) FailNext(op string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], errs...)
+}
+
+// APIError builds an error as returned by EC2, for use with FailNext.
+func APIError(code string, message string) error {
+	return apiError(code, "%s", message)
+}
+
+func (f *FakeEC2) defaultAz() string {
+	return f.Region + "a"
+}
+
+// AddImage registers an available AMI, as a public image or a previously packed one.
+func (f *FakeEC2) AddImage(imageId string, rootDeviceName string, tags ...types.Tag) *types.Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	im := &types.Image{
+		ImageId:        aws.String(imageId),
+		Name:           aws.String(imageId),
+		RootDeviceName: aws.String(rootDeviceName),
+		State:          types.ImageStateAvailable,
+		Tags:           tags,
+	}
+	f.Images[imageId] = im
+	return im
+}
+
+// AddDefaultVpc registers a default vpc, as found in most accounts.
+func (f *FakeEC2) AddDefaultVpc() *types.Vpc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createVpc(true, "172.31.0.0/16")
+}
+
+// AddVpc registers a non default vpc.
+func (f *FakeEC2) AddVpc(cidrBlock string, tags ...types.Tag) *types.Vpc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v := f.createVpc(false, cidrBlock)
+	v.Tags = tags
+	return v
+}
+
+// AddSubnet registers a subnet of vpcId in zone az, the zone suffix (e.g. "b") may be given alone.
+func (f *FakeEC2) AddSubnet(vpcId string, az string, cidrBlock string, tags ...types.Tag) *types.Subnet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(az) == 1 {
+		az = f.Region + az
+	}
+	s := &types.Subnet{
+		SubnetId:         aws.String(f.nextId("subnet")),
+		VpcId:            aws.String(vpcId),
+		AvailabilityZone: aws.String(az),
+		CidrBlock:        aws.String(cidrBlock),
+		State:            types.SubnetStateAvailable,
+		Tags:             tags,
+	}
+	f.Subnets[*s.SubnetId] = s
+	return s
+}
+
+// AddAddress registers an allocated Elastic IP.
+func (f *FakeEC2) AddAddress(publicIp string, tags ...types.Tag) *types.Address {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a := &types.Address{
+		AllocationId: aws.String(f.nextId("eipalloc")),
+		PublicIp:     aws.String(publicIp),
+		Domain:       types.DomainTypeVpc,
+		Tags:         tags,
+	}
+	f.Addresses[*a.AllocationId] = a
+	return a
+}
+
+// createVpc creates a vpc with its main route table.
+func (f *FakeEC2) createVpc(isDefault bool, cidrBlock string) *types.Vpc {
+	v := &types.Vpc{
+		VpcId:     aws.String(f.nextId("vpc")),
+		IsDefault: aws.Bool(isDefault),
+		CidrBlock: aws.String(cidrBlock),
+		State:     types.VpcStateAvailable,
+	}
+	f.Vpcs[*v.VpcId] = v
+	main := &types.RouteTable{
+		RouteTableId: aws.String(f.nextId("rtb")),
+		VpcId:        v.VpcId,
+		Associations: []types.RouteTableAssociation{
+			{
+				Main:                    aws.Bool(true),
+				RouteTableAssociationId: aws.String(f.nextId("rtbassoc")),
+			},
+		},
+		Routes: []types.Route{
+			{
+				DestinationCidrBlock: v.CidrBlock,
+				GatewayId:            aws.String("local"),
+			},
+		},
+	}
+	main.Associations[0].RouteTableId = main.RouteTableId
+	f.RouteTables[*main.RouteTableId] = main
+	return v
+}
+
+// tick completes every transient state.
+func (f *FakeEC2) tick() {
+	for _, i := range f.Instances {
+		switch i.State.Name {
+		case types.InstanceStateNamePending:
+			i.State = instanceState(types.InstanceStateNameRunning)
+		case types.InstanceStateNameStopping:
+			i.State = instanceState(types.InstanceStateNameStopped)
+		case types.InstanceStateNameShuttingDown:
+			i.State = instanceState(types.InstanceStateNameTerminated)
+			f.releaseInstanceResources(i)
+		}
+	}
+	for _, im := range f.Images {
+		if im.State == types.ImageStatePending {
+			im.State = types.ImageStateAvailable
+		}
+	}
+	for _, v := range f.Volumes {
+		if v.State == types.VolumeStateCreating {
+			v.State = types.VolumeStateAvailable
+		}
+	}
+	f.detachVolumes()
+	for _, m := range f.Modifications {
+		switch m.ModificationState {
+		case types.VolumeModificationStateModifying:
+			m.ModificationState = types.VolumeModificationStateOptimizing
+			m.Progress = aws.Int64(50)
+		case types.VolumeModificationStateOptimizing:
+			m.ModificationState = types.VolumeModificationStateCompleted
+			m.Progress = aws.Int64(100)
+			m.EndTime = aws.Time(time.Now())
+		}
+	}
+	for _, snap := range f.Snapshots {
+		if snap.State == types.SnapshotStatePending {
+			snap.State = types.SnapshotStateCompleted
+			snap.Progress = aws.String("100%")
+		}
+	}
+}
+
+func (f *FakeEC2) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeRegions"); err != nil {
+		return nil, err
+	}
+	names := []string{f.Region}
+	if f.cloud != nil {
+		f.cloud.mu.Lock()
+		names = f.cloud.regionNames()
+		f.cloud.mu.Unlock()
+	}
+	out := &ec2.DescribeRegionsOutput{}
+	for _, name := range names {
+		out.Regions = append(out.Regions, types.Region{RegionName: aws.String(name)})
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+	for _, id := range params.Resources {
+		tags, err := f.tagsOf(id)
+		if err != nil {
+			return nil, err
+		}
+		*tags = mergeTags(*tags, params.Tags)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *FakeEC2) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteTags"); err != nil {
+		return nil, err
+	}
+	for _, id := range params.Resources {
+		tags, err := f.tagsOf(id)
+		if err != nil {
+			return nil, err
+		}
+		if params.Tags == nil {
+			*tags = nil
+			continue
+		}
+		var kept []types.Tag
+		for _, t := range *tags {
+			if !containsTagKey(params.Tags, *t.Key) {
+				kept = append(kept, t)
+			}
+		}
+		*tags = kept
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (f *FakeEC2) tagsOf(id string) (*[]types.Tag, error) {
+	switch {
+	case strings.HasPrefix(id, "i-"):
+		if i, ok := f.Instances[id]; ok {
+			return &i.Tags, nil
+		}
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+	case strings.HasPrefix(id, "vol-"):
+		if v, ok := f.Volumes[id]; ok {
+			return &v.Tags, nil
+		}
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", id)
+	case strings.HasPrefix(id, "sg-"):
+		if sg, ok := f.SecurityGroups[id]; ok {
+			return &sg.Tags, nil
+		}
+		return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	case strings.HasPrefix(id, "ami-"):
+		if im, ok := f.Images[id]; ok {
+			return &im.Tags, nil
+		}
+		return nil, apiError("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", id)
+	case strings.HasPrefix(id, "eipalloc-"):
+		if a, ok := f.Addresses[id]; ok {
+			return &a.Tags, nil
+		}
+		return nil, apiError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", id)
+	case strings.HasPrefix(id, "vpc-"):
+		if v, ok := f.Vpcs[id]; ok {
+			return &v.Tags, nil
+		}
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+	case strings.HasPrefix(id, "subnet-"):
+		if sn, ok := f.Subnets[id]; ok {
+			return &sn.Tags, nil
+		}
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+	case strings.HasPrefix(id, "igw-"):
+		if g, ok := f.Gateways[id]; ok {
+			return &g.Tags, nil
+		}
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	case strings.HasPrefix(id, "snap-"):
+		if snap, ok := f.Snapshots[id]; ok {
+			return &snap.Tags, nil
+		}
+		return nil, apiError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+	case strings.HasPrefix(id, "rtb-"):
+		if t, ok := f.RouteTables[id]; ok {
+			return &t.Tags, nil
+		}
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	return nil, apiError("InvalidID", "The ID '%s' is not valid", id)
+}
+
+func apiError(code string, format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Fault:   smithy.FaultClient,
+	}
+}
+
+func mergeTags(tags []types.Tag, added []types.Tag) []types.Tag {
+	result := append([]types.Tag{}, tags...)
+	for _, t := range added {
+		replaced := false
+		for index := range result {
+			if *result[index].Key == *t.Key {
+				result[index].Value = t.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			result = append(result, types.Tag{Key: t.Key, Value: t.Value})
+		}
+	}
+	return result
+}
+
+func containsTagKey(tags []types.Tag, key string) bool {
+	for _, t := range tags {
+		if *t.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func tagsFor(specs []types.TagSpecification, resourceType types.ResourceType) (result []types.Tag) {
+	for _, spec := range specs {
+		if spec.ResourceType == resourceType {
+			result = mergeTags(result, spec.Tags)
+		}
+	}
+	return
+}
+
+// attributes returns the values of a filter name for a resource, ok is false for unsupported filters.
+type attributes func(name string) (values []string, ok bool)
+
+func tagAttributes(tags []types.Tag, name string) ([]string, bool) {
+	if strings.HasPrefix(name, "tag:") {
+		key := strings.TrimPrefix(name, "tag:")
+		for _, t := range tags {
+			if *t.Key == key {
+				return []string{aws.ToString(t.Value)}, true
+			}
+		}
+		return nil, true
+	}
+	if name == "tag-key" {
+		var keys []string
+		for _, t := range tags {
+			keys = append(keys, *t.Key)
+		}
+		return keys, true
+	}
+	return nil, false
+}
+
+func matchFilters(filters []types.Filter, attrs attributes) (bool, error) {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		values, ok := attrs(name)
+		if !ok {
+			return false, apiError("InvalidParameterValue", "The filter '%s' is invalid", name)
+		}
+		if !matchAny(values, filter.Values) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchAny(values []string, patterns []string) bool {
+	for _, v := range values {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, elt := range values {
+		if elt == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[T any](m map[string]T) (result []string) {
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return
+}
+
+// page returns the page of items starting at nextToken, honoring MaxResults and PageSize.
+func page[T any](f *FakeEC2, items []T, nextToken *string, maxResults *int32) ([]T, *string, error) {
+	size := f.PageSize
+	if maxResults != nil && *maxResults > 0 {
+		size = int(*maxResults)
+	}
+	start := 0
+	if token := aws.ToString(nextToken); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start > len(items) {
+			return nil, nil, apiError("InvalidParameterValue", "Invalid value '%s' for nextToken", token)
+		}
+	}
+	if size <= 0 || start+size >= len(items) {
+		return items[start:], nil, nil
+	}
+	return items[start : start+size], aws.String(strconv.Itoa(start + size)), nil
+}
@@ -0,0 +1,109 @@
+package awstest
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"time"
+)
+
+func imageAttributes(im *types.Image) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "image-id":
+			return []string{*im.ImageId}, true
+		case "name":
+			return []string{aws.ToString(im.Name)}, true
+		case "state":
+			return []string{string(im.State)}, true
+		case "owner-id":
+			return []string{aws.ToString(im.OwnerId)}, true
+		case "architecture":
+			return []string{string(im.Architecture)}, true
+		case "description":
+			return []string{aws.ToString(im.Description)}, true
+		}
+		return tagAttributes(im.Tags, name)
+	}
+}
+
+func copyImage(im *types.Image) types.Image {
+	result := *im
+	result.Tags = append([]types.Tag{}, im.Tags...)
+	result.BlockDeviceMappings = append([]types.BlockDeviceMapping{}, im.BlockDeviceMappings...)
+	return result
+}
+
+func (f *FakeEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeImages"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	for _, id := range params.ImageIds {
+		if _, ok := f.Images[id]; !ok {
+			return nil, apiError("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeImagesOutput{}
+	for _, id := range sortedKeys(f.Images) {
+		im := f.Images[id]
+		if len(params.ImageIds) > 0 && !containsString(params.ImageIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, imageAttributes(im)); err != nil {
+			return nil, err
+		} else if ok {
+			out.Images = append(out.Images, copyImage(im))
+		}
+	}
+	var err error
+	out.Images, out.NextToken, err = page(f, out.Images, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateImage"); err != nil {
+		return nil, err
+	}
+	i, ok := f.Instances[aws.ToString(params.InstanceId)]
+	if !ok {
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.ToString(params.InstanceId))
+	}
+	for _, im := range f.Images {
+		if aws.ToString(im.Name) == aws.ToString(params.Name) {
+			return nil, apiError("InvalidAMIName.Duplicate", "AMI name %s is already in use by AMI %s", *params.Name, *im.ImageId)
+		}
+	}
+	im := &types.Image{
+		ImageId:        aws.String(f.nextId("ami")),
+		Name:           params.Name,
+		Description:    params.Description,
+		RootDeviceName: i.RootDeviceName,
+		State:          types.ImageStatePending,
+		CreationDate:   aws.String(time.Now().UTC().Format(time.RFC3339)),
+		Tags:           tagsFor(params.TagSpecifications, types.ResourceTypeImage),
+	}
+	f.Images[*im.ImageId] = im
+	return &ec2.CreateImageOutput{ImageId: im.ImageId}, nil
+}
+
+func (f *FakeEC2) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeregisterImage"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Images[aws.ToString(params.ImageId)]; !ok {
+		return nil, apiError("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", aws.ToString(params.ImageId))
+	}
+	delete(f.Images, *params.ImageId)
+	return &ec2.DeregisterImageOutput{}, nil
+}
@@ -0,0 +1,346 @@
+package awstest
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"time"
+)
+
+func instanceState(name types.InstanceStateName) *types.InstanceState {
+	codes := map[types.InstanceStateName]int32{
+		types.InstanceStateNamePending:      0,
+		types.InstanceStateNameRunning:      16,
+		types.InstanceStateNameShuttingDown: 32,
+		types.InstanceStateNameTerminated:   48,
+		types.InstanceStateNameStopping:     64,
+		types.InstanceStateNameStopped:      80,
+	}
+	return &types.InstanceState{
+		Name: name,
+		Code: aws.Int32(codes[name]),
+	}
+}
+
+func instanceAttributes(i *types.Instance) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "instance-id":
+			return []string{*i.InstanceId}, true
+		case "instance-state-name":
+			return []string{string(i.State.Name)}, true
+		case "availability-zone":
+			return []string{aws.ToString(i.Placement.AvailabilityZone)}, true
+		case "image-id":
+			return []string{aws.ToString(i.ImageId)}, true
+		case "vpc-id":
+			return []string{aws.ToString(i.VpcId)}, true
+		case "subnet-id":
+			return []string{aws.ToString(i.SubnetId)}, true
+		}
+		return tagAttributes(i.Tags, name)
+	}
+}
+
+func copyInstance(i *types.Instance) types.Instance {
+	result := *i
+	result.Tags = append([]types.Tag{}, i.Tags...)
+	result.BlockDeviceMappings = append([]types.InstanceBlockDeviceMapping{}, i.BlockDeviceMappings...)
+	result.SecurityGroups = append([]types.GroupIdentifier{}, i.SecurityGroups...)
+	state := *i.State
+	result.State = &state
+	return result
+}
+
+func (f *FakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	for _, id := range params.InstanceIds {
+		if _, ok := f.Instances[id]; !ok {
+			return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeInstancesOutput{}
+	for _, id := range sortedKeys(f.Instances) {
+		i := f.Instances[id]
+		if len(params.InstanceIds) > 0 && !containsString(params.InstanceIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, instanceAttributes(i)); err != nil {
+			return nil, err
+		} else if ok {
+			out.Reservations = append(out.Reservations, types.Reservation{
+				ReservationId: aws.String("r-" + id[2:]),
+				Instances:     []types.Instance{copyInstance(i)},
+			})
+		}
+	}
+	var err error
+	out.Reservations, out.NextToken, err = page(f, out.Reservations, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	if token := aws.ToString(params.ClientToken); token != "" {
+		if id, ok := f.tokens[token]; ok {
+			i := f.Instances[id]
+			if aws.ToString(i.ImageId) != aws.ToString(params.ImageId) || i.InstanceType != params.InstanceType {
+				return nil, apiError("IdempotentParameterMismatch", "The client token %s was already used with different parameters", token)
+			}
+			return &ec2.RunInstancesOutput{Instances: []types.Instance{copyInstance(i)}}, nil
+		}
+	}
+	im, ok := f.Images[aws.ToString(params.ImageId)]
+	if !ok {
+		return nil, apiError("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", aws.ToString(params.ImageId))
+	}
+	var groups []types.GroupIdentifier
+	for _, id := range params.SecurityGroupIds {
+		sg, ok := f.SecurityGroups[id]
+		if !ok {
+			return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+		}
+		groups = append(groups, types.GroupIdentifier{GroupId: sg.GroupId, GroupName: sg.GroupName})
+	}
+	az := f.defaultAz()
+	if params.Placement != nil && params.Placement.AvailabilityZone != nil {
+		az = *params.Placement.AvailabilityZone
+	}
+	var vpcId *string
+	mapPublicIp := true
+	if params.SubnetId != nil {
+		sn, ok := f.Subnets[*params.SubnetId]
+		if !ok {
+			return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", *params.SubnetId)
+		}
+		if params.Placement != nil && params.Placement.AvailabilityZone != nil && az != aws.ToString(sn.AvailabilityZone) {
+			return nil, apiError("InvalidParameterValue", "Value (%s) for parameter availabilityZone is invalid. Subnet '%s' is in the availability zone %s", az, *sn.SubnetId, aws.ToString(sn.AvailabilityZone))
+		}
+		az = aws.ToString(sn.AvailabilityZone)
+		vpcId = sn.VpcId
+		mapPublicIp = aws.ToBool(sn.MapPublicIpOnLaunch)
+	}
+	for _, g := range groups {
+		if sg := f.SecurityGroups[*g.GroupId]; vpcId != nil && aws.ToString(sg.VpcId) != *vpcId {
+			return nil, apiError("InvalidParameter", "Security group %s and subnet %s belong to different networks.", *g.GroupId, *params.SubnetId)
+		}
+	}
+	count := int(aws.ToInt32(params.MinCount))
+	if count == 0 {
+		count = 1
+	}
+	out := &ec2.RunInstancesOutput{}
+	for n := 0; n < count; n++ {
+		id := f.nextId("i")
+		privateIp := fmt.Sprintf("172.31.%d.%d", f.seq/250, f.seq%250+1)
+		publicIp := fmt.Sprintf("54.0.%d.%d", f.seq/250, f.seq%250+1)
+		i := &types.Instance{
+			InstanceId:       aws.String(id),
+			ImageId:          im.ImageId,
+			InstanceType:     params.InstanceType,
+			LaunchTime:       aws.Time(time.Now()),
+			Placement:        &types.Placement{AvailabilityZone: aws.String(az)},
+			PrivateIpAddress: aws.String(privateIp),
+			PublicIpAddress:  aws.String(publicIp),
+			RootDeviceName:   im.RootDeviceName,
+			SecurityGroups:   groups,
+			State:            instanceState(types.InstanceStateNamePending),
+			SubnetId:         params.SubnetId,
+			VpcId:            vpcId,
+			Tags:             tagsFor(params.TagSpecifications, types.ResourceTypeInstance),
+			NetworkInterfaces: []types.InstanceNetworkInterface{
+				{PrivateIpAddress: aws.String(privateIp)},
+			},
+		}
+		root := &types.Volume{
+			VolumeId:         aws.String(f.nextId("vol")),
+			AvailabilityZone: aws.String(az),
+			Size:             aws.Int32(8),
+			VolumeType:       types.VolumeTypeGp2,
+			State:            types.VolumeStateInUse,
+			CreateTime:       aws.Time(time.Now()),
+			Encrypted:        aws.Bool(false),
+			Tags:             tagsFor(params.TagSpecifications, types.ResourceTypeVolume),
+		}
+		for _, mapping := range params.BlockDeviceMappings {
+			if aws.ToString(mapping.DeviceName) != aws.ToString(im.RootDeviceName) || mapping.Ebs == nil {
+				continue
+			}
+			if mapping.Ebs.VolumeSize != nil {
+				root.Size = mapping.Ebs.VolumeSize
+			}
+			if aws.ToBool(mapping.Ebs.Encrypted) {
+				root.Encrypted = aws.Bool(true)
+				root.KmsKeyId = mapping.Ebs.KmsKeyId
+			}
+		}
+		root.Attachments = []types.VolumeAttachment{
+			{
+				Device:              im.RootDeviceName,
+				InstanceId:          i.InstanceId,
+				VolumeId:            root.VolumeId,
+				State:               types.VolumeAttachmentStateAttached,
+				DeleteOnTermination: aws.Bool(true),
+			},
+		}
+		f.Volumes[*root.VolumeId] = root
+		i.BlockDeviceMappings = []types.InstanceBlockDeviceMapping{
+			{
+				DeviceName: im.RootDeviceName,
+				Ebs: &types.EbsInstanceBlockDevice{
+					VolumeId:            root.VolumeId,
+					Status:              types.AttachmentStatusAttached,
+					DeleteOnTermination: aws.Bool(true),
+				},
+			},
+		}
+		f.Instances[id] = i
+		if token := aws.ToString(params.ClientToken); token != "" {
+			f.tokens[token] = id
+		}
+		if !mapPublicIp {
+			i.PublicIpAddress = nil
+		}
+		out.Instances = append(out.Instances, copyInstance(i))
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) changeState(op string, ids []string, from []types.InstanceStateName, to types.InstanceStateName) ([]types.InstanceStateChange, error) {
+	if err := f.call(op); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		i, ok := f.Instances[id]
+		if !ok {
+			return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+		}
+		allowed := i.State.Name == to
+		for _, state := range from {
+			if i.State.Name == state {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, apiError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be %s", id, to)
+		}
+	}
+	var result []types.InstanceStateChange
+	for _, id := range ids {
+		i := f.Instances[id]
+		previous := i.State
+		if i.State.Name != to {
+			i.State = instanceState(to)
+		}
+		result = append(result, types.InstanceStateChange{
+			InstanceId:    i.InstanceId,
+			PreviousState: previous,
+			CurrentState:  i.State,
+		})
+	}
+	return result, nil
+}
+
+func (f *FakeEC2) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes, err := f.changeState("StartInstances", params.InstanceIds,
+		[]types.InstanceStateName{types.InstanceStateNameStopped, types.InstanceStateNameRunning}, types.InstanceStateNamePending)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+func (f *FakeEC2) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes, err := f.changeState("StopInstances", params.InstanceIds,
+		[]types.InstanceStateName{types.InstanceStateNamePending, types.InstanceStateNameRunning, types.InstanceStateNameStopped}, types.InstanceStateNameStopping)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+func (f *FakeEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes, err := f.changeState("TerminateInstances", params.InstanceIds,
+		[]types.InstanceStateName{
+			types.InstanceStateNamePending, types.InstanceStateNameRunning, types.InstanceStateNameStopping,
+			types.InstanceStateNameStopped, types.InstanceStateNameTerminated,
+		}, types.InstanceStateNameShuttingDown)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+}
+
+func (f *FakeEC2) ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyInstanceAttribute"); err != nil {
+		return nil, err
+	}
+	i, ok := f.Instances[aws.ToString(params.InstanceId)]
+	if !ok {
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.ToString(params.InstanceId))
+	}
+	if len(params.Groups) > 0 {
+		var groups []types.GroupIdentifier
+		for _, id := range params.Groups {
+			sg, ok := f.SecurityGroups[id]
+			if !ok {
+				return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+			}
+			if i.VpcId != nil && aws.ToString(sg.VpcId) != *i.VpcId {
+				return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist in VPC '%s'", id, *i.VpcId)
+			}
+			groups = append(groups, types.GroupIdentifier{GroupId: sg.GroupId, GroupName: sg.GroupName})
+		}
+		i.SecurityGroups = groups
+	}
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+// releaseInstanceResources detaches volumes and addresses of a terminated instance,
+// deleting the volumes flagged DeleteOnTermination.
+func (f *FakeEC2) releaseInstanceResources(i *types.Instance) {
+	for id, v := range f.Volumes {
+		var kept []types.VolumeAttachment
+		for _, att := range v.Attachments {
+			if aws.ToString(att.InstanceId) != *i.InstanceId {
+				kept = append(kept, att)
+			} else if aws.ToBool(att.DeleteOnTermination) {
+				delete(f.Volumes, id)
+			}
+		}
+		v.Attachments = kept
+		if len(kept) == 0 {
+			v.State = types.VolumeStateAvailable
+		}
+	}
+	i.BlockDeviceMappings = nil
+	for _, a := range f.Addresses {
+		if aws.ToString(a.InstanceId) == *i.InstanceId {
+			a.InstanceId = nil
+			a.AssociationId = nil
+		}
+	}
+	i.PublicIpAddress = nil
+}
@@ -0,0 +1,563 @@
+package awstest
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"reflect"
+)
+
+func vpcAttributes(v *types.Vpc) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "vpc-id":
+			return []string{*v.VpcId}, true
+		case "isDefault", "is-default":
+			return []string{fmt.Sprintf("%t", aws.ToBool(v.IsDefault))}, true
+		case "state":
+			return []string{string(v.State)}, true
+		}
+		return tagAttributes(v.Tags, name)
+	}
+}
+
+func (f *FakeEC2) DescribeVpcs(ctx context.Context, params *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVpcs"); err != nil {
+		return nil, err
+	}
+	for _, id := range params.VpcIds {
+		if _, ok := f.Vpcs[id]; !ok {
+			return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeVpcsOutput{}
+	for _, id := range sortedKeys(f.Vpcs) {
+		v := f.Vpcs[id]
+		if len(params.VpcIds) > 0 && !containsString(params.VpcIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, vpcAttributes(v)); err != nil {
+			return nil, err
+		} else if ok {
+			vpc := *v
+			vpc.Tags = append([]types.Tag{}, v.Tags...)
+			out.Vpcs = append(out.Vpcs, vpc)
+		}
+	}
+	var err error
+	out.Vpcs, out.NextToken, err = page(f, out.Vpcs, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateDefaultVpc(ctx context.Context, params *ec2.CreateDefaultVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateDefaultVpcOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateDefaultVpc"); err != nil {
+		return nil, err
+	}
+	for _, v := range f.Vpcs {
+		if aws.ToBool(v.IsDefault) {
+			return nil, apiError("DefaultVpcAlreadyExists", "A Default VPC already exists for this account in this region.")
+		}
+	}
+	v := f.createVpc(true, "172.31.0.0/16")
+	vpc := *v
+	return &ec2.CreateDefaultVpcOutput{Vpc: &vpc}, nil
+}
+
+func subnetAttributes(sn *types.Subnet) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "subnet-id":
+			return []string{*sn.SubnetId}, true
+		case "vpc-id":
+			return []string{aws.ToString(sn.VpcId)}, true
+		case "availability-zone":
+			return []string{aws.ToString(sn.AvailabilityZone)}, true
+		case "cidr-block":
+			return []string{aws.ToString(sn.CidrBlock)}, true
+		case "state":
+			return []string{string(sn.State)}, true
+		}
+		return tagAttributes(sn.Tags, name)
+	}
+}
+
+func (f *FakeEC2) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+	for _, id := range params.SubnetIds {
+		if _, ok := f.Subnets[id]; !ok {
+			return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range sortedKeys(f.Subnets) {
+		sn := f.Subnets[id]
+		if len(params.SubnetIds) > 0 && !containsString(params.SubnetIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, subnetAttributes(sn)); err != nil {
+			return nil, err
+		} else if ok {
+			subnet := *sn
+			subnet.Tags = append([]types.Tag{}, sn.Tags...)
+			out.Subnets = append(out.Subnets, subnet)
+		}
+	}
+	var err error
+	out.Subnets, out.NextToken, err = page(f, out.Subnets, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func securityGroupAttributes(sg *types.SecurityGroup) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "group-id":
+			return []string{*sg.GroupId}, true
+		case "group-name":
+			return []string{aws.ToString(sg.GroupName)}, true
+		case "vpc-id":
+			return []string{aws.ToString(sg.VpcId)}, true
+		}
+		return tagAttributes(sg.Tags, name)
+	}
+}
+
+func copySecurityGroup(sg *types.SecurityGroup) types.SecurityGroup {
+	result := *sg
+	result.Tags = append([]types.Tag{}, sg.Tags...)
+	result.IpPermissions = append([]types.IpPermission{}, sg.IpPermissions...)
+	return result
+}
+
+func (f *FakeEC2) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+	for _, id := range params.GroupIds {
+		if _, ok := f.SecurityGroups[id]; !ok {
+			return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range sortedKeys(f.SecurityGroups) {
+		sg := f.SecurityGroups[id]
+		if len(params.GroupIds) > 0 && !containsString(params.GroupIds, id) {
+			continue
+		}
+		if len(params.GroupNames) > 0 && !containsString(params.GroupNames, aws.ToString(sg.GroupName)) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, securityGroupAttributes(sg)); err != nil {
+			return nil, err
+		} else if ok {
+			out.SecurityGroups = append(out.SecurityGroups, copySecurityGroup(sg))
+		}
+	}
+	var err error
+	out.SecurityGroups, out.NextToken, err = page(f, out.SecurityGroups, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSecurityGroup"); err != nil {
+		return nil, err
+	}
+	if params.VpcId != nil {
+		if _, ok := f.Vpcs[*params.VpcId]; !ok {
+			return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", *params.VpcId)
+		}
+	}
+	for _, sg := range f.SecurityGroups {
+		if aws.ToString(sg.GroupName) == aws.ToString(params.GroupName) && aws.ToString(sg.VpcId) == aws.ToString(params.VpcId) {
+			return nil, apiError("InvalidGroup.Duplicate", "The security group '%s' already exists for VPC '%s'", *params.GroupName, aws.ToString(params.VpcId))
+		}
+	}
+	sg := &types.SecurityGroup{
+		GroupId:     aws.String(f.nextId("sg")),
+		GroupName:   params.GroupName,
+		Description: params.Description,
+		VpcId:       params.VpcId,
+		Tags:        tagsFor(params.TagSpecifications, types.ResourceTypeSecurityGroup),
+	}
+	f.SecurityGroups[*sg.GroupId] = sg
+	return &ec2.CreateSecurityGroupOutput{GroupId: sg.GroupId}, nil
+}
+
+func (f *FakeEC2) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSecurityGroup"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	id := aws.ToString(params.GroupId)
+	if _, ok := f.SecurityGroups[id]; !ok {
+		return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	}
+	for _, i := range f.Instances {
+		if i.State.Name == types.InstanceStateNameTerminated {
+			continue
+		}
+		for _, g := range i.SecurityGroups {
+			if aws.ToString(g.GroupId) == id {
+				return nil, apiError("DependencyViolation", "resource %s has a dependent object", id)
+			}
+		}
+	}
+	for otherId, other := range f.SecurityGroups {
+		if otherId == id {
+			continue
+		}
+		for _, perm := range other.IpPermissions {
+			for _, pair := range perm.UserIdGroupPairs {
+				if aws.ToString(pair.GroupId) == id {
+					return nil, apiError("DependencyViolation", "resource %s has a dependent object", id)
+				}
+			}
+		}
+	}
+	delete(f.SecurityGroups, id)
+	delete(f.ruleIds, id)
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *FakeEC2) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+	sg, ok := f.SecurityGroups[aws.ToString(params.GroupId)]
+	if !ok {
+		return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", aws.ToString(params.GroupId))
+	}
+	var added []types.IpPermission
+	for _, perm := range params.IpPermissions {
+		for _, single := range splitPermission(perm) {
+			if indexOfPermission(sg.IpPermissions, single) != -1 || indexOfPermission(added, single) != -1 {
+				return nil, apiError("InvalidPermission.Duplicate", "the specified rule already exists in %s", *sg.GroupId)
+			}
+			added = append(added, single)
+		}
+	}
+	for _, single := range added {
+		sg.IpPermissions = append(sg.IpPermissions, single)
+		f.ruleIds[*sg.GroupId] = append(f.ruleIds[*sg.GroupId], f.nextId("sgr"))
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{Return: aws.Bool(true)}, nil
+}
+
+func (f *FakeEC2) RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RevokeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+	sg, ok := f.SecurityGroups[aws.ToString(params.GroupId)]
+	if !ok {
+		return nil, apiError("InvalidGroup.NotFound", "The security group '%s' does not exist", aws.ToString(params.GroupId))
+	}
+	var indexes []int
+	for _, perm := range params.IpPermissions {
+		for _, single := range splitPermission(perm) {
+			index := indexOfPermission(sg.IpPermissions, single)
+			if index == -1 {
+				return nil, apiError("InvalidPermission.NotFound", "The specified rule does not exist in this security group.")
+			}
+			indexes = append(indexes, index)
+		}
+	}
+	for _, ruleId := range params.SecurityGroupRuleIds {
+		index := -1
+		for i, id := range f.ruleIds[*sg.GroupId] {
+			if id == ruleId {
+				index = i
+			}
+		}
+		if index == -1 {
+			return nil, apiError("InvalidSecurityGroupRuleId.NotFound", "The security group rule ID '%s' does not exist", ruleId)
+		}
+		indexes = append(indexes, index)
+	}
+	var kept []types.IpPermission
+	var keptIds []string
+	for index, perm := range sg.IpPermissions {
+		var revoked bool
+		for _, i := range indexes {
+			revoked = revoked || i == index
+		}
+		if !revoked {
+			kept = append(kept, perm)
+			keptIds = append(keptIds, f.ruleIds[*sg.GroupId][index])
+		}
+	}
+	sg.IpPermissions = kept
+	f.ruleIds[*sg.GroupId] = keptIds
+	return &ec2.RevokeSecurityGroupIngressOutput{Return: aws.Bool(true)}, nil
+}
+
+// splitPermission returns one permission per source, as EC2 stores rules.
+func splitPermission(perm types.IpPermission) (result []types.IpPermission) {
+	base := types.IpPermission{
+		IpProtocol: perm.IpProtocol,
+		FromPort:   perm.FromPort,
+		ToPort:     perm.ToPort,
+	}
+	for _, r := range perm.IpRanges {
+		p := base
+		p.IpRanges = []types.IpRange{{CidrIp: r.CidrIp, Description: r.Description}}
+		result = append(result, p)
+	}
+	for _, r := range perm.Ipv6Ranges {
+		p := base
+		p.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: r.CidrIpv6, Description: r.Description}}
+		result = append(result, p)
+	}
+	for _, pair := range perm.UserIdGroupPairs {
+		p := base
+		p.UserIdGroupPairs = []types.UserIdGroupPair{{GroupId: pair.GroupId, Description: pair.Description}}
+		result = append(result, p)
+	}
+	return
+}
+
+// indexOfPermission finds a single source permission, descriptions do not identify a rule.
+func indexOfPermission(perms []types.IpPermission, perm types.IpPermission) int {
+	for index, p := range perms {
+		if reflect.DeepEqual(withoutDescription(p), withoutDescription(perm)) {
+			return index
+		}
+	}
+	return -1
+}
+
+func withoutDescription(perm types.IpPermission) types.IpPermission {
+	result := types.IpPermission{
+		IpProtocol: perm.IpProtocol,
+		FromPort:   perm.FromPort,
+		ToPort:     perm.ToPort,
+	}
+	for _, r := range perm.IpRanges {
+		result.IpRanges = append(result.IpRanges, types.IpRange{CidrIp: r.CidrIp})
+	}
+	for _, r := range perm.Ipv6Ranges {
+		result.Ipv6Ranges = append(result.Ipv6Ranges, types.Ipv6Range{CidrIpv6: r.CidrIpv6})
+	}
+	for _, pair := range perm.UserIdGroupPairs {
+		result.UserIdGroupPairs = append(result.UserIdGroupPairs, types.UserIdGroupPair{GroupId: pair.GroupId})
+	}
+	return result
+}
+
+func (f *FakeEC2) DescribeSecurityGroupRules(ctx context.Context, params *ec2.DescribeSecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSecurityGroupRules"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeSecurityGroupRulesOutput{}
+	for _, id := range sortedKeys(f.SecurityGroups) {
+		sg := f.SecurityGroups[id]
+		for index, perm := range sg.IpPermissions {
+			rule := types.SecurityGroupRule{
+				SecurityGroupRuleId: aws.String(f.ruleIds[id][index]),
+				GroupId:             sg.GroupId,
+				IsEgress:            aws.Bool(false),
+				IpProtocol:          perm.IpProtocol,
+				FromPort:            aws.Int32(-1),
+				ToPort:              aws.Int32(-1),
+			}
+			if perm.FromPort != nil {
+				rule.FromPort = perm.FromPort
+			}
+			if perm.ToPort != nil {
+				rule.ToPort = perm.ToPort
+			}
+			switch {
+			case len(perm.IpRanges) > 0:
+				rule.CidrIpv4 = perm.IpRanges[0].CidrIp
+				rule.Description = perm.IpRanges[0].Description
+			case len(perm.Ipv6Ranges) > 0:
+				rule.CidrIpv6 = perm.Ipv6Ranges[0].CidrIpv6
+				rule.Description = perm.Ipv6Ranges[0].Description
+			case len(perm.UserIdGroupPairs) > 0:
+				rule.ReferencedGroupInfo = &types.ReferencedSecurityGroup{GroupId: perm.UserIdGroupPairs[0].GroupId}
+				rule.Description = perm.UserIdGroupPairs[0].Description
+			}
+			if len(params.SecurityGroupRuleIds) > 0 && !containsString(params.SecurityGroupRuleIds, *rule.SecurityGroupRuleId) {
+				continue
+			}
+			if ok, err := matchFilters(params.Filters, func(name string) ([]string, bool) {
+				switch name {
+				case "group-id":
+					return []string{id}, true
+				case "security-group-rule-id":
+					return []string{*rule.SecurityGroupRuleId}, true
+				}
+				return tagAttributes(nil, name)
+			}); err != nil {
+				return nil, err
+			} else if ok {
+				out.SecurityGroupRules = append(out.SecurityGroupRules, rule)
+			}
+		}
+	}
+	var err error
+	out.SecurityGroupRules, out.NextToken, err = page(f, out.SecurityGroupRules, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func addressAttributes(a *types.Address) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "allocation-id":
+			return []string{aws.ToString(a.AllocationId)}, true
+		case "public-ip":
+			return []string{aws.ToString(a.PublicIp)}, true
+		case "instance-id":
+			return []string{aws.ToString(a.InstanceId)}, true
+		case "association-id":
+			return []string{aws.ToString(a.AssociationId)}, true
+		}
+		return tagAttributes(a.Tags, name)
+	}
+}
+
+func (f *FakeEC2) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeAddresses"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeAddressesOutput{}
+	for _, id := range sortedKeys(f.Addresses) {
+		a := f.Addresses[id]
+		if len(params.AllocationIds) > 0 && !containsString(params.AllocationIds, id) {
+			continue
+		}
+		if len(params.PublicIps) > 0 && !containsString(params.PublicIps, aws.ToString(a.PublicIp)) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, addressAttributes(a)); err != nil {
+			return nil, err
+		} else if ok {
+			address := *a
+			address.Tags = append([]types.Tag{}, a.Tags...)
+			out.Addresses = append(out.Addresses, address)
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AssociateAddress"); err != nil {
+		return nil, err
+	}
+	var address *types.Address
+	for _, a := range f.Addresses {
+		if (params.AllocationId != nil && aws.ToString(a.AllocationId) == *params.AllocationId) ||
+			(params.PublicIp != nil && aws.ToString(a.PublicIp) == *params.PublicIp) {
+			address = a
+		}
+	}
+	if address == nil {
+		return nil, apiError("InvalidAddress.NotFound", "Address %s not found", aws.ToString(params.PublicIp)+aws.ToString(params.AllocationId))
+	}
+	i, ok := f.Instances[aws.ToString(params.InstanceId)]
+	if !ok {
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.ToString(params.InstanceId))
+	}
+	if i.State.Name != types.InstanceStateNameRunning && i.State.Name != types.InstanceStateNameStopped {
+		return nil, apiError("IncorrectInstanceState", "The instance '%s' is not in a valid state for this operation", *i.InstanceId)
+	}
+	address.InstanceId = i.InstanceId
+	address.AssociationId = aws.String(f.nextId("eipassoc"))
+	address.PrivateIpAddress = i.PrivateIpAddress
+	i.PublicIpAddress = address.PublicIp
+	return &ec2.AssociateAddressOutput{AssociationId: address.AssociationId}, nil
+}
+
+func (f *FakeEC2) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AllocateAddress"); err != nil {
+		return nil, err
+	}
+	f.seq++
+	a := &types.Address{
+		AllocationId: aws.String(f.nextId("eipalloc")),
+		PublicIp:     aws.String(fmt.Sprintf("3.0.%d.%d", f.seq/250, f.seq%250+1)),
+		Domain:       types.DomainTypeVpc,
+		Tags:         tagsFor(params.TagSpecifications, types.ResourceTypeElasticIp),
+	}
+	f.Addresses[*a.AllocationId] = a
+	return &ec2.AllocateAddressOutput{
+		AllocationId: a.AllocationId,
+		PublicIp:     a.PublicIp,
+		Domain:       a.Domain,
+	}, nil
+}
+
+func (f *FakeEC2) DisassociateAddress(ctx context.Context, params *ec2.DisassociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateAddressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DisassociateAddress"); err != nil {
+		return nil, err
+	}
+	for _, a := range f.Addresses {
+		if a.AssociationId != nil && *a.AssociationId == aws.ToString(params.AssociationId) {
+			if i, ok := f.Instances[aws.ToString(a.InstanceId)]; ok {
+				i.PublicIpAddress = nil
+			}
+			a.AssociationId = nil
+			a.InstanceId = nil
+			a.PrivateIpAddress = nil
+			return &ec2.DisassociateAddressOutput{}, nil
+		}
+	}
+	return nil, apiError("InvalidAssociationID.NotFound", "The association ID '%s' does not exist", aws.ToString(params.AssociationId))
+}
+
+func (f *FakeEC2) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ReleaseAddress"); err != nil {
+		return nil, err
+	}
+	a, ok := f.Addresses[aws.ToString(params.AllocationId)]
+	if !ok {
+		return nil, apiError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", aws.ToString(params.AllocationId))
+	}
+	if a.AssociationId != nil {
+		return nil, apiError("InvalidIPAddress.InUse", "Address %s is in use.", aws.ToString(a.PublicIp))
+	}
+	delete(f.Addresses, *a.AllocationId)
+	return &ec2.ReleaseAddressOutput{}, nil
+}
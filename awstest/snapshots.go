@@ -0,0 +1,112 @@
+package awstest
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"time"
+)
+
+func snapshotAttributes(s *types.Snapshot) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "snapshot-id":
+			return []string{*s.SnapshotId}, true
+		case "status":
+			return []string{string(s.State)}, true
+		case "volume-id":
+			return []string{aws.ToString(s.VolumeId)}, true
+		}
+		return tagAttributes(s.Tags, name)
+	}
+}
+
+func copySnapshot(s *types.Snapshot) types.Snapshot {
+	result := *s
+	result.Tags = append([]types.Tag{}, s.Tags...)
+	return result
+}
+
+func (f *FakeEC2) CreateSnapshot(ctx context.Context, params *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(params.VolumeId))
+	}
+	s := &types.Snapshot{
+		SnapshotId:  aws.String(f.nextId("snap")),
+		VolumeId:    v.VolumeId,
+		VolumeSize:  v.Size,
+		Description: params.Description,
+		Encrypted:   v.Encrypted,
+		KmsKeyId:    v.KmsKeyId,
+		OwnerId:     aws.String("123456789012"),
+		StartTime:   aws.Time(time.Now()),
+		State:       types.SnapshotStatePending,
+		Tags:        tagsFor(params.TagSpecifications, types.ResourceTypeSnapshot),
+	}
+	f.Snapshots[*s.SnapshotId] = s
+	return &ec2.CreateSnapshotOutput{
+		SnapshotId:  s.SnapshotId,
+		VolumeId:    s.VolumeId,
+		VolumeSize:  s.VolumeSize,
+		Description: s.Description,
+		Encrypted:   s.Encrypted,
+		KmsKeyId:    s.KmsKeyId,
+		OwnerId:     s.OwnerId,
+		StartTime:   s.StartTime,
+		State:       s.State,
+		Tags:        append([]types.Tag{}, s.Tags...),
+	}, nil
+}
+
+func (f *FakeEC2) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	for _, id := range params.SnapshotIds {
+		if _, ok := f.Snapshots[id]; !ok {
+			return nil, apiError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+		}
+	}
+	out := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range sortedKeys(f.Snapshots) {
+		s := f.Snapshots[id]
+		if len(params.SnapshotIds) > 0 && !containsString(params.SnapshotIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, snapshotAttributes(s)); err != nil {
+			return nil, err
+		} else if ok {
+			out.Snapshots = append(out.Snapshots, copySnapshot(s))
+		}
+	}
+	var err error
+	out.Snapshots, out.NextToken, err = page(f, out.Snapshots, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	id := aws.ToString(params.SnapshotId)
+	if _, ok := f.Snapshots[id]; !ok {
+		return nil, apiError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+	}
+	delete(f.Snapshots, id)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
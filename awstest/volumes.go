@@ -0,0 +1,343 @@
+package awstest
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"time"
+)
+
+func volumeAttributes(v *types.Volume) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "volume-id":
+			return []string{*v.VolumeId}, true
+		case "status":
+			return []string{string(v.State)}, true
+		case "availability-zone":
+			return []string{aws.ToString(v.AvailabilityZone)}, true
+		case "attachment.instance-id":
+			var ids []string
+			for _, att := range v.Attachments {
+				ids = append(ids, aws.ToString(att.InstanceId))
+			}
+			return ids, true
+		}
+		return tagAttributes(v.Tags, name)
+	}
+}
+
+func copyVolume(v *types.Volume) types.Volume {
+	result := *v
+	result.Tags = append([]types.Tag{}, v.Tags...)
+	result.Attachments = append([]types.VolumeAttachment{}, v.Attachments...)
+	return result
+}
+
+func (f *FakeEC2) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVolumes"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	for _, id := range params.VolumeIds {
+		if _, ok := f.Volumes[id]; !ok {
+			return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", id)
+		}
+	}
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range sortedKeys(f.Volumes) {
+		v := f.Volumes[id]
+		if len(params.VolumeIds) > 0 && !containsString(params.VolumeIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, volumeAttributes(v)); err != nil {
+			return nil, err
+		} else if ok {
+			out.Volumes = append(out.Volumes, copyVolume(v))
+		}
+	}
+	var err error
+	out.Volumes, out.NextToken, err = page(f, out.Volumes, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateVolume"); err != nil {
+		return nil, err
+	}
+	if params.AvailabilityZone == nil {
+		return nil, apiError("MissingParameter", "The request must contain the parameter availabilityZone")
+	}
+	if token := aws.ToString(params.ClientToken); token != "" {
+		if id, ok := f.tokens[token]; ok {
+			v, ok := f.Volumes[id]
+			if !ok {
+				// deleted volumes are still known by their token
+				return &ec2.CreateVolumeOutput{VolumeId: aws.String(id), State: types.VolumeStateDeleted, AvailabilityZone: params.AvailabilityZone}, nil
+			}
+			if aws.ToInt32(v.Size) != aws.ToInt32(params.Size) || aws.ToString(v.AvailabilityZone) != aws.ToString(params.AvailabilityZone) {
+				return nil, apiError("IdempotentParameterMismatch", "The client token %s was already used with different parameters", token)
+			}
+			return createVolumeOutput(v), nil
+		}
+	}
+	size := params.Size
+	if id := aws.ToString(params.SnapshotId); id != "" {
+		snap, ok := f.Snapshots[id]
+		if !ok {
+			return nil, apiError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+		}
+		if size == nil {
+			size = snap.VolumeSize
+		} else if *size < aws.ToInt32(snap.VolumeSize) {
+			return nil, apiError("InvalidParameterValue", "Volume of %dGiB is too small; minimum is %dGiB.", *size, aws.ToInt32(snap.VolumeSize))
+		}
+	}
+	volumeType := params.VolumeType
+	if volumeType == "" {
+		volumeType = types.VolumeTypeGp2
+	}
+	v := &types.Volume{
+		VolumeId:         aws.String(f.nextId("vol")),
+		AvailabilityZone: params.AvailabilityZone,
+		CreateTime:       aws.Time(time.Now()),
+		Encrypted:        aws.Bool(aws.ToBool(params.Encrypted)),
+		Iops:             params.Iops,
+		KmsKeyId:         params.KmsKeyId,
+		Size:             size,
+		SnapshotId:       params.SnapshotId,
+		State:            types.VolumeStateCreating,
+		Tags:             tagsFor(params.TagSpecifications, types.ResourceTypeVolume),
+		Throughput:       params.Throughput,
+		VolumeType:       volumeType,
+	}
+	f.Volumes[*v.VolumeId] = v
+	if token := aws.ToString(params.ClientToken); token != "" {
+		f.tokens[token] = *v.VolumeId
+	}
+	return createVolumeOutput(v), nil
+}
+
+func createVolumeOutput(v *types.Volume) *ec2.CreateVolumeOutput {
+	return &ec2.CreateVolumeOutput{
+		AvailabilityZone: v.AvailabilityZone,
+		CreateTime:       v.CreateTime,
+		Encrypted:        v.Encrypted,
+		Iops:             v.Iops,
+		KmsKeyId:         v.KmsKeyId,
+		Size:             v.Size,
+		SnapshotId:       v.SnapshotId,
+		State:            v.State,
+		Tags:             append([]types.Tag{}, v.Tags...),
+		Throughput:       v.Throughput,
+		VolumeId:         v.VolumeId,
+		VolumeType:       v.VolumeType,
+	}
+}
+
+func (f *FakeEC2) AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AttachVolume"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	v, ok := f.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(params.VolumeId))
+	}
+	i, ok := f.Instances[aws.ToString(params.InstanceId)]
+	if !ok {
+		return nil, apiError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.ToString(params.InstanceId))
+	}
+	if v.State != types.VolumeStateAvailable {
+		return nil, apiError("VolumeInUse", "%s is already attached to an instance", *v.VolumeId)
+	}
+	if aws.ToString(v.AvailabilityZone) != aws.ToString(i.Placement.AvailabilityZone) {
+		return nil, apiError("InvalidVolume.ZoneMismatch", "The volume '%s' is not in the same availability zone as instance '%s'", *v.VolumeId, *i.InstanceId)
+	}
+	for _, mapping := range i.BlockDeviceMappings {
+		if aws.ToString(mapping.DeviceName) == aws.ToString(params.Device) {
+			return nil, apiError("InvalidParameterValue", "Invalid value '%s' for unixDevice. Attachment point %s is already in use", *params.Device, *params.Device)
+		}
+	}
+	att := types.VolumeAttachment{
+		Device:              params.Device,
+		InstanceId:          i.InstanceId,
+		VolumeId:            v.VolumeId,
+		State:               types.VolumeAttachmentStateAttached,
+		AttachTime:          aws.Time(time.Now()),
+		DeleteOnTermination: aws.Bool(false),
+	}
+	v.Attachments = append(v.Attachments, att)
+	v.State = types.VolumeStateInUse
+	i.BlockDeviceMappings = append(i.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+		DeviceName: params.Device,
+		Ebs: &types.EbsInstanceBlockDevice{
+			VolumeId:            v.VolumeId,
+			Status:              types.AttachmentStatusAttached,
+			DeleteOnTermination: aws.Bool(false),
+		},
+	})
+	return &ec2.AttachVolumeOutput{
+		Device:     att.Device,
+		InstanceId: att.InstanceId,
+		VolumeId:   att.VolumeId,
+		State:      types.VolumeAttachmentStateAttaching,
+		AttachTime: att.AttachTime,
+	}, nil
+}
+
+// DetachVolume starts detaching the volume, it is available on the next describe call.
+func (f *FakeEC2) DetachVolume(ctx context.Context, params *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DetachVolume"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(params.VolumeId))
+	}
+	for index := range v.Attachments {
+		att := &v.Attachments[index]
+		if params.InstanceId != nil && aws.ToString(att.InstanceId) != *params.InstanceId {
+			continue
+		}
+		if att.State != types.VolumeAttachmentStateAttached {
+			return nil, apiError("IncorrectState", "Volume '%s' is %s.", *v.VolumeId, att.State)
+		}
+		att.State = types.VolumeAttachmentStateDetaching
+		return &ec2.DetachVolumeOutput{
+			Device:     att.Device,
+			InstanceId: att.InstanceId,
+			VolumeId:   v.VolumeId,
+			State:      att.State,
+			AttachTime: att.AttachTime,
+		}, nil
+	}
+	return nil, apiError("IncorrectState", "Volume '%s' is in the '%s' state.", *v.VolumeId, v.State)
+}
+
+// detachVolumes completes the detachments in progress.
+func (f *FakeEC2) detachVolumes() {
+	for _, v := range f.Volumes {
+		var kept []types.VolumeAttachment
+		for _, att := range v.Attachments {
+			if att.State != types.VolumeAttachmentStateDetaching {
+				kept = append(kept, att)
+				continue
+			}
+			if i, ok := f.Instances[aws.ToString(att.InstanceId)]; ok {
+				var mappings []types.InstanceBlockDeviceMapping
+				for _, mapping := range i.BlockDeviceMappings {
+					if mapping.Ebs == nil || aws.ToString(mapping.Ebs.VolumeId) != *v.VolumeId {
+						mappings = append(mappings, mapping)
+					}
+				}
+				i.BlockDeviceMappings = mappings
+			}
+		}
+		if len(kept) != len(v.Attachments) {
+			v.Attachments = kept
+			if len(kept) == 0 {
+				v.State = types.VolumeStateAvailable
+			}
+		}
+	}
+}
+
+func (f *FakeEC2) DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteVolume"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	v, ok := f.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(params.VolumeId))
+	}
+	if v.State != types.VolumeStateAvailable {
+		return nil, apiError("VolumeInUse", "Volume %s is currently attached", *v.VolumeId)
+	}
+	delete(f.Volumes, *v.VolumeId)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+// ModifyVolume applies the new size, type and performance at once, the modification then goes through optimizing
+// to completed on the next describe calls. Like EC2, it refuses to shrink a volume or to modify it again before the
+// previous modification is completed.
+func (f *FakeEC2) ModifyVolume(ctx context.Context, params *ec2.ModifyVolumeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyVolume"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.ToString(params.VolumeId)]
+	if !ok {
+		return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(params.VolumeId))
+	}
+	if m, ok := f.Modifications[*v.VolumeId]; ok && m.ModificationState != types.VolumeModificationStateCompleted && m.ModificationState != types.VolumeModificationStateFailed {
+		return nil, apiError("IncorrectModificationState", "Cannot modify volume %s as it is in modification state %s", *v.VolumeId, m.ModificationState)
+	}
+	if params.Size != nil && *params.Size < aws.ToInt32(v.Size) {
+		return nil, apiError("InvalidParameterValue", "New size cannot be smaller than existing size")
+	}
+	m := &types.VolumeModification{
+		VolumeId:           v.VolumeId,
+		ModificationState:  types.VolumeModificationStateModifying,
+		OriginalSize:       v.Size,
+		OriginalVolumeType: v.VolumeType,
+		OriginalIops:       v.Iops,
+		OriginalThroughput: v.Throughput,
+		Progress:           aws.Int64(0),
+		StartTime:          aws.Time(time.Now()),
+	}
+	if params.Size != nil {
+		v.Size = params.Size
+	}
+	if params.VolumeType != "" {
+		v.VolumeType = params.VolumeType
+	}
+	if params.Iops != nil {
+		v.Iops = params.Iops
+	}
+	if params.Throughput != nil {
+		v.Throughput = params.Throughput
+	}
+	m.TargetSize, m.TargetVolumeType, m.TargetIops, m.TargetThroughput = v.Size, v.VolumeType, v.Iops, v.Throughput
+	f.Modifications[*v.VolumeId] = m
+	result := *m
+	return &ec2.ModifyVolumeOutput{VolumeModification: &result}, nil
+}
+
+func (f *FakeEC2) DescribeVolumesModifications(ctx context.Context, params *ec2.DescribeVolumesModificationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesModificationsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVolumesModifications"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	for _, id := range params.VolumeIds {
+		if _, ok := f.Volumes[id]; !ok {
+			return nil, apiError("InvalidVolume.NotFound", "The volume '%s' does not exist.", id)
+		}
+	}
+	out := &ec2.DescribeVolumesModificationsOutput{}
+	for _, id := range sortedKeys(f.Modifications) {
+		if len(params.VolumeIds) > 0 && !containsString(params.VolumeIds, id) {
+			continue
+		}
+		out.VolumesModifications = append(out.VolumesModifications, *f.Modifications[id])
+	}
+	return out, nil
+}
@@ -0,0 +1,516 @@
+package awstest
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"net"
+)
+
+// Zones returns the availability zones of the region, a, b and c.
+func (f *FakeEC2) Zones() []string {
+	return []string{f.Region + "a", f.Region + "b", f.Region + "c"}
+}
+
+func (f *FakeEC2) DescribeAvailabilityZones(ctx context.Context, params *ec2.DescribeAvailabilityZonesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeAvailabilityZones"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeAvailabilityZonesOutput{}
+	for _, name := range f.Zones() {
+		zone := types.AvailabilityZone{
+			ZoneName:   aws.String(name),
+			ZoneType:   aws.String("availability-zone"),
+			RegionName: aws.String(f.Region),
+			State:      types.AvailabilityZoneStateAvailable,
+		}
+		if len(params.ZoneNames) > 0 && !containsString(params.ZoneNames, name) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, func(filter string) ([]string, bool) {
+			switch filter {
+			case "zone-name":
+				return []string{name}, true
+			case "zone-type":
+				return []string{*zone.ZoneType}, true
+			case "region-name":
+				return []string{f.Region}, true
+			case "state":
+				return []string{string(zone.State)}, true
+			}
+			return nil, false
+		}); err != nil {
+			return nil, err
+		} else if ok {
+			out.AvailabilityZones = append(out.AvailabilityZones, zone)
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateVpc(ctx context.Context, params *ec2.CreateVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateVpcOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateVpc"); err != nil {
+		return nil, err
+	}
+	_, network, err := net.ParseCIDR(aws.ToString(params.CidrBlock))
+	if err != nil {
+		return nil, apiError("InvalidParameterValue", "Value (%s) for parameter cidrBlock is invalid. This is not a valid CIDR block.", aws.ToString(params.CidrBlock))
+	}
+	if ones, _ := network.Mask.Size(); ones < 16 || ones > 28 {
+		return nil, apiError("InvalidVpc.Range", "The CIDR '%s' is invalid.", aws.ToString(params.CidrBlock))
+	}
+	v := f.createVpc(false, network.String())
+	v.Tags = tagsFor(params.TagSpecifications, types.ResourceTypeVpc)
+	vpc := *v
+	return &ec2.CreateVpcOutput{Vpc: &vpc}, nil
+}
+
+func (f *FakeEC2) ModifyVpcAttribute(ctx context.Context, params *ec2.ModifyVpcAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVpcAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyVpcAttribute"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Vpcs[aws.ToString(params.VpcId)]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.ToString(params.VpcId))
+	}
+	return &ec2.ModifyVpcAttributeOutput{}, nil
+}
+
+func (f *FakeEC2) DeleteVpc(ctx context.Context, params *ec2.DeleteVpcInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVpcOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteVpc"); err != nil {
+		return nil, err
+	}
+	id := aws.ToString(params.VpcId)
+	if _, ok := f.Vpcs[id]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+	}
+	dependency := apiError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted.", id)
+	for _, sn := range f.Subnets {
+		if aws.ToString(sn.VpcId) == id {
+			return nil, dependency
+		}
+	}
+	for _, g := range f.Gateways {
+		for _, att := range g.Attachments {
+			if aws.ToString(att.VpcId) == id {
+				return nil, dependency
+			}
+		}
+	}
+	for _, sg := range f.SecurityGroups {
+		if aws.ToString(sg.VpcId) == id {
+			return nil, dependency
+		}
+	}
+	for tableId, t := range f.RouteTables {
+		if aws.ToString(t.VpcId) == id {
+			if !isMainRouteTable(t) {
+				return nil, dependency
+			}
+			delete(f.RouteTables, tableId)
+		}
+	}
+	delete(f.Vpcs, id)
+	return &ec2.DeleteVpcOutput{}, nil
+}
+
+func (f *FakeEC2) CreateSubnet(ctx context.Context, params *ec2.CreateSubnetInput, optFns ...func(*ec2.Options)) (*ec2.CreateSubnetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSubnet"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Vpcs[aws.ToString(params.VpcId)]
+	if !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.ToString(params.VpcId))
+	}
+	az := aws.ToString(params.AvailabilityZone)
+	if az == "" {
+		az = f.defaultAz()
+	}
+	if !containsString(f.Zones(), az) {
+		return nil, apiError("InvalidParameterValue", "Value (%s) for parameter availabilityZone is invalid. Subnets can currently only be created in the following availability zones: %v.", az, f.Zones())
+	}
+	_, network, err := net.ParseCIDR(aws.ToString(params.CidrBlock))
+	if err != nil {
+		return nil, apiError("InvalidParameterValue", "Value (%s) for parameter cidrBlock is invalid. This is not a valid CIDR block.", aws.ToString(params.CidrBlock))
+	}
+	_, vpcNetwork, _ := net.ParseCIDR(aws.ToString(v.CidrBlock))
+	if !containsNetwork(vpcNetwork, network) {
+		return nil, apiError("InvalidSubnet.Range", "The CIDR '%s' is invalid.", network)
+	}
+	for _, other := range f.Subnets {
+		if aws.ToString(other.VpcId) != *v.VpcId {
+			continue
+		}
+		_, otherNetwork, _ := net.ParseCIDR(aws.ToString(other.CidrBlock))
+		if otherNetwork.Contains(network.IP) || network.Contains(otherNetwork.IP) {
+			return nil, apiError("InvalidSubnet.Conflict", "The CIDR '%s' conflicts with another subnet", network)
+		}
+	}
+	sn := &types.Subnet{
+		SubnetId:         aws.String(f.nextId("subnet")),
+		VpcId:            v.VpcId,
+		AvailabilityZone: aws.String(az),
+		CidrBlock:        aws.String(network.String()),
+		State:            types.SubnetStateAvailable,
+		Tags:             tagsFor(params.TagSpecifications, types.ResourceTypeSubnet),
+	}
+	f.Subnets[*sn.SubnetId] = sn
+	subnet := *sn
+	return &ec2.CreateSubnetOutput{Subnet: &subnet}, nil
+}
+
+func containsNetwork(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
+}
+
+func (f *FakeEC2) ModifySubnetAttribute(ctx context.Context, params *ec2.ModifySubnetAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySubnetAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifySubnetAttribute"); err != nil {
+		return nil, err
+	}
+	sn, ok := f.Subnets[aws.ToString(params.SubnetId)]
+	if !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", aws.ToString(params.SubnetId))
+	}
+	if params.MapPublicIpOnLaunch != nil {
+		sn.MapPublicIpOnLaunch = params.MapPublicIpOnLaunch.Value
+	}
+	return &ec2.ModifySubnetAttributeOutput{}, nil
+}
+
+func (f *FakeEC2) DeleteSubnet(ctx context.Context, params *ec2.DeleteSubnetInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSubnetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSubnet"); err != nil {
+		return nil, err
+	}
+	f.tick()
+	id := aws.ToString(params.SubnetId)
+	if _, ok := f.Subnets[id]; !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+	}
+	for _, i := range f.Instances {
+		if aws.ToString(i.SubnetId) == id && i.State.Name != types.InstanceStateNameTerminated {
+			return nil, apiError("DependencyViolation", "The subnet '%s' has dependencies and cannot be deleted.", id)
+		}
+	}
+	for _, t := range f.RouteTables {
+		var kept []types.RouteTableAssociation
+		for _, association := range t.Associations {
+			if aws.ToString(association.SubnetId) != id {
+				kept = append(kept, association)
+			}
+		}
+		t.Associations = kept
+	}
+	delete(f.Subnets, id)
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+func internetGatewayAttributes(g *types.InternetGateway) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "internet-gateway-id":
+			return []string{*g.InternetGatewayId}, true
+		case "attachment.vpc-id":
+			var ids []string
+			for _, att := range g.Attachments {
+				ids = append(ids, aws.ToString(att.VpcId))
+			}
+			return ids, true
+		}
+		return tagAttributes(g.Tags, name)
+	}
+}
+
+func copyInternetGateway(g *types.InternetGateway) types.InternetGateway {
+	result := *g
+	result.Tags = append([]types.Tag{}, g.Tags...)
+	result.Attachments = append([]types.InternetGatewayAttachment{}, g.Attachments...)
+	return result
+}
+
+func (f *FakeEC2) DescribeInternetGateways(ctx context.Context, params *ec2.DescribeInternetGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInternetGatewaysOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInternetGateways"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInternetGatewaysOutput{}
+	for _, id := range sortedKeys(f.Gateways) {
+		g := f.Gateways[id]
+		if len(params.InternetGatewayIds) > 0 && !containsString(params.InternetGatewayIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, internetGatewayAttributes(g)); err != nil {
+			return nil, err
+		} else if ok {
+			out.InternetGateways = append(out.InternetGateways, copyInternetGateway(g))
+		}
+	}
+	var err error
+	out.InternetGateways, out.NextToken, err = page(f, out.InternetGateways, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateInternetGateway(ctx context.Context, params *ec2.CreateInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateInternetGatewayOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateInternetGateway"); err != nil {
+		return nil, err
+	}
+	g := &types.InternetGateway{
+		InternetGatewayId: aws.String(f.nextId("igw")),
+		Tags:              tagsFor(params.TagSpecifications, types.ResourceTypeInternetGateway),
+	}
+	f.Gateways[*g.InternetGatewayId] = g
+	result := copyInternetGateway(g)
+	return &ec2.CreateInternetGatewayOutput{InternetGateway: &result}, nil
+}
+
+func (f *FakeEC2) AttachInternetGateway(ctx context.Context, params *ec2.AttachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.AttachInternetGatewayOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AttachInternetGateway"); err != nil {
+		return nil, err
+	}
+	g, ok := f.Gateways[aws.ToString(params.InternetGatewayId)]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", aws.ToString(params.InternetGatewayId))
+	}
+	if _, ok := f.Vpcs[aws.ToString(params.VpcId)]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.ToString(params.VpcId))
+	}
+	if len(g.Attachments) > 0 {
+		return nil, apiError("Resource.AlreadyAssociated", "resource %s is already attached to network %s", *g.InternetGatewayId, aws.ToString(g.Attachments[0].VpcId))
+	}
+	g.Attachments = []types.InternetGatewayAttachment{
+		{
+			VpcId: params.VpcId,
+			State: types.AttachmentStatusAttached,
+		},
+	}
+	return &ec2.AttachInternetGatewayOutput{}, nil
+}
+
+func (f *FakeEC2) DetachInternetGateway(ctx context.Context, params *ec2.DetachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DetachInternetGatewayOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DetachInternetGateway"); err != nil {
+		return nil, err
+	}
+	g, ok := f.Gateways[aws.ToString(params.InternetGatewayId)]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", aws.ToString(params.InternetGatewayId))
+	}
+	if len(g.Attachments) == 0 || aws.ToString(g.Attachments[0].VpcId) != aws.ToString(params.VpcId) {
+		return nil, apiError("Gateway.NotAttached", "resource %s is not attached to network %s", *g.InternetGatewayId, aws.ToString(params.VpcId))
+	}
+	g.Attachments = nil
+	return &ec2.DetachInternetGatewayOutput{}, nil
+}
+
+func (f *FakeEC2) DeleteInternetGateway(ctx context.Context, params *ec2.DeleteInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteInternetGatewayOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteInternetGateway"); err != nil {
+		return nil, err
+	}
+	g, ok := f.Gateways[aws.ToString(params.InternetGatewayId)]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", aws.ToString(params.InternetGatewayId))
+	}
+	if len(g.Attachments) > 0 {
+		return nil, apiError("DependencyViolation", "The internetGateway '%s' has dependencies and cannot be deleted.", *g.InternetGatewayId)
+	}
+	delete(f.Gateways, *g.InternetGatewayId)
+	return &ec2.DeleteInternetGatewayOutput{}, nil
+}
+
+func isMainRouteTable(t *types.RouteTable) bool {
+	for _, association := range t.Associations {
+		if aws.ToBool(association.Main) {
+			return true
+		}
+	}
+	return false
+}
+
+func routeTableAttributes(t *types.RouteTable) attributes {
+	return func(name string) ([]string, bool) {
+		switch name {
+		case "route-table-id":
+			return []string{*t.RouteTableId}, true
+		case "vpc-id":
+			return []string{aws.ToString(t.VpcId)}, true
+		case "association.main":
+			return []string{fmt.Sprintf("%t", isMainRouteTable(t))}, true
+		case "association.subnet-id":
+			var ids []string
+			for _, association := range t.Associations {
+				if association.SubnetId != nil {
+					ids = append(ids, *association.SubnetId)
+				}
+			}
+			return ids, true
+		}
+		return tagAttributes(t.Tags, name)
+	}
+}
+
+func copyRouteTable(t *types.RouteTable) types.RouteTable {
+	result := *t
+	result.Tags = append([]types.Tag{}, t.Tags...)
+	result.Associations = append([]types.RouteTableAssociation{}, t.Associations...)
+	result.Routes = append([]types.Route{}, t.Routes...)
+	return result
+}
+
+func (f *FakeEC2) DescribeRouteTables(ctx context.Context, params *ec2.DescribeRouteTablesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeRouteTables"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeRouteTablesOutput{}
+	for _, id := range sortedKeys(f.RouteTables) {
+		t := f.RouteTables[id]
+		if len(params.RouteTableIds) > 0 && !containsString(params.RouteTableIds, id) {
+			continue
+		}
+		if ok, err := matchFilters(params.Filters, routeTableAttributes(t)); err != nil {
+			return nil, err
+		} else if ok {
+			out.RouteTables = append(out.RouteTables, copyRouteTable(t))
+		}
+	}
+	var err error
+	out.RouteTables, out.NextToken, err = page(f, out.RouteTables, params.NextToken, params.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) CreateRouteTable(ctx context.Context, params *ec2.CreateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateRouteTable"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Vpcs[aws.ToString(params.VpcId)]
+	if !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.ToString(params.VpcId))
+	}
+	t := &types.RouteTable{
+		RouteTableId: aws.String(f.nextId("rtb")),
+		VpcId:        v.VpcId,
+		Routes: []types.Route{
+			{
+				DestinationCidrBlock: v.CidrBlock,
+				GatewayId:            aws.String("local"),
+			},
+		},
+		Tags: tagsFor(params.TagSpecifications, types.ResourceTypeRouteTable),
+	}
+	f.RouteTables[*t.RouteTableId] = t
+	result := copyRouteTable(t)
+	return &ec2.CreateRouteTableOutput{RouteTable: &result}, nil
+}
+
+func (f *FakeEC2) CreateRoute(ctx context.Context, params *ec2.CreateRouteInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateRoute"); err != nil {
+		return nil, err
+	}
+	t, ok := f.RouteTables[aws.ToString(params.RouteTableId)]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", aws.ToString(params.RouteTableId))
+	}
+	if params.GatewayId != nil {
+		g, ok := f.Gateways[*params.GatewayId]
+		if !ok {
+			return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", *params.GatewayId)
+		}
+		if len(g.Attachments) == 0 || aws.ToString(g.Attachments[0].VpcId) != aws.ToString(t.VpcId) {
+			return nil, apiError("InvalidParameterValue", "route table %s and network gateway %s belong to different networks", *t.RouteTableId, *params.GatewayId)
+		}
+	}
+	for _, route := range t.Routes {
+		if aws.ToString(route.DestinationCidrBlock) == aws.ToString(params.DestinationCidrBlock) {
+			return nil, apiError("RouteAlreadyExists", "The route identified by %s already exists.", aws.ToString(params.DestinationCidrBlock))
+		}
+	}
+	t.Routes = append(t.Routes, types.Route{
+		DestinationCidrBlock: params.DestinationCidrBlock,
+		GatewayId:            params.GatewayId,
+		State:                types.RouteStateActive,
+	})
+	return &ec2.CreateRouteOutput{Return: aws.Bool(true)}, nil
+}
+
+func (f *FakeEC2) AssociateRouteTable(ctx context.Context, params *ec2.AssociateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.AssociateRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AssociateRouteTable"); err != nil {
+		return nil, err
+	}
+	t, ok := f.RouteTables[aws.ToString(params.RouteTableId)]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", aws.ToString(params.RouteTableId))
+	}
+	sn, ok := f.Subnets[aws.ToString(params.SubnetId)]
+	if !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", aws.ToString(params.SubnetId))
+	}
+	for _, other := range f.RouteTables {
+		for _, association := range other.Associations {
+			if aws.ToString(association.SubnetId) == *sn.SubnetId {
+				return nil, apiError("Resource.AlreadyAssociated", "the specified association for route table %s conflicts with an existing association", *t.RouteTableId)
+			}
+		}
+	}
+	association := types.RouteTableAssociation{
+		RouteTableAssociationId: aws.String(f.nextId("rtbassoc")),
+		RouteTableId:            t.RouteTableId,
+		SubnetId:                sn.SubnetId,
+		Main:                    aws.Bool(false),
+	}
+	t.Associations = append(t.Associations, association)
+	return &ec2.AssociateRouteTableOutput{AssociationId: association.RouteTableAssociationId}, nil
+}
+
+func (f *FakeEC2) DeleteRouteTable(ctx context.Context, params *ec2.DeleteRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.DeleteRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteRouteTable"); err != nil {
+		return nil, err
+	}
+	t, ok := f.RouteTables[aws.ToString(params.RouteTableId)]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", aws.ToString(params.RouteTableId))
+	}
+	if len(t.Associations) > 0 {
+		return nil, apiError("DependencyViolation", "The routeTable '%s' has dependencies and cannot be deleted.", *t.RouteTableId)
+	}
+	delete(f.RouteTables, *t.RouteTableId)
+	return &ec2.DeleteRouteTableOutput{}, nil
+}
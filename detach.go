@@ -0,0 +1,120 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sort"
+)
+
+// detachVolume detaches the volume volName from the instance it is attached to, and waits until it is available.
+// The detachment is not forced, the guest should have unmounted the volume.
+func (r *Region2) detachVolume(ctx context.Context, volName string) error {
+	v, ok := r.Ec2Volumes[volName]
+	if !ok {
+		return fmt.Errorf("volume %s does not exist in region %s", volName, r.Name)
+	}
+	instanceId := attachedInstanceId(v)
+	if instanceId == "" {
+		return nil
+	}
+	if _, err := r.Svc.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   v.VolumeId,
+		InstanceId: aws.String(instanceId),
+	}); err != nil {
+		return fmt.Errorf("cannot detach volume %s from instance %s : %v", volName, instanceId, err)
+	}
+	log2.Infof("detaching volume %s from instance %s", volName, instanceId)
+	if err := r.waitForAvailableVolumes(ctx, volName); err != nil {
+		return err
+	}
+	log2.Infof("volume %s is detached from instance %s", volName, instanceId)
+	return nil
+}
+
+// undeclaredVolumes returns the volumes of the env attached to the instance of the host name which it does not
+// declare, its root volume apart.
+func (r *Region2) undeclaredVolumes(name string) (result []string) {
+	// a filtered region knows the hosts to be created with a nil instance
+	instance := r.Instances[name]
+	if instance == nil {
+		return nil
+	}
+	for volName, v := range r.Ec2Volumes {
+		if containsString(r.Hosts[name].Volumes, volName) || attachedInstanceId(v) != *instance.InstanceId {
+			continue
+		}
+		root := false
+		for _, att := range v.Attachments {
+			root = root || aws.ToString(att.Device) == aws.ToString(instance.RootDeviceName)
+		}
+		if !root {
+			result = append(result, volName)
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// detachUndeclaredVolumes detaches from each existing host the volumes it no longer declares, one status per host.
+func (r *Region2) detachUndeclaredVolumes(ctx context.Context) (result []*OperationStatus) {
+	for _, name := range r.sortedHostNames() {
+		volNames := r.undeclaredVolumes(name)
+		if len(volNames) == 0 {
+			continue
+		}
+		status := &OperationStatus{Host: r.Hosts[name]}
+		for _, volName := range volNames {
+			log2.Infof("volume %s is no more declared by host %s", volName, name)
+			if err := r.detachVolume(ctx, volName); err != nil {
+				log2.Errorf("%v", err)
+				status.InError = true
+			}
+		}
+		result = append(result, status)
+	}
+	return
+}
+
+// dataVolumesOf returns the volumes of the env attached to the instances which are not deleted with them.
+func (r *Region2) dataVolumesOf(instanceIds []string) (result []string) {
+	for volName, v := range r.Ec2Volumes {
+		for _, att := range v.Attachments {
+			if containsString(instanceIds, aws.ToString(att.InstanceId)) && !aws.ToBool(att.DeleteOnTermination) {
+				result = append(result, volName)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// moveVolume detaches the volume volName from its instance, if any, and attaches it to the instance of hostName.
+func (r *Region2) moveVolume(ctx context.Context, volName string, hostName string) error {
+	v, ok := r.Ec2Volumes[volName]
+	if !ok {
+		return fmt.Errorf("volume %s does not exist in region %s", volName, r.Name)
+	}
+	instance, ok := r.Instances[hostName]
+	if !ok {
+		return fmt.Errorf("host %s has no instance in region %s", hostName, r.Name)
+	}
+	if attachedInstanceId(v) == *instance.InstanceId {
+		log2.Infof("volume %s is already attached to host %s", volName, hostName)
+		return nil
+	}
+	if aws.ToString(v.AvailabilityZone) != aws.ToString(instance.Placement.AvailabilityZone) {
+		return fmt.Errorf("cannot move volume %s to host %s, the volume is in zone %s and the host in zone %s", volName, hostName, aws.ToString(v.AvailabilityZone), aws.ToString(instance.Placement.AvailabilityZone))
+	}
+	if err := r.detachVolume(ctx, volName); err != nil {
+		return err
+	}
+	used, err := r.usedDevices(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("cannot move volume %s to host %s : %v", volName, hostName, err)
+	}
+	return r.attachVolume(ctx, hostName, volName, used)
+}
@@ -0,0 +1,90 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+)
+
+func TestUpDetachesUndeclaredVolume(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	volumes := []*Volume{testVolume("data-a", "eu-west-1"), testVolume("logs-a", "eu-west-1")}
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1", "data-a", "logs-a")}, volumes)
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1", "data-a")}, volumes)
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("second up failed : %v", err)
+	}
+	instance := instancesOf(fake)["a"]
+	v := volumesOf(fake)
+	if attachedInstanceId(v["data-a"]) != *instance.InstanceId {
+		t.Errorf("volume data-a should stay attached to host a, got %v", v["data-a"])
+	}
+	if logs := v["logs-a"]; logs == nil || len(logs.Attachments) != 0 || logs.State != types.VolumeStateAvailable {
+		t.Errorf("volume logs-a no more declared should be detached and kept, got %v", logs)
+	}
+	if got := fake.Calls["DetachVolume"]; got != 1 {
+		t.Errorf("got %d DetachVolume calls, want 1", got)
+	}
+}
+
+func TestMoveVolumeAcrossHosts(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a"), testHost("b", "eu-west-1")},
+		[]*Volume{testVolume("data-a", "eu-west-1")})
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+
+	if err := (Admin{}).MoveVolume("data-a", "b"); err != nil {
+		t.Fatalf("move failed : %v", err)
+	}
+	instances := instancesOf(fake)
+	v := volumesOf(fake)["data-a"]
+	if attachedInstanceId(v) != *instances["b"].InstanceId {
+		t.Errorf("volume data-a should be attached to host b, got %v", v)
+	}
+	if got := TagValue(v.Tags, deviceTag); got != aws.ToString(v.Attachments[0].Device) {
+		t.Errorf("got device %s recorded for data-a, want the one it is attached under", got)
+	}
+	if err := (Admin{}).MoveVolume("data-a", "c"); err == nil {
+		t.Error("moving a volume to a host which does not exist should fail")
+	}
+}
+
+func TestMoveVolumeRefusesOtherZone(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	for _, vpc := range fake.Vpcs {
+		fake.AddSubnet(*vpc.VpcId, "b", "172.31.16.0/20")
+	}
+	other := testHost("b", "eu-west-1")
+	other.Specification.AvailabilityZone = "eu-west-1b"
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a"), other},
+		[]*Volume{testVolume("data-a", "eu-west-1")})
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	instances := instancesOf(fake)
+	if got := aws.ToString(instances["b"].Placement.AvailabilityZone); got != "eu-west-1b" {
+		t.Fatalf("got host b in zone %s, want eu-west-1b", got)
+	}
+
+	if err := (Admin{}).MoveVolume("data-a", "b"); err == nil {
+		t.Fatal("moving a volume to a host of another zone should fail")
+	}
+	if v := volumesOf(fake)["data-a"]; attachedInstanceId(v) != *instances["a"].InstanceId {
+		t.Errorf("volume data-a should stay attached to host a, got %v", v)
+	}
+	if got := fake.Calls["DetachVolume"]; got != 0 {
+		t.Errorf("got %d DetachVolume calls, want none", got)
+	}
+}
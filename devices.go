@@ -0,0 +1,199 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"sort"
+	"strings"
+)
+
+const (
+	// tag of a volume holding the device it is attached under, reused by its next attachments
+	deviceTag = "xbee.device"
+	// range of the devices recommended for EBS data volumes, /dev/sdf to /dev/sdp
+	firstDataDevice = 'f'
+	lastDataDevice  = 'p'
+)
+
+// deviceLetter returns the letter of a /dev/sdX or /dev/xvdX device, partitions such as /dev/sda1 included, 0 for
+// other names. /dev/sdf and /dev/xvdf are the same device for EC2.
+func deviceLetter(name string) byte {
+	name = strings.TrimPrefix(name, "/dev/")
+	switch {
+	case strings.HasPrefix(name, "sd"):
+		name = strings.TrimPrefix(name, "sd")
+	case strings.HasPrefix(name, "xvd"):
+		name = strings.TrimPrefix(name, "xvd")
+	default:
+		return 0
+	}
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return 0
+	}
+	return name[0]
+}
+
+// usedDevices returns the device letters taken on instance, by its own mappings and by those of its AMI, which the
+// instance may not report, e.g. instance store volumes.
+func (r *Region2) usedDevices(ctx context.Context, instance *types.Instance) (map[byte]bool, error) {
+	used := map[byte]bool{}
+	addDevice(used, instance.RootDeviceName)
+	for _, mapping := range instance.BlockDeviceMappings {
+		addDevice(used, mapping.DeviceName)
+	}
+	if err := r.addImageDevices(ctx, used, aws.ToString(instance.ImageId)); err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+func addDevice(used map[byte]bool, name *string) {
+	if letter := deviceLetter(aws.ToString(name)); letter != 0 {
+		used[letter] = true
+	}
+}
+
+// addImageDevices adds to used the devices mapped by the AMI, nothing when it is deregistered.
+func (r *Region2) addImageDevices(ctx context.Context, used map[byte]bool, imageId string) error {
+	out, err := r.Svc.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{imageId},
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot get the block device mappings of ami %s : %v", imageId, err)
+	}
+	for _, image := range out.Images {
+		addDevice(used, image.RootDeviceName)
+		for _, mapping := range image.BlockDeviceMappings {
+			addDevice(used, mapping.DeviceName)
+		}
+	}
+	return nil
+}
+
+// allocateDevice returns the device a volume is attached under, the one it was attached under last time when still
+// free, the first free one among /dev/sdf-/dev/sdp otherwise. The device is marked as used.
+func allocateDevice(used map[byte]bool, previous string) (string, error) {
+	if letter := deviceLetter(previous); letter != 0 && !used[letter] {
+		used[letter] = true
+		return previous, nil
+	}
+	for letter := byte(firstDataDevice); letter <= lastDataDevice; letter++ {
+		if !used[letter] {
+			used[letter] = true
+			return fmt.Sprintf("/dev/sd%c", letter), nil
+		}
+	}
+	return "", fmt.Errorf("no device left among /dev/sd%c-/dev/sd%c", firstDataDevice, lastDataDevice)
+}
+
+// assignDevices gives the volumes of h, before its instance is created from imageId, the devices AttachVolumes
+// attaches them under, so that its userdata can name them.
+func (r *Region2) assignDevices(ctx context.Context, h *Host, imageId string) error {
+	used := map[byte]bool{}
+	if err := r.addImageDevices(ctx, used, imageId); err != nil {
+		return err
+	}
+	for _, volName := range h.Volumes {
+		v, ok := r.Ec2Volumes[volName]
+		if !ok {
+			continue
+		}
+		device, err := allocateDevice(used, TagValue(v.Tags, deviceTag))
+		if err != nil {
+			return fmt.Errorf("cannot assign a device to volume %s of host %s : %v", volName, h.Name, err)
+		}
+		// the userdata names the volume by this device, the instance is not created when it cannot be recorded
+		if err := r.tagDevice(ctx, volName, v, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagDevice records the device of the volume volName, so that it keeps it when attached again. The volume may have
+// just been created.
+func (r *Region2) tagDevice(ctx context.Context, volName string, v *types.Volume, device string) error {
+	if TagValue(v.Tags, deviceTag) == device {
+		return nil
+	}
+	tag := types.Tag{Key: aws.String(deviceTag), Value: aws.String(device)}
+	if _, err := r.Svc.CreateTags(afterCreate(ctx), &ec2.CreateTagsInput{
+		Resources: []string{*v.VolumeId},
+		Tags:      []types.Tag{tag},
+	}); err != nil {
+		return fmt.Errorf("cannot record device %s of volume %s : %v", device, volName, err)
+	}
+	for index := range v.Tags {
+		if aws.ToString(v.Tags[index].Key) == deviceTag {
+			v.Tags[index] = tag
+			return nil
+		}
+	}
+	v.Tags = append(v.Tags, tag)
+	return nil
+}
+
+// VolumeDevice tells where the guest of a host finds a data volume.
+type VolumeDevice struct {
+	Region   string `json:"region"`
+	Host     string `json:"host"`
+	Volume   string `json:"volume"`
+	VolumeId string `json:"volumeId"`
+	// device name given to EC2, seen as such by the guest of Xen instances only
+	Device string `json:"device"`
+	// path of the volume on Nitro instances, whose NVMe serial is the volume id
+	DiskById string `json:"diskById"`
+}
+
+// nvmeDiskById returns the /dev/disk/by-id path of an EBS volume on a Nitro instance.
+func nvmeDiskById(volumeId string) string {
+	return "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_" + strings.Replace(volumeId, "-", "", 1)
+}
+
+// volumeDevices returns the data volumes attached to the instance of every host.
+func (r *Region2) volumeDevices() (result []*VolumeDevice) {
+	for _, name := range r.sortedHostNames() {
+		instance, ok := r.Instances[name]
+		if !ok {
+			continue
+		}
+		for _, volName := range r.Hosts[name].Volumes {
+			v, ok := r.Ec2Volumes[volName]
+			if !ok {
+				continue
+			}
+			for _, att := range v.Attachments {
+				if aws.ToString(att.InstanceId) == *instance.InstanceId {
+					result = append(result, &VolumeDevice{
+						Region:   r.Name,
+						Host:     name,
+						Volume:   volName,
+						VolumeId: *v.VolumeId,
+						Device:   aws.ToString(att.Device),
+						DiskById: nvmeDiskById(*v.VolumeId),
+					})
+				}
+			}
+		}
+	}
+	return
+}
+
+func volumeDevices(regions map[string]*Region2) (result []*VolumeDevice) {
+	for _, r := range regions {
+		result = append(result, r.volumeDevices()...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Region != result[j].Region {
+			return result[i].Region < result[j].Region
+		}
+		return result[i].Host < result[j].Host
+	})
+	return
+}
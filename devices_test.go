@@ -0,0 +1,102 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+)
+
+func TestDeviceLetter(t *testing.T) {
+	tests := []struct {
+		name   string
+		letter byte
+	}{
+		{"/dev/sdf", 'f'},
+		{"/dev/xvdf", 'f'},
+		{"sdg", 'g'},
+		{"xvdg", 'g'},
+		{"/dev/sda1", 'a'},
+		{"/dev/xvda1", 'a'},
+		{"/dev/nvme0n1", 0},
+		{"/dev/sd", 0},
+		{"/dev/sd1", 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		if got := deviceLetter(test.name); got != test.letter {
+			t.Errorf("got letter %q for %s, want %q", got, test.name, test.letter)
+		}
+	}
+}
+
+func TestAllocateDevice(t *testing.T) {
+	// the root partition of the AMI and an instance store volume
+	used := map[byte]bool{}
+	addDevice(used, aws.String("/dev/sda1"))
+	addDevice(used, aws.String("/dev/xvdf"))
+	if !used['f'] || !used['a'] {
+		t.Fatalf("got used devices %v, want a and f", used)
+	}
+
+	if device, err := allocateDevice(used, "/dev/sdf"); err != nil || device != "/dev/sdg" {
+		t.Errorf("got %s %v for a previous device already taken by the same device under xvd, want /dev/sdg", device, err)
+	}
+	if device, err := allocateDevice(used, "/dev/xvdk"); err != nil || device != "/dev/xvdk" {
+		t.Errorf("got %s %v, want the free previous device /dev/xvdk", device, err)
+	}
+	if device, err := allocateDevice(used, "/dev/sdk"); err != nil || device != "/dev/sdh" {
+		t.Errorf("got %s %v for /dev/sdk, taken as /dev/xvdk, want /dev/sdh", device, err)
+	}
+	if device, err := allocateDevice(used, ""); err != nil || device != "/dev/sdi" {
+		t.Errorf("got %s %v without previous device, want /dev/sdi", device, err)
+	}
+
+	for letter := byte('j'); letter <= 'p'; letter++ {
+		if letter == 'k' {
+			continue
+		}
+		if device, err := allocateDevice(used, ""); err != nil || device != fmt.Sprintf("/dev/sd%c", letter) {
+			t.Fatalf("got %s %v, want /dev/sd%c", device, err, letter)
+		}
+	}
+	if device, err := allocateDevice(used, ""); err == nil {
+		t.Errorf("got device %s once /dev/sdf-/dev/sdp are taken, want an error", device)
+	}
+	if device, err := allocateDevice(used, "/dev/sdq"); err != nil || device != "/dev/sdq" {
+		t.Errorf("got %s %v, a free previous device out of the range should be kept", device, err)
+	}
+}
+
+func TestAssignDevicesReturnsTagFailure(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeRegion(awstest.NewFakeCloud(), "eu-west-1")
+	out, err := fake.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone:  aws.String("eu-west-1a"),
+		Size:              aws.Int32(10),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVolume, "data-a"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Region2{
+		Name:       "eu-west-1",
+		Svc:        fake,
+		Ec2Volumes: map[string]*types.Volume{"data-a": toVolume(out)},
+	}
+	h := testHost("a", "eu-west-1", "data-a")
+
+	fake.FailNext("CreateTags", awstest.APIError("UnauthorizedOperation", "injected"))
+	if err := r.assignDevices(ctx, h, testAmi); err == nil {
+		t.Fatal("assigning devices should fail when the device cannot be recorded")
+	}
+	if err := r.assignDevices(ctx, h, testAmi); err != nil {
+		t.Fatal(err)
+	}
+	if got := TagValue(volumesOf(fake)["data-a"].Tags, deviceTag); got != "/dev/sdf" {
+		t.Errorf("got device %q recorded for data-a, want /dev/sdf", got)
+	}
+}
@@ -0,0 +1,85 @@
+package aws
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"sort"
+)
+
+// ebsLimits are the performance bounds of an EBS volume type, zero bounds meaning the setting is not supported.
+type ebsLimits struct {
+	minIops        int
+	maxIops        int
+	iopsPerGib     int
+	iopsRequired   bool
+	minThroughput  int
+	maxThroughput  int
+	minSize        int
+	maxSize        int
+	throughputIops float64
+}
+
+var ebsVolumeTypes = map[string]ebsLimits{
+	"gp2":      {minSize: 1, maxSize: 16384},
+	"gp3":      {minIops: 3000, maxIops: 16000, iopsPerGib: 500, minThroughput: 125, maxThroughput: 1000, minSize: 1, maxSize: 16384, throughputIops: 0.25},
+	"io1":      {minIops: 100, maxIops: 64000, iopsPerGib: 50, iopsRequired: true, minSize: 4, maxSize: 16384},
+	"io2":      {minIops: 100, maxIops: 256000, iopsPerGib: 1000, iopsRequired: true, minSize: 4, maxSize: 65536},
+	"st1":      {minSize: 125, maxSize: 16384},
+	"sc1":      {minSize: 125, maxSize: 16384},
+	"standard": {minSize: 1, maxSize: 1024},
+}
+
+// validateEbs checks iops and throughput against the allowed ranges of volumeType, gp2 when empty as for EC2.
+// A zero size is the one of the AMI for a root volume, the checks depending on the size are then left to EC2.
+func validateEbs(volumeType string, size int, iops int, throughput int) error {
+	if volumeType == "" {
+		volumeType = "gp2"
+	}
+	limits, ok := ebsVolumeTypes[volumeType]
+	if !ok {
+		var names []string
+		for name := range ebsVolumeTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("volume type %s is not one of %v", volumeType, names)
+	}
+	if size != 0 && (size < limits.minSize || size > limits.maxSize) {
+		return fmt.Errorf("size %d GiB is out of range %d-%d for volume type %s", size, limits.minSize, limits.maxSize, volumeType)
+	}
+	switch {
+	case iops == 0 && limits.iopsRequired:
+		return fmt.Errorf("iops is required for volume type %s", volumeType)
+	case iops != 0 && limits.maxIops == 0:
+		return fmt.Errorf("iops cannot be set for volume type %s", volumeType)
+	case iops != 0 && (iops < limits.minIops || iops > limits.maxIops):
+		return fmt.Errorf("iops %d is out of range %d-%d for volume type %s", iops, limits.minIops, limits.maxIops, volumeType)
+	case iops > limits.minIops && size != 0 && iops > size*limits.iopsPerGib:
+		return fmt.Errorf("iops %d exceeds %d per GiB for a %d GiB %s volume", iops, limits.iopsPerGib, size, volumeType)
+	}
+	switch {
+	case throughput != 0 && limits.maxThroughput == 0:
+		return fmt.Errorf("throughput cannot be set for volume type %s", volumeType)
+	case throughput != 0 && (throughput < limits.minThroughput || throughput > limits.maxThroughput):
+		return fmt.Errorf("throughput %d MiB/s is out of range %d-%d for volume type %s", throughput, limits.minThroughput, limits.maxThroughput, volumeType)
+	}
+	if throughput != 0 {
+		// the iops of a gp3 volume are its baseline when not given
+		effectiveIops := iops
+		if effectiveIops == 0 {
+			effectiveIops = limits.minIops
+		}
+		if float64(throughput) > float64(effectiveIops)*limits.throughputIops {
+			return fmt.Errorf("throughput %d MiB/s exceeds %.2f MiB/s per iops with %d iops", throughput, limits.throughputIops, effectiveIops)
+		}
+	}
+	return nil
+}
+
+// optionalInt32 leaves unset values to EC2 defaults.
+func optionalInt32(value int) *int32 {
+	if value == 0 {
+		return nil
+	}
+	return aws.Int32(int32(value))
+}
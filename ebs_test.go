@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEbs(t *testing.T) {
+	tests := []struct {
+		volumeType string
+		size       int
+		iops       int
+		throughput int
+		// part of the error, none when empty
+		err string
+	}{
+		{"gp3", 100, 0, 0, ""},
+		{"gp3", 100, 3000, 125, ""},
+		{"gp3", 100, 16000, 1000, ""},
+		{"gp3", 100, 2999, 0, "out of range 3000-16000"},
+		{"gp3", 100, 16001, 0, "out of range 3000-16000"},
+		{"gp3", 10, 6000, 0, "exceeds 500 per GiB"},
+		{"gp3", 100, 0, 124, "out of range 125-1000"},
+		{"gp3", 100, 16000, 1001, "out of range 125-1000"},
+		{"gp3", 100, 0, 751, "exceeds 0.25 MiB/s per iops with 3000 iops"},
+		{"gp3", 0, 6000, 0, ""},
+		{"io1", 100, 0, 0, "iops is required"},
+		{"io1", 100, 5000, 0, ""},
+		{"io1", 100, 99, 0, "out of range 100-64000"},
+		{"io1", 100, 5001, 0, "exceeds 50 per GiB"},
+		{"io1", 100, 5000, 125, "throughput cannot be set"},
+		{"io1", 3, 100, 0, "size 3 GiB is out of range 4-16384"},
+		{"io2", 100, 100000, 0, ""},
+		{"io2", 100, 100001, 0, "exceeds 1000 per GiB"},
+		{"io2", 1000, 256001, 0, "out of range 100-256000"},
+		{"gp2", 100, 3000, 0, "iops cannot be set"},
+		{"gp2", 100, 0, 125, "throughput cannot be set"},
+		{"", 100, 3000, 0, "iops cannot be set for volume type gp2"},
+		{"st1", 500, 3000, 0, "iops cannot be set"},
+		{"st1", 500, 0, 125, "throughput cannot be set"},
+		{"st1", 100, 0, 0, "out of range 125-16384"},
+		{"sc1", 500, 3000, 0, "iops cannot be set"},
+		{"sc1", 500, 0, 125, "throughput cannot be set"},
+		{"gp4", 100, 0, 0, "is not one of"},
+	}
+	for _, test := range tests {
+		err := validateEbs(test.volumeType, test.size, test.iops, test.throughput)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s of %d GiB with %d iops and %d MiB/s: got %v, want no error", test.volumeType, test.size, test.iops, test.throughput, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s of %d GiB with %d iops and %d MiB/s: got %v, want an error with %q", test.volumeType, test.size, test.iops, test.throughput, err, test.err)
+		}
+	}
+}
+
+func TestValidateRootVolume(t *testing.T) {
+	tests := []struct {
+		data *AwsHostData
+		err  string
+	}{
+		{&AwsHostData{Size: 8}, ""},
+		{&AwsHostData{Size: 8, RootIops: 3000}, "require rootVolumeType"},
+		{&AwsHostData{Size: 8, RootThroughput: 125}, "require rootVolumeType"},
+		{&AwsHostData{Size: 8, RootVolumeType: "gp3", RootIops: 3000, RootThroughput: 250}, ""},
+		{&AwsHostData{RootVolumeType: "gp3", RootIops: 16000}, ""},
+		{&AwsHostData{Size: 8, RootVolumeType: "gp3", RootIops: 16000}, "invalid root volume : iops 16000 exceeds 500 per GiB"},
+		{&AwsHostData{Size: 8, RootVolumeType: "gp2", RootIops: 3000}, "invalid root volume : iops cannot be set"},
+		{&AwsHostData{Size: 8, RootVolumeType: "io2"}, "invalid root volume : iops is required"},
+	}
+	for _, test := range tests {
+		err := test.data.validateRootVolume()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%+v: got %v, want no error", test.data, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%+v: got %v, want an error with %q", test.data, err, test.err)
+		}
+	}
+}
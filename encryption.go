@@ -0,0 +1,140 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sort"
+)
+
+const (
+	// XBEE_AWS_ENCRYPTED=true encrypts every host of the env, as encrypted in the host does.
+	envEncryptedEnv = "XBEE_AWS_ENCRYPTED"
+	// XBEE_AWS_KMS_KEY_ID is the KMS key of the encrypted volumes of the env whose host and volume give none.
+	envKmsKeyIdEnv = "XBEE_AWS_KMS_KEY_ID"
+)
+
+// applyEnvEncryption applies the env level encryption to the host, its data volumes follow it.
+func (d *AwsHostData) applyEnvEncryption() {
+	d.Encrypted = d.Encrypted || boolOption(envEncryptedEnv)
+	if d.KmsKeyId == "" {
+		d.KmsKeyId = stringOption(envKmsKeyIdEnv)
+	}
+}
+
+// encryptedFlag leaves Encrypted unset for unencrypted volumes, so that the EBS encryption by default of the account
+// still applies.
+func encryptedFlag(encrypted bool) *bool {
+	if encrypted {
+		return aws.Bool(true)
+	}
+	return nil
+}
+
+func kmsKeyId(encrypted bool, keyId string) *string {
+	if encrypted && keyId != "" {
+		return aws.String(keyId)
+	}
+	return nil
+}
+
+// VolumeEncryption is the encryption status of a root or data volume of a host.
+type VolumeEncryption struct {
+	Region   string `json:"region"`
+	Host     string `json:"host"`
+	Volume   string `json:"volume"`
+	VolumeId string `json:"volumeId"`
+	Root     bool   `json:"root"`
+	// whether the specification asks for encryption
+	Required  bool   `json:"required"`
+	Encrypted bool   `json:"encrypted"`
+	KmsKeyId  string `json:"kmsKeyId,omitempty"`
+}
+
+// Compliant tells whether a volume required to be encrypted is.
+func (e *VolumeEncryption) Compliant() bool {
+	return e.Encrypted || !e.Required
+}
+
+func (e *VolumeEncryption) log() {
+	kind := "data volume " + e.Volume
+	if e.Root {
+		kind = "root volume"
+	}
+	switch {
+	case !e.Compliant():
+		log2.Warnf("host %s %s %s in region %s is not encrypted, though encryption is required", e.Host, kind, e.VolumeId, e.Region)
+	case e.Encrypted && e.KmsKeyId == "":
+		log2.Infof("host %s %s %s in region %s is encrypted with the default EBS key", e.Host, kind, e.VolumeId, e.Region)
+	case e.Encrypted:
+		log2.Infof("host %s %s %s in region %s is encrypted with key %s", e.Host, kind, e.VolumeId, e.Region, e.KmsKeyId)
+	default:
+		log2.Infof("host %s %s %s in region %s is not encrypted", e.Host, kind, e.VolumeId, e.Region)
+	}
+}
+
+func (r *Region2) volumeById(id string) *types.Volume {
+	for _, v := range r.Ec2Volumes {
+		if aws.ToString(v.VolumeId) == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// encryptionReport returns the encryption status of the root volume and the data volumes of every existing host.
+func (r *Region2) encryptionReport() (result []*VolumeEncryption) {
+	for _, name := range r.sortedHostNames() {
+		h := r.Hosts[name]
+		if instance, ok := r.Instances[name]; ok {
+			for _, mapping := range instance.BlockDeviceMappings {
+				if aws.ToString(mapping.DeviceName) != aws.ToString(instance.RootDeviceName) || mapping.Ebs == nil {
+					continue
+				}
+				e := &VolumeEncryption{
+					Region:   r.Name,
+					Host:     name,
+					Volume:   name,
+					VolumeId: aws.ToString(mapping.Ebs.VolumeId),
+					Root:     true,
+					Required: h.Specification.Encrypted,
+				}
+				if v := r.volumeById(e.VolumeId); v != nil {
+					e.Encrypted, e.KmsKeyId = aws.ToBool(v.Encrypted), aws.ToString(v.KmsKeyId)
+				}
+				result = append(result, e)
+			}
+		}
+		for _, volName := range h.Volumes {
+			v, ok := r.Ec2Volumes[volName]
+			vol, declared := r.Volumes[volName]
+			if !ok || !declared {
+				continue
+			}
+			required, _ := vol.encryption(h)
+			result = append(result, &VolumeEncryption{
+				Region:    r.Name,
+				Host:      name,
+				Volume:    volName,
+				VolumeId:  aws.ToString(v.VolumeId),
+				Required:  required,
+				Encrypted: aws.ToBool(v.Encrypted),
+				KmsKeyId:  aws.ToString(v.KmsKeyId),
+			})
+		}
+	}
+	return
+}
+
+func encryptionReport(regions map[string]*Region2) (result []*VolumeEncryption) {
+	for _, r := range regions {
+		result = append(result, r.encryptionReport()...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Region != result[j].Region {
+			return result[i].Region < result[j].Region
+		}
+		return result[i].Host < result[j].Host
+	})
+	return
+}
@@ -0,0 +1,36 @@
+package aws
+
+import "testing"
+
+func TestEnvEncryptionAppliesToHostsAndVolumes(t *testing.T) {
+	t.Setenv(envEncryptedEnv, "true")
+	t.Setenv(envKmsKeyIdEnv, "alias/env")
+	h := testHost("a", "eu-west-1")
+	h.Specification.applyEnvEncryption()
+	if !h.Specification.Encrypted || h.Specification.KmsKeyId != "alias/env" {
+		t.Errorf("got host encrypted %v with key %q, want the env encryption", h.Specification.Encrypted, h.Specification.KmsKeyId)
+	}
+	unencrypted := false
+	tests := []struct {
+		volume    *AwsVolumeData
+		encrypted bool
+		keyId     string
+	}{
+		{&AwsVolumeData{}, true, "alias/env"},
+		{&AwsVolumeData{KmsKeyId: "alias/volume"}, true, "alias/volume"},
+		{&AwsVolumeData{Encrypted: &unencrypted}, false, ""},
+	}
+	for _, test := range tests {
+		v := &Volume{Specification: test.volume}
+		if encrypted, keyId := v.encryption(h); encrypted != test.encrypted || keyId != test.keyId {
+			t.Errorf("got volume %+v encrypted %v with key %q, want %v with key %q", test.volume, encrypted, keyId, test.encrypted, test.keyId)
+		}
+	}
+
+	own := testHost("b", "eu-west-1")
+	own.Specification.Encrypted, own.Specification.KmsKeyId = true, "alias/host"
+	own.Specification.applyEnvEncryption()
+	if own.Specification.KmsKeyId != "alias/host" {
+		t.Errorf("got key %q, the key of the host should be kept", own.Specification.KmsKeyId)
+	}
+}
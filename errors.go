@@ -0,0 +1,85 @@
+package aws
+
+import (
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sort"
+	"strings"
+)
+
+// steps of region initialization, see newRegion
+const (
+	StepSession        = "session"
+	StepInstances      = "instances"
+	StepVolumes        = "volumes"
+	StepVpc            = "vpc"
+	StepSecurityGroups = "security groups"
+	StepAddresses      = "addresses"
+	StepImages         = "images"
+)
+
+type RegionError struct {
+	Region string
+	Step   string
+	Err    error
+}
+
+func (e *RegionError) Error() string {
+	return fmt.Sprintf("region %s, %s: %v", e.Region, e.Step, e.Err)
+}
+
+func (e *RegionError) Unwrap() error {
+	return e.Err
+}
+
+// RegionErrors aggregates every initialization failure, for all regions.
+type RegionErrors []*RegionError
+
+func (errs RegionErrors) Error() string {
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs RegionErrors) Regions() []string {
+	set := map[string]bool{}
+	var result []string
+	for _, err := range errs {
+		if !set[err.Region] {
+			set[err.Region] = true
+			result = append(result, err.Region)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (errs RegionErrors) XbeeError() *cmd.XbeeError {
+	if len(errs) == 0 {
+		return nil
+	}
+	return cmd.Error("regions %v failed to initialize :\n%s", errs.Regions(), errs.Error())
+}
+
+const (
+	// XBEE_AWS_REGION_ERRORS=partial lets commands go on with the regions that initialized,
+	// the default fail-fast stops before changing anything.
+	regionErrorsEnv   = "XBEE_AWS_REGION_ERRORS"
+	RegionErrorsFail  = "fail-fast"
+	RegionErrorsAllow = "partial"
+)
+
+func partialRegions() bool {
+	switch value := stringOption(regionErrorsEnv); value {
+	case RegionErrorsAllow:
+		return true
+	case "", RegionErrorsFail:
+		return false
+	default:
+		log2.Warnf("ignoring %s=%s, %s or %s is expected", regionErrorsEnv, value, RegionErrorsFail, RegionErrorsAllow)
+		return false
+	}
+}
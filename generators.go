@@ -3,7 +3,7 @@ package aws
 import (
 	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/log2"
@@ -18,33 +18,35 @@ type UpInstanceGeneratorResponse struct {
 	InitiallyDown        bool
 	InitiallyUp          bool
 }
-type response struct {
-	r   *Region2
-	err error
+type DownInstanceGeneratorResponse struct {
+	InError       bool
+	Name          string
+	InitiallyDown bool
+	InitiallyUp   bool
 }
-
-func sendError(ctx context.Context, ch chan *response, err error) {
-	select {
-	case <-ctx.Done():
-	case ch <- &response{
-		err: err,
-	}:
-	}
+type response struct {
+	r    *Region2
+	errs RegionErrors
 }
 
 func newRegion(ctx context.Context, name string, hosts map[string]*Host, volumes map[string]*Volume) <-chan *response {
 	ch := make(chan *response)
 	go func() {
 		defer close(ch)
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithRegion(name),
-		)
+		resp := &response{}
+		var mu sync.Mutex
+		addError := func(step string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			resp.errs = append(resp.errs, &RegionError{Region: name, Step: step, Err: err})
+		}
+		svc, err := NewEC2Client(ctx, name)
 		if err != nil {
-			sendError(ctx, ch, fmt.Errorf("cannot create session to region %s : %v", name, err))
+			addError(StepSession, fmt.Errorf("cannot create session : %v", err))
 		} else {
 			r := &Region2{
 				Name:     name,
-				Svc:      ec2.NewFromConfig(cfg),
+				Svc:      WithRetry(svc, DefaultRetryPolicy()),
 				Hosts:    hosts,
 				Volumes:  volumes,
 				ImageMap: map[string]string{},
@@ -53,74 +55,102 @@ func newRegion(ctx context.Context, name string, hosts map[string]*Host, volumes
 			wg.Add(6)
 			go func() {
 				defer wg.Done()
-				err := r.fillInstances(ctx)
-				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when describing instances for region %s : %v", name, err))
-					return
+				if err := r.fillInstances(ctx); err != nil {
+					addError(StepInstances, err)
 				}
 			}()
 			go func() {
 				defer wg.Done()
-				err = r.fillVolumes(ctx)
-				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when describing volumes for region %s : %v", name, err))
-					return
+				if err := r.fillVolumes(ctx); err != nil {
+					addError(StepVolumes, fmt.Errorf("cannot describe volumes : %v", err))
 				}
 			}()
 			go func() {
 				defer wg.Done()
-				err = r.ensureVpc(ctx)
+				var err error
+				r.sshSecurityGroupId, r.xbeeSecurityGroupId, err = r.findDefaultEnvSecurityGroups(ctx)
 				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when describing vpc for region %s : %v", name, err))
-					return
+					addError(StepSecurityGroups, err)
 				}
 			}()
 			go func() {
 				defer wg.Done()
-				r.sshSecurityGroupId, r.xbeeSecurityGroupId, err = r.findDefaultEnvSecurityGroups(ctx)
+				out, err := r.Svc.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{})
 				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when searching for default SSH and XBEE security groups in region %s : %v", name, err))
+					addError(StepAddresses, fmt.Errorf("cannot describe Elastic IPs : %v", err))
 					return
 				}
+				for index := range out.Addresses {
+					r.EIps = append(r.EIps, &out.Addresses[index])
+				}
 			}()
 			go func() {
 				defer wg.Done()
-				out, err := r.Svc.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{})
-				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when searching for default Elastic IPs in region %s : %v", name, err))
-					return
+				if err := r.findEnvNetwork(ctx); err != nil {
+					addError(StepVpc, fmt.Errorf("cannot look for the vpc of the env : %v", err))
 				}
-				r.EIps = out.Addresses
 			}()
 			go func() {
 				defer wg.Done()
-				err := r.ensureImages(ctx)
-				if err != nil {
-					sendError(ctx, ch, fmt.Errorf("an unexpected error occured when searching for AMIs in region %s : %v", name, err))
-					return
+				if err := r.ensureImages(ctx); err != nil {
+					addError(StepImages, fmt.Errorf("cannot look for AMIs : %v", err))
 				}
 			}()
 
 			wg.Wait()
-			select {
-			case <-ctx.Done():
-			case ch <- &response{
-				r: r,
-			}:
+			if len(resp.errs) == 0 {
+				r.reportDuplicates()
+				resp.r = r
 			}
 		}
+		select {
+		case <-ctx.Done():
+		case ch <- resp:
+		}
 	}()
 	return ch
 }
 
-func regionsForHosts(ctx context.Context) (map[string]*Region2, *cmd.XbeeError) {
-	hosts, err := HostsByRegion()
+// collectRegions waits for every region, a region is either fully initialized or reported in the returned errors.
+func collectRegions(ctx context.Context, channels []<-chan *response) (map[string]*Region2, RegionErrors, *cmd.XbeeError) {
+	ch := util.Multiplex(ctx, channels...)
+	result := map[string]*Region2{}
+	var failed RegionErrors
+	for resp := range ch {
+		if len(resp.errs) > 0 {
+			for _, err := range resp.errs {
+				log2.Errorf("%v", err)
+			}
+			failed = append(failed, resp.errs...)
+		} else {
+			result[resp.r.Name] = resp.r
+		}
+	}
+	if len(failed) > 0 {
+		if !partialRegions() {
+			return nil, nil, failed.XbeeError()
+		}
+		log2.Warnf("going on without regions %v", failed.Regions())
+	}
+	return result, failed, nil
+}
+
+// envHosts and envVolumes return the hosts and volumes of the env by region, tests replace them to run commands on
+// hosts of their own.
+var (
+	envHosts   = HostsByRegion
+	envVolumes = VolumesFrom
+)
+
+// regionsForHosts returns the initialized regions, and the ones which failed when partial operation is allowed.
+func regionsForHosts(ctx context.Context) (map[string]*Region2, RegionErrors, *cmd.XbeeError) {
+	hosts, err := envHosts()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	volumes, err := VolumesFrom()
+	volumes, err := envVolumes()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var channels []<-chan *response
@@ -128,16 +158,37 @@ func regionsForHosts(ctx context.Context) (map[string]*Region2, *cmd.XbeeError)
 		volumesForRegion := volumes[regionName]
 		channels = append(channels, newRegion(ctx, regionName, hostsForRegion, volumesForRegion))
 	}
-	ch := util.Multiplex(ctx, channels...)
-	result := map[string]*Region2{}
-	for resp := range ch {
-		if resp.err != nil {
-			log2.Errorf("%v", resp.err)
-		} else {
-			result[resp.r.Name] = resp.r
+	return collectRegions(ctx, channels)
+}
+
+// regionsOfAccount returns every region enabled for the account, with the hosts and volumes the env declares there.
+func regionsOfAccount(ctx context.Context) (map[string]*Region2, RegionErrors, *cmd.XbeeError) {
+	hosts, err := envHosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	volumes, err := envVolumes()
+	if err != nil {
+		return nil, nil, err
+	}
+	svc, err2 := NewEC2Client(ctx, "")
+	if err2 != nil {
+		return nil, nil, cmd.Error("cannot create session : %v", err2)
+	}
+	out, err2 := WithRetry(svc, DefaultRetryPolicy()).DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err2 != nil {
+		return nil, nil, cmd.Error("cannot list the regions of the account : %v", err2)
+	}
+	var channels []<-chan *response
+	for _, region := range out.Regions {
+		name := aws.ToString(region.RegionName)
+		hostsForRegion := hosts[name]
+		if hostsForRegion == nil {
+			hostsForRegion = map[string]*Host{}
 		}
+		channels = append(channels, newRegion(ctx, name, hostsForRegion, volumes[name]))
 	}
-	return result, nil
+	return collectRegions(ctx, channels)
 }
 
 type OperationStatus struct {
@@ -2,6 +2,7 @@ package aws
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
@@ -12,10 +13,70 @@ type AwsHostData struct {
 	InstanceType     string `json:"instanceType"`
 	Region           string `json:"region"`
 	Size             int    `json:"size"`
+	// type of the root volume, the one of the AMI when empty, and its performance for gp3, io1 and io2
+	RootVolumeType string `json:"rootVolumeType"`
+	RootIops       int    `json:"rootIops"`
+	RootThroughput int    `json:"rootThroughput"`
+
+	// network placement, the default vpc of the region is used when none is given. In a vpc with several subnets,
+	// the host needs a subnetId, subnetTags or a zone, given by availabilityZone or by its existing volumes.
+	VpcId      string            `json:"vpcId"`
+	SubnetId   string            `json:"subnetId"`
+	SubnetTags map[string]string `json:"subnetTags"`
+	// allows creating the default vpc of the region when it does not exist
+	CreateDefaultVpc bool `json:"createDefaultVpc"`
+	// builds a vpc dedicated to the env, with a public and a private subnet in each zone used by its hosts
+	ManagedVpc bool `json:"managedVpc"`
+	// cidr block of the managed vpc, 10.0.0.0/16 by default
+	VpcCidr string `json:"vpcCidr"`
+	// subnet of the managed vpc the host is placed in, public by default. The private subnet has no NAT gateway, a
+	// host placed in it is only reachable from the vpc and has no access to the internet.
+	SubnetTier string `json:"subnetTier"`
+
+	// allocates an Elastic IP for the host on its first Up, kept across Down/Up and released on Delete
+	ElasticIp bool `json:"elasticIp"`
+
+	// sources allowed to reach the host ports, anyone when none is given
+	Ingress *IngressSources `json:"ingress"`
+	// sources per port, as written in the host ports, overriding ingress
+	PortIngress map[string]*IngressSources `json:"portIngress"`
+	// sources allowed to reach port 22, shared by the hosts of the env
+	SshIngress *IngressSources `json:"sshIngress"`
+
+	// encrypts the root volume, and the data volumes which do not say otherwise. XBEE_AWS_ENCRYPTED encrypts every host.
+	Encrypted bool `json:"encrypted"`
+	// KMS key id, alias or arn of encrypted volumes, XBEE_AWS_KMS_KEY_ID or else the EBS default key of the account
+	// when empty
+	KmsKeyId string `json:"kmsKeyId"`
+
+	// installs a boot script growing the filesystems of data volumes, so that a volume resized by Up is fully usable
+	// after the next boot of the host. Only applies to hosts created once set.
+	GrowFilesystems bool `json:"growFilesystems"`
 
 	Ami string `json:"ami"`
 }
 
+// validateRootVolume checks the root volume settings, the root volume keeps the type of the AMI when none is given.
+func (d *AwsHostData) validateRootVolume() error {
+	if d.RootVolumeType == "" {
+		if d.RootIops != 0 || d.RootThroughput != 0 {
+			return fmt.Errorf("rootIops and rootThroughput require rootVolumeType")
+		}
+		return nil
+	}
+	if err := validateEbs(d.RootVolumeType, d.Size, d.RootIops, d.RootThroughput); err != nil {
+		return fmt.Errorf("invalid root volume : %v", err)
+	}
+	return nil
+}
+
+func (d *AwsHostData) subnetTier() string {
+	if d.SubnetTier == "" {
+		return SubnetPublic
+	}
+	return d.SubnetTier
+}
+
 type Host struct {
 	*provider.XbeeHost
 	Specification *AwsHostData
@@ -30,6 +91,27 @@ func NewHost(host *provider.XbeeHost) (*Host, *cmd.XbeeError) {
 	if err := json.Unmarshal(data, &result); err != nil {
 		panic(cmd.Error("unexpected error when deserializing data provider : %v", err))
 	}
+	if tier := result.SubnetTier; tier != "" && tier != SubnetPublic && tier != SubnetPrivate {
+		return nil, cmd.Error("host %s : subnetTier must be %s or %s, not %s", host.Name, SubnetPublic, SubnetPrivate, tier)
+	}
+	for _, port := range host.Ports {
+		if _, err := ParsePortSpec(port); err != nil {
+			return nil, cmd.Error("host %s : invalid port %q : %v", host.Name, port, err)
+		}
+	}
+	if err := result.validateIngress(host); err != nil {
+		return nil, cmd.Error("host %s : %v", host.Name, err)
+	}
+	if err := result.mergeEnvIngress(); err != nil {
+		return nil, cmd.Error("host %s : %v", host.Name, err)
+	}
+	if err := result.validateRootVolume(); err != nil {
+		return nil, cmd.Error("host %s : %v", host.Name, err)
+	}
+	if result.KmsKeyId != "" && !result.Encrypted {
+		return nil, cmd.Error("host %s : kmsKeyId %s requires encrypted", host.Name, result.KmsKeyId)
+	}
+	result.applyEnvEncryption()
 	amis := provider.SystemProviderDataFor(host.SystemHash)["amis"].(map[string]interface{})
 	if amisForOsArh, ok := amis[host.OsArch].(map[string]interface{}); ok {
 		if ami, ok := amisForOsArh[result.Region]; ok {
@@ -58,3 +140,25 @@ func HostsByRegion() (map[string]map[string]*Host, *cmd.XbeeError) {
 	}
 	return result, nil
 }
+
+func (d *AwsHostData) validateIngress(host *provider.XbeeHost) error {
+	if err := d.Ingress.validate(); err != nil {
+		return fmt.Errorf("invalid ingress : %v", err)
+	}
+	if err := d.SshIngress.validate(); err != nil {
+		return fmt.Errorf("invalid sshIngress : %v", err)
+	}
+	for port, sources := range d.PortIngress {
+		var declared bool
+		for _, p := range host.Ports {
+			declared = declared || p == port
+		}
+		if !declared {
+			return fmt.Errorf("portIngress is given for port %s, which is not a port of the host", port)
+		}
+		if err := sources.validate(); err != nil {
+			return fmt.Errorf("invalid portIngress for port %s : %v", port, err)
+		}
+	}
+	return nil
+}
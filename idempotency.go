@@ -0,0 +1,128 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+	"time"
+)
+
+const (
+	// XBEE_AWS_CLIENT_TOKEN_ATTEMPTS is the number of client tokens tried for one creation, 20 by default. Each
+	// resource created with the same input and then removed, e.g. by a rollback, uses one of them until EC2 forgets
+	// its token.
+	clientTokenAttemptsEnv = "XBEE_AWS_CLIENT_TOKEN_ATTEMPTS"
+)
+
+// clientToken is stable for a resource of the environment created from a given input, so that a retried or replayed
+// creation returns the resource created the first time. A changed input gets a new token, attempt moves to a new
+// token once the previous resource is gone.
+func clientToken(kind string, name string, input interface{}, attempt int) (string, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", fmt.Errorf("cannot serialize %s input of %s : %v", kind, name, err)
+	}
+	inputSum := sha256.Sum256(data)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%x/%d", provider.EnvId(), kind, name, inputSum, attempt)))
+	return fmt.Sprintf("xbee-%x", sum[:24]), nil
+}
+
+// replayed tells if a resource returned by a creation call existed before the call, its state may then be stale.
+func replayed(created *time.Time, callStart time.Time) bool {
+	return created != nil && created.Before(callStart.Add(-time.Minute))
+}
+
+func (r *Region2) runInstance(ctx context.Context, name string, input *ec2.RunInstancesInput) (*types.Instance, error) {
+	maxAttempts := intOption(clientTokenAttemptsEnv, 20)
+	input.ClientToken = nil
+	tokenInput := *input
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		token, err := clientToken("instance", name, &tokenInput, attempt)
+		if err != nil {
+			return nil, err
+		}
+		input.ClientToken = aws.String(token)
+		start := time.Now()
+		out, err := r.Svc.RunInstances(ctx, input)
+		if err != nil {
+			if apiErrorCode(err) == "IdempotentParameterMismatch" {
+				log2.Infof("client token %d of instance %s was used with other parameters, trying the next one", attempt, name)
+				continue
+			}
+			return nil, err
+		}
+		instance := &out.Instances[0]
+		if replayed(instance.LaunchTime, start) {
+			described, err := r.Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+				InstanceIds: []string{*instance.InstanceId},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(described.Reservations) > 0 && len(described.Reservations[0].Instances) > 0 {
+				instance = &described.Reservations[0].Instances[0]
+			}
+		}
+		switch instance.State.Name {
+		case types.InstanceStateNameTerminated, types.InstanceStateNameShuttingDown:
+			log2.Infof("client token %d of instance %s returns instance %s, which is %s, trying the next one", attempt, name, *instance.InstanceId, instance.State.Name)
+			continue
+		}
+		if replayed(instance.LaunchTime, start) {
+			log2.Infof("instance %s for %s was already launched by a previous run", *instance.InstanceId, name)
+		}
+		return instance, nil
+	}
+	return nil, fmt.Errorf("no usable client token for instance %s after %d attempts, raise %s", name, maxAttempts, clientTokenAttemptsEnv)
+}
+
+func (r *Region2) createVolumeIdempotent(ctx context.Context, name string, input *ec2.CreateVolumeInput) (*types.Volume, error) {
+	maxAttempts := intOption(clientTokenAttemptsEnv, 20)
+	input.ClientToken = nil
+	tokenInput := *input
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		token, err := clientToken("volume", name, &tokenInput, attempt)
+		if err != nil {
+			return nil, err
+		}
+		input.ClientToken = aws.String(token)
+		start := time.Now()
+		out, err := r.Svc.CreateVolume(ctx, input)
+		if err != nil {
+			if apiErrorCode(err) == "IdempotentParameterMismatch" {
+				log2.Infof("client token %d of volume %s was used with other parameters, trying the next one", attempt, name)
+				continue
+			}
+			return nil, err
+		}
+		vol := toVolume(out)
+		if replayed(vol.CreateTime, start) {
+			described, err := r.Svc.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+				VolumeIds: []string{*vol.VolumeId},
+			})
+			if err != nil {
+				if apiErrorCode(err) == "InvalidVolume.NotFound" {
+					log2.Infof("client token %d of volume %s returns volume %s, which is deleted, trying the next one", attempt, name, *vol.VolumeId)
+					continue
+				}
+				return nil, err
+			}
+			if len(described.Volumes) > 0 {
+				vol = &described.Volumes[0]
+			}
+		}
+		switch vol.State {
+		case types.VolumeStateDeleting, types.VolumeStateDeleted, types.VolumeStateError:
+			log2.Infof("client token %d of volume %s returns volume %s, which is %s, trying the next one", attempt, name, *vol.VolumeId, vol.State)
+			continue
+		}
+		return vol, nil
+	}
+	return nil, fmt.Errorf("no usable client token for volume %s after %d attempts, raise %s", name, maxAttempts, clientTokenAttemptsEnv)
+}
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+)
+
+func runInstancesInput(name string) *ec2.RunInstancesInput {
+	return &ec2.RunInstancesInput{
+		ImageId:           aws.String(testAmi),
+		InstanceType:      types.InstanceTypeT3Micro,
+		MinCount:          aws.Int32(1),
+		MaxCount:          aws.Int32(1),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeInstance, name),
+	}
+}
+
+func createVolumeInput(name string) *ec2.CreateVolumeInput {
+	return &ec2.CreateVolumeInput{
+		AvailabilityZone:  aws.String("eu-west-1a"),
+		Size:              aws.Int32(10),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVolume, name),
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	token := func(input *ec2.RunInstancesInput, attempt int) string {
+		result, err := clientToken("instance", "a", input, attempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	first := token(runInstancesInput("a"), 1)
+	if again := token(runInstancesInput("a"), 1); again != first {
+		t.Errorf("got tokens %s and %s for the same input and attempt, want the same", first, again)
+	}
+	if next := token(runInstancesInput("a"), 2); next == first {
+		t.Errorf("got token %s for attempts 1 and 2, want different tokens", first)
+	}
+	changed := runInstancesInput("a")
+	changed.InstanceType = types.InstanceTypeT3Small
+	if other := token(changed, 1); other == first {
+		t.Errorf("got token %s for different inputs, want different tokens", first)
+	}
+}
+
+func TestRunInstanceReplaysSameInputAndSkipsTerminated(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeRegion(awstest.NewFakeCloud(), "eu-west-1")
+	r := &Region2{Name: "eu-west-1", Svc: fake}
+
+	first, err := r.runInstance(ctx, "a", runInstancesInput("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := r.runInstance(ctx, "a", runInstancesInput("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again.InstanceId != *first.InstanceId || len(fake.Instances) != 1 {
+		t.Errorf("got instances %s and %s, want the same input to return the instance created first", *first.InstanceId, *again.InstanceId)
+	}
+
+	if _, err := fake.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{*first.InstanceId}}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls["RunInstances"]
+	created, err := r.runInstance(ctx, "a", runInstancesInput("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *created.InstanceId == *first.InstanceId {
+		t.Errorf("got terminated instance %s, want a new one", *first.InstanceId)
+	}
+	if got := fake.Calls["RunInstances"] - calls; got != 2 {
+		t.Errorf("got %d RunInstances calls, want the terminated replay and a new token", got)
+	}
+}
+
+func TestCreateVolumeIdempotentSkipsDeleted(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeRegion(awstest.NewFakeCloud(), "eu-west-1")
+	r := &Region2{Name: "eu-west-1", Svc: fake}
+
+	first, err := r.createVolumeIdempotent(ctx, "data", createVolumeInput("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := r.createVolumeIdempotent(ctx, "data", createVolumeInput("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again.VolumeId != *first.VolumeId || len(fake.Volumes) != 1 {
+		t.Errorf("got volumes %s and %s, want the same input to return the volume created first", *first.VolumeId, *again.VolumeId)
+	}
+
+	if _, err := fake.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: first.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls["CreateVolume"]
+	created, err := r.createVolumeIdempotent(ctx, "data", createVolumeInput("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *created.VolumeId == *first.VolumeId {
+		t.Errorf("got deleted volume %s, want a new one", *first.VolumeId)
+	}
+	if got := fake.Calls["CreateVolume"] - calls; got != 2 {
+		t.Errorf("got %d CreateVolume calls, want the deleted replay and a new token", got)
+	}
+}
@@ -0,0 +1,235 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// XBEE_AWS_CALLER_IP overrides the detected egress ip of the caller, e.g. when behind a proxy.
+	callerIpEnv = "XBEE_AWS_CALLER_IP"
+	// XBEE_AWS_CALLER_IP_URL is the service answering the egress ip of the caller, https://checkip.amazonaws.com by default.
+	callerIpUrlEnv = "XBEE_AWS_CALLER_IP_URL"
+	// XBEE_AWS_INGRESS is the JSON of the sources allowed to reach the ports of every host of the env, merged with
+	// the ingress and portIngress of each host, e.g. {"cidrs":["10.0.0.0/8"],"callerIp":true}.
+	envIngressEnv = "XBEE_AWS_INGRESS"
+	// XBEE_AWS_SSH_INGRESS is the JSON of the sources allowed to reach port 22, merged with the sshIngress of each host.
+	envSshIngressEnv = "XBEE_AWS_SSH_INGRESS"
+)
+
+// IngressSources lists who may reach a port. No source at all means anyone (0.0.0.0/0).
+type IngressSources struct {
+	Cidrs []string `json:"cidrs"`
+	// ids of security groups, e.g. the one of a bastion or a load balancer
+	SecurityGroups []string `json:"securityGroups"`
+	// adds the egress ip of the caller, detected when the rule is created
+	CallerIp bool `json:"callerIp"`
+}
+
+func (s *IngressSources) isEmpty() bool {
+	return s == nil || (len(s.Cidrs) == 0 && len(s.SecurityGroups) == 0 && !s.CallerIp)
+}
+
+func (s *IngressSources) validate() error {
+	if s == nil {
+		return nil
+	}
+	for _, cidr := range s.Cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("%s is not a cidr block", cidr)
+		}
+	}
+	for _, id := range s.SecurityGroups {
+		if !strings.HasPrefix(id, "sg-") {
+			return fmt.Errorf("%s is not a security group id", id)
+		}
+	}
+	return nil
+}
+
+// merge returns the union of s and other.
+func (s *IngressSources) merge(other *IngressSources) *IngressSources {
+	if s == nil {
+		return other
+	}
+	if other == nil {
+		return s
+	}
+	result := &IngressSources{CallerIp: s.CallerIp || other.CallerIp}
+	result.Cidrs = appendMissing(append([]string{}, s.Cidrs...), other.Cidrs...)
+	result.SecurityGroups = appendMissing(append([]string{}, s.SecurityGroups...), other.SecurityGroups...)
+	return result
+}
+
+func appendMissing(values []string, added ...string) []string {
+	for _, v := range added {
+		var found bool
+		for _, existing := range values {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// permission returns the ingress rule opening ports from to to for the sources, its rules are described as created
+// by xbee.
+func (s *IngressSources) permission(ctx context.Context, protocol string, from int32, to int32) (types.IpPermission, error) {
+	permission := types.IpPermission{
+		IpProtocol: aws.String(protocol),
+		FromPort:   aws.Int32(from),
+		ToPort:     aws.Int32(to),
+	}
+	if s.isEmpty() {
+		permission.IpRanges = []types.IpRange{
+			{CidrIp: aws.String("0.0.0.0/0"), Description: aws.String(ruleDescription)},
+		}
+		return permission, nil
+	}
+	descriptions := map[string]string{}
+	for _, cidr := range s.Cidrs {
+		descriptions[cidr] = ruleDescription
+	}
+	cidrs := s.Cidrs
+	if s.CallerIp {
+		ip, err := callerIp(ctx)
+		if err != nil {
+			return permission, err
+		}
+		if _, ok := descriptions[ip]; !ok {
+			descriptions[ip] = callerRuleDescription
+		}
+		cidrs = appendMissing(append([]string{}, cidrs...), ip)
+	}
+	for _, cidr := range cidrs {
+		if isIpv6Cidr(cidr) {
+			permission.Ipv6Ranges = append(permission.Ipv6Ranges, types.Ipv6Range{CidrIpv6: aws.String(cidr), Description: aws.String(descriptions[cidr])})
+		} else {
+			permission.IpRanges = append(permission.IpRanges, types.IpRange{CidrIp: aws.String(cidr), Description: aws.String(descriptions[cidr])})
+		}
+	}
+	for _, id := range s.SecurityGroups {
+		permission.UserIdGroupPairs = append(permission.UserIdGroupPairs, types.UserIdGroupPair{GroupId: aws.String(id), Description: aws.String(ruleDescription)})
+	}
+	return permission, nil
+}
+
+func isIpv6Cidr(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
+
+var detectedCallerIp struct {
+	sync.Mutex
+	cidr string
+}
+
+// callerIp returns the egress ip of the caller as a /32 (or /128) cidr block, detected once per run.
+func callerIp(ctx context.Context) (string, error) {
+	detectedCallerIp.Lock()
+	defer detectedCallerIp.Unlock()
+	if detectedCallerIp.cidr != "" {
+		return detectedCallerIp.cidr, nil
+	}
+	value := stringOption(callerIpEnv)
+	if value == "" {
+		url := stringOption(callerIpUrlEnv)
+		if url == "" {
+			url = "https://checkip.amazonaws.com"
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", fmt.Errorf("cannot detect caller ip from %s : %v", url, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("cannot detect caller ip from %s : %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("cannot detect caller ip from %s : %s", url, resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+		if err != nil {
+			return "", fmt.Errorf("cannot detect caller ip from %s : %v", url, err)
+		}
+		value = strings.TrimSpace(string(data))
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("caller ip %q is not an ip address", value)
+	}
+	if ip.To4() != nil {
+		detectedCallerIp.cidr = ip.String() + "/32"
+	} else {
+		detectedCallerIp.cidr = ip.String() + "/128"
+	}
+	return detectedCallerIp.cidr, nil
+}
+
+// envIngressOption returns the sources given as JSON by the option name, nil when it is not set.
+func envIngressOption(name string) (*IngressSources, error) {
+	value := stringOption(name)
+	if value == "" {
+		return nil, nil
+	}
+	var result IngressSources
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON : %v", name, err)
+	}
+	if err := result.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s : %v", name, err)
+	}
+	return &result, nil
+}
+
+// mergeEnvIngress adds the sources of the env, given by XBEE_AWS_INGRESS and XBEE_AWS_SSH_INGRESS, to the ones of
+// the host. Ports with their own sources get the ones of the env too.
+func (d *AwsHostData) mergeEnvIngress() error {
+	ingress, err := envIngressOption(envIngressEnv)
+	if err != nil {
+		return err
+	}
+	sshIngress, err := envIngressOption(envSshIngressEnv)
+	if err != nil {
+		return err
+	}
+	d.Ingress = d.Ingress.merge(ingress)
+	for port, sources := range d.PortIngress {
+		d.PortIngress[port] = sources.merge(ingress)
+	}
+	d.SshIngress = d.SshIngress.merge(sshIngress)
+	return nil
+}
+
+// portIngress returns the sources allowed to reach the host port given as in Ports.
+func (d *AwsHostData) portIngress(port string) *IngressSources {
+	if sources, ok := d.PortIngress[port]; ok {
+		return sources
+	}
+	return d.Ingress
+}
+
+// sshIngress returns the union of the SSH sources of the hosts, they share the SSH security group of the env.
+func (r *Region2) sshIngress() *IngressSources {
+	var result *IngressSources
+	for _, name := range r.sortedHostNames() {
+		result = result.merge(r.Hosts[name].Specification.SshIngress)
+	}
+	return result
+}
@@ -0,0 +1,32 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeEnvIngress(t *testing.T) {
+	t.Setenv(envIngressEnv, `{"cidrs":["10.0.0.0/8"]}`)
+	t.Setenv(envSshIngressEnv, `{"securityGroups":["sg-bastion"]}`)
+	d := &AwsHostData{
+		Ingress:     &IngressSources{Cidrs: []string{"192.168.0.0/16"}},
+		PortIngress: map[string]*IngressSources{"443": {CallerIp: true}},
+	}
+	if err := d.mergeEnvIngress(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.168.0.0/16", "10.0.0.0/8"}; !reflect.DeepEqual(d.Ingress.Cidrs, want) {
+		t.Errorf("got ingress cidrs %v, want %v", d.Ingress.Cidrs, want)
+	}
+	if got := d.PortIngress["443"]; !got.CallerIp || !reflect.DeepEqual(got.Cidrs, []string{"10.0.0.0/8"}) {
+		t.Errorf("got port 443 ingress %+v, want the caller ip and the env cidr", got)
+	}
+	if got := d.SshIngress; got == nil || !reflect.DeepEqual(got.SecurityGroups, []string{"sg-bastion"}) {
+		t.Errorf("got ssh ingress %+v, want the env security group", got)
+	}
+
+	t.Setenv(envIngressEnv, `{"cidrs":["10.0.0.0"]}`)
+	if err := (&AwsHostData{}).mergeEnvIngress(); err == nil {
+		t.Error("an env ingress which is not a cidr block should be refused")
+	}
+}
@@ -0,0 +1,223 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// XBEE_AWS_ROLLBACK_ON_INTERRUPT=true removes the resources created by an interrupted command, they are only listed otherwise.
+	rollbackOnInterruptEnv = "XBEE_AWS_ROLLBACK_ON_INTERRUPT"
+	// XBEE_AWS_KEEP_ON_FAILURE=true keeps what Up created for a host it failed to create, e.g. to debug it.
+	keepOnFailureEnv = "XBEE_AWS_KEEP_ON_FAILURE"
+)
+
+const (
+	resourceInstance      = "instance"
+	resourceVolume        = "volume"
+	resourceSecurityGroup = "security group"
+	resourceAddress       = "elastic ip"
+	resourceNetwork       = "vpc"
+	resourceImage         = "ami"
+)
+
+// commandContext returns the root context of a provider command, cancelled on SIGINT or SIGTERM.
+// Once cancelled, a second signal is no more caught and ends the process.
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// createdResource is a resource created by the running command.
+type createdResource struct {
+	r    *Region2
+	Kind string
+	Id   string
+	// host, volume or env level name the resource was created for
+	Name string
+}
+
+// journal records the resources created by a command, so that they can be reported or rolled back when the command
+// does not complete. A nil journal records nothing.
+type journal struct {
+	mu        sync.Mutex
+	resources []*createdResource
+}
+
+func (j *journal) record(r *Region2, kind string, id string, name string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resources = append(j.resources, &createdResource{r: r, Kind: kind, Id: id, Name: name})
+}
+
+func (j *journal) created() []*createdResource {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]*createdResource{}, j.resources...)
+}
+
+func (j *journal) logSummary() {
+	resources := j.created()
+	if len(resources) == 0 {
+		log2.Infof("no resource was created")
+		return
+	}
+	log2.Warnf("resources created so far:")
+	for _, res := range resources {
+		log2.Warnf("  %s %s for %s in region %s", res.Kind, res.Id, res.Name, res.r.Name)
+	}
+}
+
+// take removes from j the resources created for h, and returns them in a new journal.
+func (j *journal) take(h *Host) *journal {
+	result := &journal{}
+	if j == nil {
+		return result
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var kept []*createdResource
+	for _, res := range j.resources {
+		if res.Name == h.Name || (res.Kind == resourceVolume && containsString(h.Volumes, res.Name)) {
+			result.resources = append(result.resources, res)
+		} else {
+			kept = append(kept, res)
+		}
+	}
+	j.resources = kept
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackHost removes what the running command created for h, which it failed to create, in reverse order.
+// Nothing is done when the command is interrupted, interrupted then reports every created resource.
+func (r *Region2) rollbackHost(ctx context.Context, h *Host) {
+	if ctx.Err() != nil {
+		return
+	}
+	if boolOption(keepOnFailureEnv) {
+		log2.Warnf("keeping the resources created for host %s as %s is set", h.Name, keepOnFailureEnv)
+		return
+	}
+	hostJournal := r.journal.take(h)
+	if len(hostJournal.resources) == 0 {
+		return
+	}
+	log2.Warnf("rolling back the resources created for host %s", h.Name)
+	if err := hostJournal.rollback(ctx); err != nil {
+		log2.Errorf("cannot roll back host %s : %v", h.Name, err)
+	}
+}
+
+// rollback removes the recorded resources. Instances are terminated first, the other resources are then removed
+// newest first, as volumes and security groups cannot be deleted while in use. Removed volumes and addresses are
+// forgotten by their region, so that a later step of the command does not use them.
+func (j *journal) rollback(ctx context.Context) error {
+	resources := j.created()
+	var errs []error
+	instanceIds := map[*Region2][]string{}
+	for _, res := range resources {
+		if res.Kind == resourceInstance {
+			instanceIds[res.r] = append(instanceIds[res.r], res.Id)
+		}
+	}
+	for r, ids := range instanceIds {
+		if err := r.terminateAndWait(ctx, ids); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for index := len(resources) - 1; index >= 0; index-- {
+		res := resources[index]
+		var err error
+		switch res.Kind {
+		case resourceVolume:
+			if _, err = res.r.Svc.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(res.Id)}); err == nil || isNotFound(err) {
+				res.r.forgetVolume(res.Id)
+			}
+		case resourceSecurityGroup:
+			_, err = res.r.Svc.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(res.Id)})
+		case resourceAddress:
+			if a := res.r.addressFor(res.Name); a != nil {
+				err = res.r.releaseAddress(ctx, a)
+			}
+		case resourceNetwork:
+			err = res.r.deleteEnvNetworkIfPossible(ctx)
+		case resourceImage:
+			_, err = res.r.Svc.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(res.Id)})
+		default:
+			continue
+		}
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("cannot roll back %s %s of %s : %v", res.Kind, res.Id, res.Name, err))
+		} else {
+			log2.Infof("rolled back %s %s of %s in region %s", res.Kind, res.Id, res.Name, res.r.Name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// terminateAndWait terminates the instances and waits until they are terminated.
+func (r *Region2) terminateAndWait(ctx context.Context, ids []string) error {
+	if _, err := r.Svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: ids}); err != nil {
+		return fmt.Errorf("cannot terminate instances %v in region %s : %v", ids, r.Name, err)
+	}
+	minDelay, maxDelay := waitDelays()
+	if err := ec2.NewInstanceTerminatedWaiter(r.Svc, func(o *ec2.InstanceTerminatedWaiterOptions) {
+		o.MinDelay, o.MaxDelay = minDelay, maxDelay
+	}).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids}, durationOption(waitTerminatedEnv, 10*time.Minute)); err != nil {
+		return fmt.Errorf("instances %v in region %s are not terminated : %v", ids, r.Name, err)
+	}
+	for _, id := range ids {
+		log2.Infof("rolled back %s %s in region %s", resourceInstance, id, r.Name)
+	}
+	return nil
+}
+
+// interrupted reports the resources created by the interrupted command op, and rolls them back when asked to.
+func (j *journal) interrupted(op string) *cmd.XbeeError {
+	log2.Warnf("%s interrupted", op)
+	j.logSummary()
+	if len(j.created()) == 0 {
+		return cmd.Error("%s interrupted", op)
+	}
+	if !boolOption(rollbackOnInterruptEnv) {
+		log2.Warnf("set %s=true to remove them when interrupted", rollbackOnInterruptEnv)
+		return cmd.Error("%s interrupted, created resources were kept", op)
+	}
+	ctx, stop := commandContext()
+	defer stop()
+	if err := j.rollback(ctx); err != nil {
+		return cmd.Error("%s interrupted, rollback incomplete : %v", op, err)
+	}
+	return cmd.Error("%s interrupted, created resources were rolled back", op)
+}
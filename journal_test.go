@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"github.com/iodasolutions/xbee-common/provider"
+	"testing"
+)
+
+func TestRollbackHostForgetsRemovedResources(t *testing.T) {
+	ctx := context.Background()
+	fake := awstest.NewFakeEC2("eu-west-1")
+	r := &Region2{Name: "eu-west-1", Svc: fake, Ec2Volumes: map[string]*types.Volume{}, journal: &journal{}}
+	h := &Host{
+		XbeeHost:      &provider.XbeeHost{Name: "h", Volumes: []string{"data"}},
+		Specification: &AwsHostData{ElasticIp: true},
+	}
+	vol, err := fake.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone:  aws.String("eu-west-1a"),
+		Size:              aws.Int32(1),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVolume, "data"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Ec2Volumes["data"] = &types.Volume{VolumeId: vol.VolumeId}
+	r.journal.record(r, resourceVolume, *vol.VolumeId, "data")
+	if _, _, err := r.ensureAddress(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+
+	r.rollbackHost(ctx, h)
+	if _, ok := r.Ec2Volumes["data"]; ok {
+		t.Error("the deleted volume is still known by the region")
+	}
+	if len(r.EIps) != 0 {
+		t.Errorf("the released Elastic IP is still known by the region : %v", r.EIps)
+	}
+	if len(fake.Volumes) != 0 || len(fake.Addresses) != 0 {
+		t.Errorf("volumes %v and addresses %v remain", fake.Volumes, fake.Addresses)
+	}
+}
@@ -0,0 +1,455 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+	"net"
+	"sort"
+)
+
+const (
+	defaultVpcCidr = "10.0.0.0/16"
+	SubnetPublic   = "public"
+	SubnetPrivate  = "private"
+)
+
+// EnvNetwork is the vpc built for an env when its hosts ask for a managed vpc.
+// Every resource is tagged with the xbee.id of the env.
+type EnvNetwork struct {
+	VpcId           *string
+	InternetGateway *types.InternetGateway
+	// route tables by subnet tier, public or private
+	RouteTables map[string]*types.RouteTable
+	// subnets by xbee.name, e.g. public-eu-west-3a
+	Subnets map[string]*types.Subnet
+}
+
+func subnetName(tier string, zone string) string {
+	return tier + "-" + zone
+}
+
+// managedNetwork tells whether the hosts of the region ask for a managed vpc, all hosts must agree.
+func (r *Region2) managedNetwork() (bool, error) {
+	var managed, unmanaged []string
+	for _, name := range r.sortedHostNames() {
+		spec := r.Hosts[name].Specification
+		if spec.ManagedVpc {
+			if spec.VpcId != "" || spec.SubnetId != "" || len(spec.SubnetTags) > 0 {
+				return false, fmt.Errorf("host %s asks for a managed vpc, it cannot set vpcId, subnetId or subnetTags", name)
+			}
+			managed = append(managed, name)
+		} else {
+			unmanaged = append(unmanaged, name)
+		}
+	}
+	if len(managed) > 0 && len(unmanaged) > 0 {
+		return false, fmt.Errorf("hosts %v ask for a managed vpc but hosts %v do not, hosts of a region must share one vpc", managed, unmanaged)
+	}
+	return len(managed) > 0, nil
+}
+
+// findEnvNetwork looks for the network previously built for the env.
+func (r *Region2) findEnvNetwork(ctx context.Context) error {
+	vpcs, err := CollectPages(ctx, ec2.NewDescribeVpcsPaginator(r.Svc, &ec2.DescribeVpcsInput{
+		Filters: EnvFiltersForResource("vpc"),
+	}), func(out *ec2.DescribeVpcsOutput) []types.Vpc {
+		return out.Vpcs
+	})
+	if err != nil {
+		return err
+	}
+	if len(vpcs) == 0 {
+		return nil
+	}
+	n := &EnvNetwork{
+		VpcId:       vpcs[0].VpcId,
+		RouteTables: map[string]*types.RouteTable{},
+		Subnets:     map[string]*types.Subnet{},
+	}
+	filters := append(EnvFilters(), types.Filter{
+		Name:   aws.String("vpc-id"),
+		Values: []string{*n.VpcId},
+	})
+	subnets, err := CollectPages(ctx, ec2.NewDescribeSubnetsPaginator(r.Svc, &ec2.DescribeSubnetsInput{
+		Filters: filters,
+	}), func(out *ec2.DescribeSubnetsOutput) []types.Subnet {
+		return out.Subnets
+	})
+	if err != nil {
+		return err
+	}
+	for index := range subnets {
+		n.Subnets[TagValue(subnets[index].Tags, "xbee.name")] = &subnets[index]
+	}
+	tables, err := CollectPages(ctx, ec2.NewDescribeRouteTablesPaginator(r.Svc, &ec2.DescribeRouteTablesInput{
+		Filters: filters,
+	}), func(out *ec2.DescribeRouteTablesOutput) []types.RouteTable {
+		return out.RouteTables
+	})
+	if err != nil {
+		return err
+	}
+	for index := range tables {
+		n.RouteTables[TagValue(tables[index].Tags, "xbee.name")] = &tables[index]
+	}
+	gateways, err := CollectPages(ctx, ec2.NewDescribeInternetGatewaysPaginator(r.Svc, &ec2.DescribeInternetGatewaysInput{
+		Filters: EnvFiltersForResource("igw"),
+	}), func(out *ec2.DescribeInternetGatewaysOutput) []types.InternetGateway {
+		return out.InternetGateways
+	})
+	if err != nil {
+		return err
+	}
+	if len(gateways) > 0 {
+		n.InternetGateway = &gateways[0]
+	}
+	r.Network = n
+	return nil
+}
+
+// fillZones lists the available zones of the region, sorted.
+func (r *Region2) fillZones(ctx context.Context) error {
+	out, err := r.Svc.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("zone-type"),
+				Values: []string{"availability-zone"},
+			},
+			{
+				Name:   aws.String("state"),
+				Values: []string{"available"},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list availability zones of region %s : %v", r.Name, err)
+	}
+	var zones []string
+	for _, zone := range out.AvailabilityZones {
+		zones = append(zones, *zone.ZoneName)
+	}
+	if len(zones) == 0 {
+		return fmt.Errorf("no availability zone available in region %s", r.Name)
+	}
+	sort.Strings(zones)
+	r.Zones = zones
+	return nil
+}
+
+// placeInEnvNetwork chooses the subnet of each host in the managed vpc, subnets still to be created are left out.
+func (r *Region2) placeInEnvNetwork(ctx context.Context) error {
+	if err := r.fillZones(ctx); err != nil {
+		return err
+	}
+	if r.Network == nil {
+		return nil
+	}
+	r.VpcId = r.Network.VpcId
+	for _, name := range r.sortedHostNames() {
+		zone, err := r.envZoneFor(r.Hosts[name])
+		if err != nil {
+			return err
+		}
+		if subnet, ok := r.Network.Subnets[subnetName(r.Hosts[name].Specification.subnetTier(), zone)]; ok {
+			r.Subnets[name] = subnet
+		}
+	}
+	return nil
+}
+
+// envZoneFor returns the zone of h in the managed vpc, the first zone of the region when nothing constrains it.
+func (r *Region2) envZoneFor(h *Host) (string, error) {
+	placement, err := r.availabilityZoneFor(h)
+	if err != nil {
+		return "", err
+	}
+	if placement != nil {
+		return *placement.AvailabilityZone, nil
+	}
+	return r.Zones[0], nil
+}
+
+// ensureEnvNetwork builds what is missing of the managed vpc: the vpc, its internet gateway, the public and private
+// route tables, and both subnets in each zone used by the hosts. Only the public route table routes to the internet
+// gateway, there is no NAT gateway and hosts of the private subnets have no egress to the internet.
+func (r *Region2) ensureEnvNetwork(ctx context.Context) error {
+	// each call works on a resource just created or found
+	ctx = afterCreate(ctx)
+	n := r.Network
+	if n == nil {
+		n = &EnvNetwork{
+			RouteTables: map[string]*types.RouteTable{},
+			Subnets:     map[string]*types.Subnet{},
+		}
+	}
+	cidr := r.vpcCidr()
+	if n.VpcId == nil {
+		out, err := r.Svc.CreateVpc(ctx, &ec2.CreateVpcInput{
+			CidrBlock:         aws.String(cidr),
+			TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVpc, "vpc"),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create vpc for env %s in region %s : %v", provider.EnvName(), r.Name, err)
+		}
+		n.VpcId = out.Vpc.VpcId
+		r.Network = n
+		r.journal.record(r, resourceNetwork, *n.VpcId, "vpc")
+		log2.Infof("created vpc %s for env %s in region %s", *n.VpcId, provider.EnvName(), r.Name)
+		if _, err := r.Svc.ModifyVpcAttribute(ctx, &ec2.ModifyVpcAttributeInput{
+			VpcId:              n.VpcId,
+			EnableDnsHostnames: &types.AttributeBooleanValue{Value: aws.Bool(true)},
+		}); err != nil {
+			return fmt.Errorf("cannot enable dns hostnames in vpc %s : %v", *n.VpcId, err)
+		}
+	}
+	r.VpcId = n.VpcId
+	if n.InternetGateway == nil {
+		out, err := r.Svc.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
+			TagSpecifications: TagSpecificationsForResource(types.ResourceTypeInternetGateway, "igw"),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create internet gateway for env %s in region %s : %v", provider.EnvName(), r.Name, err)
+		}
+		n.InternetGateway = out.InternetGateway
+	}
+	if len(n.InternetGateway.Attachments) == 0 {
+		if _, err := r.Svc.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
+			InternetGatewayId: n.InternetGateway.InternetGatewayId,
+			VpcId:             n.VpcId,
+		}); err != nil {
+			return fmt.Errorf("cannot attach internet gateway %s to vpc %s : %v", *n.InternetGateway.InternetGatewayId, *n.VpcId, err)
+		}
+		n.InternetGateway.Attachments = []types.InternetGatewayAttachment{
+			{
+				VpcId: n.VpcId,
+				State: types.AttachmentStatusAttached,
+			},
+		}
+	}
+	for _, tier := range []string{SubnetPublic, SubnetPrivate} {
+		if _, ok := n.RouteTables[tier]; ok {
+			continue
+		}
+		out, err := r.Svc.CreateRouteTable(ctx, &ec2.CreateRouteTableInput{
+			VpcId:             n.VpcId,
+			TagSpecifications: TagSpecificationsForResource(types.ResourceTypeRouteTable, tier),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create %s route table in vpc %s : %v", tier, *n.VpcId, err)
+		}
+		n.RouteTables[tier] = out.RouteTable
+	}
+	if !hasDefaultRoute(n.RouteTables[SubnetPublic]) {
+		table := n.RouteTables[SubnetPublic]
+		if _, err := r.Svc.CreateRoute(ctx, &ec2.CreateRouteInput{
+			RouteTableId:         table.RouteTableId,
+			DestinationCidrBlock: aws.String("0.0.0.0/0"),
+			GatewayId:            n.InternetGateway.InternetGatewayId,
+		}); err != nil {
+			return fmt.Errorf("cannot route public subnets of vpc %s to the internet gateway : %v", *n.VpcId, err)
+		}
+		table.Routes = append(table.Routes, types.Route{
+			DestinationCidrBlock: aws.String("0.0.0.0/0"),
+			GatewayId:            n.InternetGateway.InternetGatewayId,
+		})
+	}
+	for _, name := range r.sortedHostNames() {
+		h := r.Hosts[name]
+		zone, err := r.envZoneFor(h)
+		if err != nil {
+			return err
+		}
+		for _, tier := range []string{SubnetPublic, SubnetPrivate} {
+			if _, ok := n.Subnets[subnetName(tier, zone)]; !ok {
+				if err := r.createEnvSubnet(ctx, cidr, tier, zone); err != nil {
+					return err
+				}
+			}
+			if err := r.associateEnvSubnet(ctx, tier, n.Subnets[subnetName(tier, zone)]); err != nil {
+				return err
+			}
+		}
+		r.Subnets[name] = n.Subnets[subnetName(h.Specification.subnetTier(), zone)]
+		if h.Specification.subnetTier() == SubnetPrivate {
+			log2.Warnf("host %s is placed in a private subnet, it has no access to the internet", name)
+		}
+	}
+	return nil
+}
+
+func (r *Region2) createEnvSubnet(ctx context.Context, vpcCidr string, tier string, zone string) error {
+	n := r.Network
+	index := sort.SearchStrings(r.Zones, zone)
+	if index == len(r.Zones) || r.Zones[index] != zone {
+		return fmt.Errorf("zone %s is not available in region %s", zone, r.Name)
+	}
+	index = 2 * index
+	if tier == SubnetPrivate {
+		index++
+	}
+	cidr, err := subnetCidr(vpcCidr, index)
+	if err != nil {
+		return err
+	}
+	name := subnetName(tier, zone)
+	out, err := r.Svc.CreateSubnet(ctx, &ec2.CreateSubnetInput{
+		VpcId:             n.VpcId,
+		CidrBlock:         aws.String(cidr),
+		AvailabilityZone:  aws.String(zone),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeSubnet, name),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create subnet %s in vpc %s : %v", name, *n.VpcId, err)
+	}
+	subnet := out.Subnet
+	n.Subnets[name] = subnet
+	if tier == SubnetPublic {
+		if _, err := r.Svc.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
+			SubnetId:            subnet.SubnetId,
+			MapPublicIpOnLaunch: &types.AttributeBooleanValue{Value: aws.Bool(true)},
+		}); err != nil {
+			return fmt.Errorf("cannot map public ips in subnet %s : %v", *subnet.SubnetId, err)
+		}
+	}
+	log2.Infof("created subnet %s (%s) for env %s in region %s", name, cidr, provider.EnvName(), r.Name)
+	return nil
+}
+
+func (r *Region2) associateEnvSubnet(ctx context.Context, tier string, subnet *types.Subnet) error {
+	table := r.Network.RouteTables[tier]
+	for _, association := range table.Associations {
+		if aws.ToString(association.SubnetId) == *subnet.SubnetId {
+			return nil
+		}
+	}
+	out, err := r.Svc.AssociateRouteTable(ctx, &ec2.AssociateRouteTableInput{
+		RouteTableId: table.RouteTableId,
+		SubnetId:     subnet.SubnetId,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot associate subnet %s to %s route table : %v", *subnet.SubnetId, tier, err)
+	}
+	table.Associations = append(table.Associations, types.RouteTableAssociation{
+		RouteTableAssociationId: out.AssociationId,
+		RouteTableId:            table.RouteTableId,
+		SubnetId:                subnet.SubnetId,
+	})
+	return nil
+}
+
+func hasDefaultRoute(table *types.RouteTable) bool {
+	for _, route := range table.Routes {
+		if aws.ToString(route.DestinationCidrBlock) == "0.0.0.0/0" && route.GatewayId != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Region2) vpcCidr() string {
+	for _, name := range r.sortedHostNames() {
+		if cidr := r.Hosts[name].Specification.VpcCidr; cidr != "" {
+			return cidr
+		}
+	}
+	return defaultVpcCidr
+}
+
+// subnetCidr returns the index-th subnet of vpcCidr, subnets being 256 times smaller than the vpc.
+func subnetCidr(vpcCidr string, index int) (string, error) {
+	_, network, err := net.ParseCIDR(vpcCidr)
+	if err != nil || network.IP.To4() == nil {
+		return "", fmt.Errorf("vpcCidr %s is not an IPv4 cidr block", vpcCidr)
+	}
+	ones, _ := network.Mask.Size()
+	if ones < 16 || ones > 20 {
+		return "", fmt.Errorf("vpcCidr %s must have a prefix length between 16 and 20", vpcCidr)
+	}
+	if index > 255 {
+		return "", fmt.Errorf("vpcCidr %s has no room for subnet %d", vpcCidr, index)
+	}
+	ip := network.IP.To4()
+	value := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	value += uint32(index) << uint(32-ones-8)
+	return fmt.Sprintf("%d.%d.%d.%d/%d", byte(value>>24), byte(value>>16), byte(value>>8), byte(value), ones+8), nil
+}
+
+// deleteEnvNetworkIfPossible tears down the managed vpc once no instance of the env remains in the region.
+func (r *Region2) deleteEnvNetworkIfPossible(ctx context.Context) error {
+	if r.Network == nil {
+		return nil
+	}
+	instances, err := CollectPages(ctx, ec2.NewDescribeInstancesPaginator(r.Svc, &ec2.DescribeInstancesInput{
+		Filters: append(EnvFilters(), types.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: []string{"pending", "running", "shutting-down", "stopping", "stopped"},
+		}),
+	}), func(out *ec2.DescribeInstancesOutput) []types.Reservation {
+		return out.Reservations
+	})
+	if err != nil {
+		return fmt.Errorf("cannot look for instances of env %s in region %s : %v", provider.EnvName(), r.Name, err)
+	}
+	if len(instances) > 0 {
+		log2.Infof("instances of env %s remain in region %s, keeping vpc %s", provider.EnvName(), r.Name, *r.Network.VpcId)
+		return nil
+	}
+	return r.deleteEnvNetwork(ctx)
+}
+
+func (r *Region2) deleteEnvNetwork(ctx context.Context) error {
+	n := r.Network
+	var names []string
+	for name := range n.Subnets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := r.Svc.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{
+			SubnetId: n.Subnets[name].SubnetId,
+		}); err != nil && !isNotFound(err) {
+			return fmt.Errorf("cannot delete subnet %s of vpc %s : %v", name, *n.VpcId, err)
+		}
+		delete(n.Subnets, name)
+	}
+	for _, tier := range []string{SubnetPublic, SubnetPrivate} {
+		if _, ok := n.RouteTables[tier]; !ok {
+			continue
+		}
+		if _, err := r.Svc.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{
+			RouteTableId: n.RouteTables[tier].RouteTableId,
+		}); err != nil && !isNotFound(err) {
+			return fmt.Errorf("cannot delete %s route table of vpc %s : %v", tier, *n.VpcId, err)
+		}
+		delete(n.RouteTables, tier)
+	}
+	if igw := n.InternetGateway; igw != nil {
+		for _, attachment := range igw.Attachments {
+			if _, err := r.Svc.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
+				InternetGatewayId: igw.InternetGatewayId,
+				VpcId:             attachment.VpcId,
+			}); err != nil && !isNotFound(err) && apiErrorCode(err) != "Gateway.NotAttached" {
+				return fmt.Errorf("cannot detach internet gateway %s from vpc %s : %v", *igw.InternetGatewayId, *attachment.VpcId, err)
+			}
+		}
+		if _, err := r.Svc.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{
+			InternetGatewayId: igw.InternetGatewayId,
+		}); err != nil && !isNotFound(err) {
+			return fmt.Errorf("cannot delete internet gateway %s : %v", *igw.InternetGatewayId, err)
+		}
+		n.InternetGateway = nil
+	}
+	if _, err := r.Svc.DeleteVpc(ctx, &ec2.DeleteVpcInput{
+		VpcId: n.VpcId,
+	}); err != nil && !isNotFound(err) {
+		return fmt.Errorf("cannot delete vpc %s of env %s in region %s : %v", *n.VpcId, provider.EnvName(), r.Name, err)
+	}
+	log2.Infof("deleted vpc %s of env %s in region %s", *n.VpcId, provider.EnvName(), r.Name)
+	r.Network = nil
+	return nil
+}
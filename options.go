@@ -0,0 +1,76 @@
+package aws
+
+import (
+	"encoding/json"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Provider options are read from the environment, so they can be set per xbee invocation.
+const (
+	// XBEE_AWS_DRY_RUN=true makes Up and Delete print their plan instead of changing anything.
+	dryRunEnv = "XBEE_AWS_DRY_RUN"
+	// XBEE_AWS_PLAN_FILE is where the JSON plan is written in dry run mode, only the human readable plan is logged when
+	// empty.
+	planFileEnv = "XBEE_AWS_PLAN_FILE"
+	// XBEE_AWS_VOLUME_DEVICES_FILE is where the JSON listing of volume devices is written, it is logged when empty.
+	volumeDevicesFileEnv = "XBEE_AWS_VOLUME_DEVICES_FILE"
+)
+
+func boolOption(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+func stringOption(name string) string {
+	return os.Getenv(name)
+}
+
+func dryRun() bool {
+	return boolOption(dryRunEnv)
+}
+
+func intOption(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		if result, err := strconv.Atoi(value); err == nil {
+			return result
+		}
+		log2.Warnf("ignoring %s=%s, an integer is expected", name, value)
+	}
+	return defaultValue
+}
+
+func durationOption(name string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if result, err := time.ParseDuration(value); err == nil {
+			return result
+		}
+		log2.Warnf("ignoring %s=%s, a duration like 90s is expected", name, value)
+	}
+	return defaultValue
+}
+
+// writeJson writes v as JSON to the file named by the option fileEnv, or logs it when the option is not set. The
+// standard output of the provider is its channel with xbee, nothing else is printed there.
+func writeJson(fileEnv string, what string, v interface{}) *cmd.XbeeError {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return cmd.Error("cannot serialize %s : %v", what, err)
+	}
+	if fileName := stringOption(fileEnv); fileName != "" {
+		return writeJsonFile(fileName, what, data)
+	}
+	log2.Infof("%s:\n%s", what, data)
+	return nil
+}
+
+func writeJsonFile(fileName string, what string, data []byte) *cmd.XbeeError {
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		return cmd.Error("cannot write %s to %s : %v", what, fileName, err)
+	}
+	log2.Infof("%s written to %s", what, fileName)
+	return nil
+}
@@ -0,0 +1,25 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// Paginator is implemented by every ec2.NewDescribe*Paginator.
+type Paginator[O any] interface {
+	HasMorePages() bool
+	NextPage(ctx context.Context, optFns ...func(*ec2.Options)) (O, error)
+}
+
+// CollectPages reads every page of p and returns the items extracted from each of them.
+func CollectPages[O any, E any](ctx context.Context, p Paginator[O], items func(O) []E) ([]E, error) {
+	var result []E
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, items(out)...)
+	}
+	return result, nil
+}
@@ -0,0 +1,137 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+)
+
+// pagedRegion returns a region with count hosts, whose fake returns describe results one by one.
+func pagedRegion(count int) (*Region2, *awstest.FakeEC2) {
+	fake := fakeRegion(awstest.NewFakeCloud(), "eu-west-1")
+	fake.PageSize = 1
+	r := &Region2{
+		Name:     "eu-west-1",
+		Svc:      fake,
+		Hosts:    map[string]*Host{},
+		ImageMap: map[string]string{},
+	}
+	for index := 0; index < count; index++ {
+		name := fmt.Sprintf("h%d", index)
+		r.Hosts[name] = testHost(name, "eu-west-1")
+	}
+	return r, fake
+}
+
+func TestFillInstancesReadsEveryPage(t *testing.T) {
+	ctx := context.Background()
+	r, fake := pagedRegion(3)
+	for _, name := range r.sortedHostNames() {
+		if _, err := fake.RunInstances(ctx, &ec2.RunInstancesInput{
+			ImageId:           aws.String(testAmi),
+			MinCount:          aws.Int32(1),
+			MaxCount:          aws.Int32(1),
+			TagSpecifications: TagSpecificationsForResource(types.ResourceTypeInstance, name),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.fillInstances(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Instances) != 3 {
+		t.Errorf("got instances of %v, want the 3 hosts", r.Instances)
+	}
+	if got := fake.Calls["DescribeInstances"]; got != 3 {
+		t.Errorf("got %d DescribeInstances calls, want one per page", got)
+	}
+}
+
+func TestFillVolumesReadsEveryPage(t *testing.T) {
+	ctx := context.Background()
+	r, fake := pagedRegion(0)
+	for index := 0; index < 3; index++ {
+		if _, err := fake.CreateVolume(ctx, &ec2.CreateVolumeInput{
+			AvailabilityZone:  aws.String("eu-west-1a"),
+			Size:              aws.Int32(10),
+			TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVolume, fmt.Sprintf("data%d", index)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.fillVolumes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Ec2Volumes) != 3 {
+		t.Errorf("got volumes %v, want 3", r.Ec2Volumes)
+	}
+	if got := fake.Calls["DescribeVolumes"]; got != 3 {
+		t.Errorf("got %d DescribeVolumes calls, want one per page", got)
+	}
+}
+
+func TestFindDefaultEnvSecurityGroupsReadsEveryPage(t *testing.T) {
+	ctx := context.Background()
+	r, fake := pagedRegion(0)
+	var vpcIds []string
+	for _, vpc := range []*types.Vpc{fake.AddVpc("10.0.0.0/16"), fake.AddVpc("10.1.0.0/16")} {
+		vpcIds = append(vpcIds, *vpc.VpcId)
+	}
+	groupIds := map[string]string{}
+	for _, vpcId := range vpcIds {
+		for _, name := range []string{"SSH", "XBEE"} {
+			out, err := fake.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+				GroupName:         aws.String(name),
+				Description:       aws.String(name),
+				VpcId:             aws.String(vpcId),
+				TagSpecifications: TagSpecificationsForResource(types.ResourceTypeSecurityGroup, name),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			groupIds[vpcId+name] = *out.GroupId
+		}
+	}
+
+	if _, _, err := r.findDefaultEnvSecurityGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Calls["DescribeSecurityGroups"]; got != 4 {
+		t.Errorf("got %d DescribeSecurityGroups calls, want the 2 pages of each group", got)
+	}
+
+	r.VpcId = aws.String(vpcIds[1])
+	ssh, xbee, err := r.findDefaultEnvSecurityGroups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh != groupIds[vpcIds[1]+"SSH"] || xbee != groupIds[vpcIds[1]+"XBEE"] {
+		t.Errorf("got groups %s and %s, want the ones of vpc %s", ssh, xbee, vpcIds[1])
+	}
+}
+
+func TestEnsureImagesReadsEveryPage(t *testing.T) {
+	ctx := context.Background()
+	r, fake := pagedRegion(3)
+	for index, name := range r.sortedHostNames() {
+		fake.AddImage(fmt.Sprintf("ami-%017d", index), "/dev/xvda", types.Tag{
+			Key:   aws.String("xbee.id"),
+			Value: aws.String(r.Hosts[name].SystemHash),
+		})
+	}
+	if err := r.ensureImages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for index, name := range r.sortedHostNames() {
+		if got, want := r.ImageMap[r.Hosts[name].SystemHash], fmt.Sprintf("ami-%017d", index); got != want {
+			t.Errorf("got AMI %q for host %s, want %s", got, name, want)
+		}
+	}
+	if got := fake.Calls["DescribeImages"]; got != 3 {
+		t.Errorf("got %d DescribeImages calls, want one per page", got)
+	}
+}
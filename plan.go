@@ -0,0 +1,482 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/constants"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+	"sort"
+)
+
+const (
+	ActionCreate    = "create"
+	ActionStart     = "start"
+	ActionNone      = "none"
+	ActionTerminate = "terminate"
+	ActionDelete    = "delete"
+	ActionModify    = "modify"
+	ActionAttach    = "attach"
+	ActionDetach    = "detach"
+	ActionError     = "error"
+)
+
+type HostPlan struct {
+	Name             string        `json:"name"`
+	Region           string        `json:"region"`
+	Action           string        `json:"action"`
+	State            string        `json:"state"`
+	InstanceId       string        `json:"instanceId,omitempty"`
+	InstanceType     string        `json:"instanceType,omitempty"`
+	Ami              string        `json:"ami,omitempty"`
+	AmiSource        string        `json:"amiSource,omitempty"`
+	AvailabilityZone string        `json:"availabilityZone,omitempty"`
+	SubnetId         string        `json:"subnetId,omitempty"`
+	ElasticIp        string        `json:"elasticIp,omitempty"`
+	Volumes          []*VolumePlan `json:"volumes,omitempty"`
+	Reason           string        `json:"reason,omitempty"`
+}
+
+type VolumePlan struct {
+	Name             string `json:"name"`
+	Action           string `json:"action"`
+	VolumeId         string `json:"volumeId,omitempty"`
+	Size             int    `json:"size,omitempty"`
+	VolumeType       string `json:"volumeType,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	SnapshotId       string `json:"snapshotId,omitempty"`
+	Iops             int    `json:"iops,omitempty"`
+	Throughput       int    `json:"throughput,omitempty"`
+	Encrypted        bool   `json:"encrypted,omitempty"`
+	KmsKeyId         string `json:"kmsKeyId,omitempty"`
+	MountPoint       string `json:"mountPoint,omitempty"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+type SecurityGroupPlan struct {
+	Name    string `json:"name"`
+	Region  string `json:"region"`
+	Action  string `json:"action"`
+	GroupId string `json:"groupId,omitempty"`
+	// inbound rules authorized and revoked
+	Authorize []string `json:"authorize,omitempty"`
+	Revoke    []string `json:"revoke,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+type Plan struct {
+	Operation      string               `json:"operation"`
+	EnvName        string               `json:"envName"`
+	Vpcs           map[string]string    `json:"vpcs"`
+	Hosts          []*HostPlan          `json:"hosts"`
+	SecurityGroups []*SecurityGroupPlan `json:"securityGroups"`
+}
+
+func newPlan(operation string) *Plan {
+	return &Plan{
+		Operation: operation,
+		EnvName:   provider.EnvName(),
+		Vpcs:      map[string]string{},
+	}
+}
+
+// planVpc reports the vpc of the region, the one of its instances when no host is to be created.
+func (r *Region2) planVpc(p *Plan) {
+	switch {
+	case r.Network != nil:
+		p.Vpcs[r.Name] = *r.Network.VpcId + " (managed)"
+	case r.VpcId != nil:
+		p.Vpcs[r.Name] = *r.VpcId
+	default:
+		for _, name := range r.sortedHostNames() {
+			if instance := r.Instances[name]; instance != nil && instance.VpcId != nil {
+				p.Vpcs[r.Name] = *instance.VpcId
+				return
+			}
+		}
+	}
+}
+
+func (r *Region2) planUp(ctx context.Context, p *Plan) {
+	r.planVpc(p)
+	hosts, _ := r.Existing()
+	for name, h := range hosts {
+		instance := r.Instances[name]
+		hp := &HostPlan{
+			Name:         name,
+			Region:       r.Name,
+			State:        xbeeState(string(instance.State.Name)),
+			InstanceId:   *instance.InstanceId,
+			InstanceType: string(instance.InstanceType),
+		}
+		if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+			hp.AvailabilityZone = *instance.Placement.AvailabilityZone
+		}
+		switch instance.State.Name {
+		case "running":
+			hp.Action = ActionNone
+		case "stopped":
+			hp.Action = ActionStart
+		default:
+			hp.Action = ActionError
+			hp.Reason = fmt.Sprintf("instance in %s state, can not be started", instance.State.Name)
+		}
+		if duplicates := r.Duplicates[name]; len(duplicates) > 0 {
+			hp.Action = ActionError
+			hp.Reason = fmt.Sprintf("%d duplicate instances share this name", len(duplicates))
+		}
+		hp.ElasticIp = r.planAddress(h, "to be allocated")
+		hp.Volumes = r.planVolumes(h, hp.AvailabilityZone)
+		p.Hosts = append(p.Hosts, hp)
+		p.SecurityGroups = append(p.SecurityGroups, r.planSecurityGroup(ctx, h))
+	}
+	hosts, volumes := r.NotExisting()
+	if len(hosts) == 0 {
+		return
+	}
+	// the vpc is resolved for hosts to be created only, as up does
+	r = r.Filter(hosts, volumes)
+	vpcErr := r.ensureVpc(ctx)
+	if vpcErr == nil {
+		managed, _ := r.managedNetwork()
+		switch {
+		case r.Network != nil || r.VpcId != nil:
+			r.planVpc(p)
+		case managed:
+			p.Vpcs[r.Name] = "managed vpc to be created"
+		default:
+			p.Vpcs[r.Name] = "default vpc to be created"
+		}
+	}
+	p.SecurityGroups = append(p.SecurityGroups,
+		r.planDefaultSecurityGroup("SSH", r.sshSecurityGroupId, ActionCreate),
+		r.planDefaultSecurityGroup("XBEE", r.xbeeSecurityGroupId, ActionCreate),
+	)
+	for name, h := range hosts {
+		hp := &HostPlan{
+			Name:         name,
+			Region:       r.Name,
+			Action:       ActionCreate,
+			State:        constants.State.NotExisting,
+			InstanceType: h.Specification.InstanceType,
+		}
+		hp.Ami, hp.AmiSource = r.amiFor(h)
+		hp.SubnetId = aws.ToString(r.subnetIdFor(h))
+		if vpcErr != nil {
+			hp.Action = ActionError
+			hp.Reason = vpcErr.Error()
+		} else if placement, err := r.availabilityZoneFor(h); err != nil {
+			hp.Action = ActionError
+			hp.Reason = err.Error()
+		} else if placement != nil {
+			hp.AvailabilityZone = *placement.AvailabilityZone
+		}
+		hp.ElasticIp = r.planAddress(h, "to be allocated")
+		hp.Volumes = r.planVolumes(h, hp.AvailabilityZone)
+		if len(h.Ports) > 0 {
+			p.SecurityGroups = append(p.SecurityGroups, r.planSecurityGroup(ctx, h))
+		}
+		p.Hosts = append(p.Hosts, hp)
+	}
+}
+
+// planSecurityGroup reports the inbound rules reconcileSecurityGroup or createSecurityGroup will authorize and revoke
+// in the group of h.
+func (r *Region2) planSecurityGroup(ctx context.Context, h *Host) *SecurityGroupPlan {
+	sp := &SecurityGroupPlan{
+		Name:   h.Name,
+		Region: r.Name,
+		Action: ActionNone,
+	}
+	changes, err := r.securityGroupChangesFor(ctx, h)
+	if err != nil {
+		sp.Action, sp.Reason = ActionError, err.Error()
+		return sp
+	}
+	sp.GroupId = changes.GroupId
+	sp.Authorize, sp.Revoke = rulesAsStrings(changes.Missing), rulesAsStrings(changes.Stale)
+	switch {
+	case changes.GroupId == "" && len(changes.Missing) > 0:
+		sp.Action = ActionCreate
+	case changes.GroupId != "" && !changes.isEmpty():
+		sp.Action = ActionModify
+	}
+	return sp
+}
+
+// planAddress returns the Elastic IP of h, or missing when it has none yet.
+func (r *Region2) planAddress(h *Host, missing string) string {
+	if a := r.addressFor(h.Name); a != nil {
+		return *a.PublicIp
+	}
+	if h.wantsElasticIp() {
+		return missing
+	}
+	return ""
+}
+
+func (r *Region2) planDefaultSecurityGroup(name string, groupId string, actionIfMissing string) *SecurityGroupPlan {
+	sp := &SecurityGroupPlan{
+		Name:    name,
+		Region:  r.Name,
+		GroupId: groupId,
+		Action:  ActionNone,
+	}
+	if groupId == "" && actionIfMissing == ActionCreate {
+		sp.Action = ActionCreate
+	}
+	if groupId != "" && actionIfMissing == ActionDelete {
+		sp.Action = ActionDelete
+	}
+	return sp
+}
+
+// planVolumes reports, for each volume of h, whether createVolume will create it, modifyVolume modify it or
+// AttachVolumes attach it to the existing instance of h, and the volumes detached from it as it no more declares them.
+// An empty az means the zone will be chosen by AWS when the instance is created.
+func (r *Region2) planVolumes(h *Host, az string) (result []*VolumePlan) {
+	for _, volName := range h.Volumes {
+		vp := &VolumePlan{
+			Name:             volName,
+			AvailabilityZone: az,
+		}
+		if ec2Vol, ok := r.Ec2Volumes[volName]; ok {
+			vp.Action = ActionNone
+			vp.VolumeId = *ec2Vol.VolumeId
+			vp.Size = int(*ec2Vol.Size)
+			vp.VolumeType = string(ec2Vol.VolumeType)
+			vp.Iops, vp.Throughput = int(aws.ToInt32(ec2Vol.Iops)), int(aws.ToInt32(ec2Vol.Throughput))
+			vp.AvailabilityZone = *ec2Vol.AvailabilityZone
+			vp.Encrypted, vp.KmsKeyId = aws.ToBool(ec2Vol.Encrypted), aws.ToString(ec2Vol.KmsKeyId)
+			if vol, ok := r.Volumes[volName]; ok {
+				if in, err := volumeModification(vol, ec2Vol); err != nil {
+					vp.Action, vp.Reason = ActionError, err.Error()
+				} else if in != nil {
+					vp.Action, vp.Reason = ActionModify, describeModification(in, ec2Vol)
+				}
+			}
+			if instance, ok := r.Instances[h.Name]; ok && vp.Action != ActionError {
+				switch attachedTo := attachedInstanceId(ec2Vol); attachedTo {
+				case *instance.InstanceId:
+				case "":
+					vp.Action = ActionAttach
+				default:
+					vp.Action, vp.Reason = ActionError, fmt.Sprintf("attached to instance %s", attachedTo)
+					for name, other := range r.Instances {
+						if *other.InstanceId == attachedTo && containsString(r.undeclaredVolumes(name), volName) {
+							vp.Action, vp.Reason = ActionAttach, fmt.Sprintf("detached from host %s first", name)
+						}
+					}
+				}
+			}
+		} else if vol, ok := r.Volumes[volName]; ok {
+			vp.Action = ActionCreate
+			vp.Size = vol.Size
+			vp.VolumeType = vol.Specification.VolumeType
+			vp.Iops, vp.Throughput = vol.Specification.Iops, vol.Specification.Throughput
+			vp.SnapshotId = vol.Specification.SnapshotId
+			vp.Encrypted, vp.KmsKeyId = vol.encryption(h)
+		} else {
+			vp.Action = ActionError
+		}
+		// the userdata mounts volumes when the instance is created only
+		if vol, ok := r.Volumes[volName]; ok && r.Instances[h.Name] == nil {
+			vp.MountPoint = vol.Specification.MountPoint
+		}
+		result = append(result, vp)
+	}
+	for _, volName := range r.undeclaredVolumes(h.Name) {
+		ec2Vol := r.Ec2Volumes[volName]
+		result = append(result, &VolumePlan{
+			Name:             volName,
+			Action:           ActionDetach,
+			VolumeId:         *ec2Vol.VolumeId,
+			Size:             int(aws.ToInt32(ec2Vol.Size)),
+			VolumeType:       string(ec2Vol.VolumeType),
+			AvailabilityZone: aws.ToString(ec2Vol.AvailabilityZone),
+			Reason:           "no more declared by the host",
+		})
+	}
+	return
+}
+
+func (r *Region2) planDelete(p *Plan) {
+	r.planVpc(p)
+	if r.Network != nil {
+		p.Vpcs[r.Name] += ", deleted once no instance of the env remains"
+	}
+	hosts, _ := r.NotExisting()
+	for name := range hosts {
+		p.Hosts = append(p.Hosts, &HostPlan{
+			Name:      name,
+			Region:    r.Name,
+			Action:    ActionNone,
+			State:     constants.State.NotExisting,
+			ElasticIp: r.planAddress(r.Hosts[name], ""),
+		})
+	}
+	hosts, _ = r.Existing()
+	for name, h := range hosts {
+		instance := r.Instances[name]
+		hp := &HostPlan{
+			Name:         name,
+			Region:       r.Name,
+			Action:       ActionTerminate,
+			State:        xbeeState(string(instance.State.Name)),
+			InstanceId:   *instance.InstanceId,
+			InstanceType: string(instance.InstanceType),
+			ElasticIp:    r.planAddress(h, ""),
+		}
+		if duplicates := r.Duplicates[name]; len(duplicates) > 0 {
+			hp.Reason = fmt.Sprintf("%d duplicate instances terminated too", len(duplicates))
+		}
+		p.Hosts = append(p.Hosts, hp)
+		for _, secGroup := range instance.SecurityGroups {
+			if *secGroup.GroupId != r.sshSecurityGroupId && *secGroup.GroupId != r.xbeeSecurityGroupId {
+				p.SecurityGroups = append(p.SecurityGroups, &SecurityGroupPlan{
+					Name:    name,
+					Region:  r.Name,
+					Action:  ActionDelete,
+					GroupId: *secGroup.GroupId,
+				})
+			}
+		}
+	}
+	p.SecurityGroups = append(p.SecurityGroups,
+		r.planDefaultSecurityGroup("SSH", r.sshSecurityGroupId, ActionDelete),
+		r.planDefaultSecurityGroup("XBEE", r.xbeeSecurityGroupId, ActionDelete),
+	)
+}
+
+func (p *Plan) sort() {
+	sort.Slice(p.Hosts, func(i, j int) bool {
+		if p.Hosts[i].Region != p.Hosts[j].Region {
+			return p.Hosts[i].Region < p.Hosts[j].Region
+		}
+		return p.Hosts[i].Name < p.Hosts[j].Name
+	})
+	sort.SliceStable(p.SecurityGroups, func(i, j int) bool {
+		return p.SecurityGroups[i].Region < p.SecurityGroups[j].Region
+	})
+}
+
+func actionSymbol(action string) string {
+	switch action {
+	case ActionCreate, ActionAttach:
+		return "+"
+	case ActionStart, ActionModify:
+		return "~"
+	case ActionTerminate, ActionDelete, ActionDetach:
+		return "-"
+	case ActionError:
+		return "!"
+	default:
+		return " "
+	}
+}
+
+// Log prints the plan as a human readable diff.
+func (p *Plan) Log() {
+	log2.Infof("plan for %s on env %s:", p.Operation, p.EnvName)
+	for region, vpc := range p.Vpcs {
+		log2.Infof("  region %s, vpc %s", region, vpc)
+	}
+	for _, hp := range p.Hosts {
+		line := fmt.Sprintf("%s host %s (%s) in region %s: %s", actionSymbol(hp.Action), hp.Name, hp.State, hp.Region, hp.Action)
+		if hp.Action == ActionCreate {
+			az := hp.AvailabilityZone
+			if az == "" {
+				az = "chosen by aws"
+			}
+			line += fmt.Sprintf(", type %s, ami %s (from %s), zone %s", hp.InstanceType, hp.Ami, hp.AmiSource, az)
+			if hp.SubnetId != "" {
+				line += fmt.Sprintf(", subnet %s", hp.SubnetId)
+			}
+		}
+		if hp.ElasticIp != "" && p.Operation == "delete" {
+			line += fmt.Sprintf(", elastic ip %s released", hp.ElasticIp)
+		} else if hp.ElasticIp != "" {
+			line += fmt.Sprintf(", elastic ip %s", hp.ElasticIp)
+		}
+		if hp.Reason != "" {
+			line += ", " + hp.Reason
+		}
+		log2.Infof("  %s", line)
+		for _, vp := range hp.Volumes {
+			line := fmt.Sprintf("%s volume %s: %s, %d GiB %s", actionSymbol(vp.Action), vp.Name, vp.Action, vp.Size, vp.VolumeType)
+			if vp.SnapshotId != "" && vp.Action == ActionCreate {
+				line += fmt.Sprintf(", restored from snapshot %s", vp.SnapshotId)
+			}
+			if vp.Iops != 0 {
+				line += fmt.Sprintf(", %d iops", vp.Iops)
+			}
+			if vp.Throughput != 0 {
+				line += fmt.Sprintf(", %d MiB/s", vp.Throughput)
+			}
+			if vp.Encrypted {
+				line += ", encrypted"
+			}
+			if vp.MountPoint != "" {
+				line += fmt.Sprintf(", mounted on %s", vp.MountPoint)
+			}
+			if vp.Reason != "" {
+				line += ", " + vp.Reason
+			}
+			log2.Infof("      %s", line)
+		}
+	}
+	for _, sp := range p.SecurityGroups {
+		if sp.Action != ActionNone {
+			line := fmt.Sprintf("%s security group %s in region %s: %s", actionSymbol(sp.Action), sp.Name, sp.Region, sp.Action)
+			if sp.Reason != "" {
+				line += ", " + sp.Reason
+			}
+			log2.Infof("  %s", line)
+			for _, rule := range sp.Authorize {
+				log2.Infof("      + inbound rule %s", rule)
+			}
+			for _, rule := range sp.Revoke {
+				log2.Infof("      - inbound rule %s", rule)
+			}
+		}
+	}
+}
+
+// Write outputs the plan as JSON to the XBEE_AWS_PLAN_FILE file. Without it, Log is the only view of the plan, the
+// JSON is meant for tools and is kept out of the log.
+func (p *Plan) Write() *cmd.XbeeError {
+	fileName := stringOption(planFileEnv)
+	if fileName == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return cmd.Error("cannot serialize plan : %v", err)
+	}
+	return writeJsonFile(fileName, "plan", data)
+}
+
+func (p *Plan) Output() *cmd.XbeeError {
+	p.sort()
+	p.Log()
+	return p.Write()
+}
+
+func planUp(ctx context.Context, regions map[string]*Region2) *Plan {
+	p := newPlan("up")
+	for _, r := range regions {
+		r.planUp(ctx, p)
+	}
+	return p
+}
+
+func planDelete(regions map[string]*Region2) *Plan {
+	p := newPlan("delete")
+	for _, r := range regions {
+		r.planDelete(p)
+	}
+	return p
+}
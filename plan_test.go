@@ -0,0 +1,86 @@
+package aws
+
+import (
+	"encoding/json"
+	"github.com/iodasolutions/aws/awstest"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mutatingCalls counts the calls of fake which change something.
+func mutatingCalls(fake *awstest.FakeEC2) map[string]int {
+	result := map[string]int{}
+	for op, count := range fake.Calls {
+		if !strings.HasPrefix(op, "Describe") {
+			result[op] = count
+		}
+	}
+	return result
+}
+
+// dryRunPlan runs command in dry run mode and returns the plan it writes.
+func dryRunPlan(t *testing.T, command func() *cmd.XbeeError) *Plan {
+	fileName := filepath.Join(t.TempDir(), "plan.json")
+	t.Setenv(dryRunEnv, "true")
+	t.Setenv(planFileEnv, fileName)
+	if err := command(); err != nil {
+		t.Fatalf("dry run failed : %v", err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Plan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDryRunUpAndDeleteChangeNothing(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1")}, nil)
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1"), testHost("b", "eu-west-1", "data-b")},
+		[]*Volume{testVolume("data-b", "eu-west-1")})
+	before := mutatingCalls(fake)
+
+	p := dryRunPlan(t, func() *cmd.XbeeError {
+		_, err := (Provider{}).Up()
+		return err
+	})
+	if len(p.Hosts) != 2 {
+		t.Fatalf("got plan of hosts %v, want a and b", p.Hosts)
+	}
+	if a := p.Hosts[0]; a.Name != "a" || a.Action != ActionNone {
+		t.Errorf("got %s for host %s, want host a unchanged", a.Action, a.Name)
+	}
+	b := p.Hosts[1]
+	if b.Name != "b" || b.Action != ActionCreate || b.Ami != testAmi {
+		t.Errorf("got %s for host %s with ami %s, want host b created from %s", b.Action, b.Name, b.Ami, testAmi)
+	}
+	if len(b.Volumes) != 1 || b.Volumes[0].Name != "data-b" || b.Volumes[0].Action != ActionCreate {
+		t.Errorf("got volumes %v for host b, want data-b created", b.Volumes)
+	}
+
+	p = dryRunPlan(t, func() *cmd.XbeeError {
+		return (Provider{}).Delete()
+	})
+	if len(p.Hosts) != 2 || p.Hosts[0].Action != ActionTerminate || p.Hosts[1].Action != ActionNone {
+		t.Errorf("got plan of hosts %v, want host a terminated and nothing for host b", p.Hosts)
+	}
+
+	after := mutatingCalls(fake)
+	for op, count := range after {
+		if count != before[op] {
+			t.Errorf("got %d %s calls in dry run, want none", count-before[op], op)
+		}
+	}
+}
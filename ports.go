@@ -0,0 +1,146 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortSpec is a host port opened in its security group. Specs are written
+//
+//	port[-port][/tcp|/udp][@cidr]   e.g. 443, 53/udp, 8000-8100/tcp, 51820/udp@10.0.0.0/8
+//	published:target/tcp|/udp       the published port is opened, e.g. 8080:80/tcp
+//	icmp[@cidr]                     every icmp type
+//
+// tcp is the default protocol. The cidr restricts the sources of the port, as portIngress does.
+// Without a protocol, to:from keeps its former meaning and opens the range from-to, e.g. 8100:8000 opens 8000-8100.
+type PortSpec struct {
+	Spec     string
+	Protocol string
+	From     int32
+	To       int32
+	Cidr     string
+}
+
+func ParsePortSpec(spec string) (*PortSpec, error) {
+	result := &PortSpec{Spec: spec, Protocol: "tcp"}
+	value := strings.TrimSpace(spec)
+	if index := strings.Index(value, "@"); index != -1 {
+		result.Cidr = value[index+1:]
+		value = value[:index]
+		if _, _, err := net.ParseCIDR(result.Cidr); err != nil {
+			return nil, fmt.Errorf("source %s is not a cidr block", result.Cidr)
+		}
+	}
+	if value == "icmp" {
+		result.Protocol = "icmp"
+		result.From, result.To = -1, -1
+		return result, nil
+	}
+	var withProtocol bool
+	if index := strings.Index(value, "/"); index != -1 {
+		withProtocol = true
+		result.Protocol = value[index+1:]
+		value = value[:index]
+		if result.Protocol != "tcp" && result.Protocol != "udp" {
+			return nil, fmt.Errorf("protocol %s is not supported, use tcp, udp or icmp", result.Protocol)
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("a port is expected")
+	}
+	var err error
+	switch {
+	case strings.Contains(value, ":"):
+		index := strings.Index(value, ":")
+		var target int32
+		if result.From, err = parsePort(value[:index]); err != nil {
+			return nil, err
+		}
+		if target, err = parsePort(value[index+1:]); err != nil {
+			return nil, err
+		}
+		result.To = result.From
+		if !withProtocol {
+			if target > result.From {
+				return nil, fmt.Errorf("%s opened ports %d to %d, write %d-%d for a range or %s/tcp to open the published port %d", value, target, result.From, result.From, target, value, result.From)
+			}
+			result.From = target
+		}
+	case strings.Contains(value, "-"):
+		bounds := strings.SplitN(value, "-", 2)
+		if result.From, err = parsePort(bounds[0]); err != nil {
+			return nil, err
+		}
+		if result.To, err = parsePort(bounds[1]); err != nil {
+			return nil, err
+		}
+		if result.From > result.To {
+			return nil, fmt.Errorf("range %s is reversed", value)
+		}
+	default:
+		if result.From, err = parsePort(value); err != nil {
+			return nil, err
+		}
+		result.To = result.From
+	}
+	return result, nil
+}
+
+func parsePort(value string) (int32, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a port number", value)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range 1-65535", port)
+	}
+	return int32(port), nil
+}
+
+func (p *PortSpec) String() string {
+	if p.Protocol == "icmp" {
+		return "icmp"
+	}
+	if p.From == p.To {
+		return fmt.Sprintf("%d/%s", p.From, p.Protocol)
+	}
+	return fmt.Sprintf("%d-%d/%s", p.From, p.To, p.Protocol)
+}
+
+// portSpecs parses the ports of h.
+func (h *Host) portSpecs() ([]*PortSpec, error) {
+	var result []*PortSpec
+	for _, port := range h.Ports {
+		spec, err := ParsePortSpec(port)
+		if err != nil {
+			return nil, fmt.Errorf("host %s : invalid port %q : %v", h.Name, port, err)
+		}
+		result = append(result, spec)
+	}
+	return result, nil
+}
+
+// ingressPermissions returns the inbound rules of the security group of h.
+func (h *Host) ingressPermissions(ctx context.Context) ([]types.IpPermission, error) {
+	var result []types.IpPermission
+	specs, err := h.portSpecs()
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		sources := h.Specification.portIngress(spec.Spec)
+		if spec.Cidr != "" {
+			sources = (&IngressSources{Cidrs: []string{spec.Cidr}}).merge(h.Specification.PortIngress[spec.Spec])
+		}
+		permission, err := sources.permission(ctx, spec.Protocol, spec.From, spec.To)
+		if err != nil {
+			return nil, fmt.Errorf("cannot build inbound rule for port %s of host %s : %v", spec.Spec, h.Name, err)
+		}
+		result = append(result, permission)
+	}
+	return result, nil
+}
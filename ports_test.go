@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"github.com/iodasolutions/xbee-common/provider"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		protocol string
+		from     int32
+		to       int32
+		cidr     string
+	}{
+		{"443", "tcp", 443, 443, ""},
+		{"53/udp", "udp", 53, 53, ""},
+		{"8000-8100/tcp", "tcp", 8000, 8100, ""},
+		{"51820/udp@10.0.0.0/8", "udp", 51820, 51820, "10.0.0.0/8"},
+		{"8080:80/tcp", "tcp", 8080, 8080, ""},
+		{"8100:8000", "tcp", 8000, 8100, ""},
+		{"icmp", "icmp", -1, -1, ""},
+	}
+	for _, test := range tests {
+		spec, err := ParsePortSpec(test.spec)
+		if err != nil {
+			t.Errorf("%s : unexpected error %v", test.spec, err)
+			continue
+		}
+		if spec.Protocol != test.protocol || spec.From != test.from || spec.To != test.to || spec.Cidr != test.cidr {
+			t.Errorf("%s : got %s %d-%d %q, want %s %d-%d %q", test.spec, spec.Protocol, spec.From, spec.To, spec.Cidr, test.protocol, test.from, test.to, test.cidr)
+		}
+	}
+	for _, spec := range []string{"80:8080", "8100-8000", "70000", "80/sctp", "80@10.0.0.1"} {
+		if _, err := ParsePortSpec(spec); err == nil {
+			t.Errorf("%s : an error is expected", spec)
+		}
+	}
+}
+
+func TestPortSpecsReturnsParseError(t *testing.T) {
+	h := &Host{XbeeHost: &provider.XbeeHost{Name: "h", Ports: []string{"80", "80:8080"}}}
+	if _, err := h.portSpecs(); err == nil {
+		t.Error("the invalid port should be reported")
+	}
+}
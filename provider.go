@@ -6,6 +6,7 @@ import (
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
+	"sort"
 	"sync"
 )
 
@@ -13,12 +14,37 @@ type Provider struct {
 }
 
 func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
-	ctx := context.Background()
+	ctx, stop := commandContext()
+	defer stop()
+	j := &journal{}
+	infos, err := pv.up(ctx, j)
+	if ctx.Err() != nil {
+		return nil, j.interrupted("up")
+	}
+	return infos, err
+}
 
-	if regions, err := regionsForHosts(ctx); err != nil {
+func (pv Provider) up(ctx context.Context, j *journal) ([]*provider.InstanceInfo, *cmd.XbeeError) {
+	if regions, failed, err := regionsForHosts(ctx); err != nil {
 		return nil, err
+	} else if dryRun() {
+		if err := planUp(ctx, regions).Output(); err != nil {
+			return nil, err
+		}
+		return instanceInfos(regions), failed.XbeeError()
 	} else {
 		var channels []<-chan *UpInstanceGeneratorResponse
+		var inError bool
+		for _, r := range regions {
+			r.journal = j
+			for _, err := range r.checkVolumeModifications(ctx) {
+				log2.Errorf("%v", err)
+				inError = true
+			}
+		}
+		if inError {
+			return nil, cmd.Error("up command failed, volumes cannot be modified as specified")
+		}
 		for _, r := range regions {
 			hosts, volumes := r.Existing()
 			if len(hosts) > 0 {
@@ -32,6 +58,26 @@ func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 					names = append(names, name)
 				}
 				notExistingRegion := r.Filter(hosts, volumes)
+				// only hosts to be created need a vpc, subnets are chosen in the zone of existing volumes
+				if err := notExistingRegion.ensureVpc(ctx); err != nil {
+					log2.Errorf("unable to create hosts %v : %v", names, err)
+					inError = true
+					continue
+				}
+				if managed, _ := notExistingRegion.managedNetwork(); managed {
+					if err := notExistingRegion.ensureEnvNetwork(ctx); err != nil {
+						log2.Errorf("unexpected error when building the vpc of env %s, unable to create hosts %v : %v", provider.EnvName(), names, err)
+						inError = true
+						continue
+					}
+				}
+				if len(notExistingRegion.Zones) == 0 {
+					if err := notExistingRegion.fillZones(ctx); err != nil {
+						log2.Errorf("unable to create hosts %v : %v", names, err)
+						inError = true
+						continue
+					}
+				}
 				sshCreated, xbeeCreated, err := notExistingRegion.ensureDefaultEnvSecurityGroups(ctx)
 				if err != nil {
 					log2.Infof("unexpected error when calling ensureDefaultEnvSecurityGroups, unable to create hosts %v : %v", names, err)
@@ -50,7 +96,6 @@ func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 		}
 		ch := util.Multiplex(ctx, channels...)
 		var createdAndStarted, created []string
-		var inError bool
 		for upStatus := range ch {
 			if upStatus.InError {
 				inError = true
@@ -71,83 +116,205 @@ func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 			if err := r.waitUntilInstancesAreInState(ctx, "running", filtered...); err != nil {
 				return nil, err
 			}
+			var failedIps []string
+			for _, status := range r.reconcileAddresses(ctx, r.HostNames()...) {
+				if status.InError {
+					failedIps = append(failedIps, status.Host.Name)
+					if util.SetFromStringSlice(created).Contains(status.Host.Name) {
+						r.rollbackHost(ctx, status.Host)
+					}
+				}
+			}
+			if len(failedIps) > 0 {
+				return nil, cmd.Error("cannot associate public ips of hosts %v in region %s", failedIps, r.Name)
+			}
+			var failedVolumes []string
+			for _, status := range r.resizeVolumes(ctx, r.HostNames()...) {
+				if status.InError {
+					failedVolumes = append(failedVolumes, status.Host.Name)
+				}
+			}
+			if len(failedVolumes) > 0 {
+				return nil, cmd.Error("cannot modify volumes of hosts %v in region %s", failedVolumes, r.Name)
+			}
 			rInfos := r.instanceInfos()
 			for _, name := range filtered {
 				infos[name] = rInfos[name]
 			}
 		}
+		// hosts of a region share r.Ec2Volumes, their volumes are attached one host at a time
 		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var failedVolumes []string
 		for _, r := range regions {
-			createdAndStarted = r.FilterByHostInRequest(created)
-			if len(createdAndStarted) > 0 {
-				for _, name := range createdAndStarted {
-					wg.Add(1)
-					go func(r *Region2, name string) {
-						defer wg.Done()
-						if err := r.AttachVolumes(ctx, name); err != nil {
-							log2.Errorf(err.Error())
+			wg.Add(1)
+			go func(r *Region2) {
+				defer wg.Done()
+				// volumes moved to another host in the specification are detached first
+				for _, status := range r.detachUndeclaredVolumes(ctx) {
+					if status.InError {
+						mu.Lock()
+						failedVolumes = append(failedVolumes, status.Host.Name)
+						mu.Unlock()
+					}
+				}
+				for _, name := range r.sortedHostNames() {
+					if err := r.AttachVolumes(ctx, name); err != nil {
+						log2.Errorf(err.Error())
+						if util.SetFromStringSlice(created).Contains(name) {
+							r.rollbackHost(ctx, r.Hosts[name])
 						}
-					}(r, name)
+						mu.Lock()
+						failedVolumes = append(failedVolumes, name)
+						mu.Unlock()
+					}
 				}
-			}
+			}(r)
 		}
 		wg.Wait()
+		if len(failedVolumes) > 0 {
+			return nil, cmd.Error("cannot detach or attach volumes of hosts %v", failedVolumes)
+		}
 		var result []*provider.InstanceInfo
 		for _, info := range infos {
 			result = append(result, info)
 		}
-		return result, nil
+		return result, failed.XbeeError()
 	}
 }
 
 func (pv Provider) Delete() *cmd.XbeeError {
-	ctx := context.Background()
+	ctx, stop := commandContext()
+	defer stop()
 
-	if regions, err := regionsForHosts(ctx); err != nil {
+	if regions, failed, err := regionsForHosts(ctx); err != nil {
 		return err
+	} else if dryRun() {
+		if err := planDelete(regions).Output(); err != nil {
+			return err
+		}
+		return failed.XbeeError()
 	} else {
 		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var failedRegions []string
 		wg.Add(len(regions))
 		for _, r := range regions {
 			go func(r *Region2) {
 				defer wg.Done()
-				r.destroyInstances(ctx)
+				if err := r.destroyInstances(ctx); err != nil {
+					log2.Errorf("%v", err)
+					mu.Lock()
+					failedRegions = append(failedRegions, r.Name)
+					mu.Unlock()
+				}
 			}(r)
 		}
 		wg.Wait()
-		return nil
+		if ctx.Err() != nil {
+			return cmd.Error("delete interrupted, run it again to finish")
+		}
+		if len(failedRegions) > 0 {
+			sort.Strings(failedRegions)
+			return cmd.Error("delete command failed in regions %v, run it again to finish", failedRegions)
+		}
+		return failed.XbeeError()
 	}
 
 }
 
 func (pv Provider) Down() *cmd.XbeeError {
-	//Do nothing for this provider
-	return nil
+	ctx, stop := commandContext()
+	defer stop()
+
+	if regions, failed, err := regionsForHosts(ctx); err != nil {
+		return err
+	} else {
+		var channels []<-chan *DownInstanceGeneratorResponse
+		for _, r := range regions {
+			hosts, volumes := r.NotExisting()
+			for name := range hosts {
+				log2.Infof("instance %s does not exist, nothing to stop", name)
+			}
+			hosts, volumes = r.Existing()
+			if len(hosts) > 0 {
+				existingInRegion := r.Filter(hosts, volumes)
+				channels = append(channels, existingInRegion.StopInstancesGenerator(ctx))
+			}
+		}
+		ch := util.Multiplex(ctx, channels...)
+		var stopped []string
+		var inError bool
+		for downStatus := range ch {
+			if downStatus.InError {
+				inError = true
+			} else if downStatus.InitiallyUp {
+				stopped = append(stopped, downStatus.Name)
+			}
+		}
+		for _, r := range regions {
+			filtered := r.FilterByHostInRequest(stopped)
+			if len(filtered) > 0 {
+				if err := r.waitUntilInstancesAreInState(ctx, "stopped", filtered...); err != nil {
+					return err
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return cmd.Error("down interrupted, run it again to finish")
+		}
+		if inError {
+			return cmd.Error("down command failed for some hosts")
+		}
+		return failed.XbeeError()
+	}
 }
 
+// InstanceInfos returns the state of every host. provider.InstanceInfo, shared by the providers of xbee, has no room
+// for data volumes: their devices are logged here instead, and written as JSON by Admin.VolumeDevices.
 func (pv Provider) InstanceInfos() ([]*provider.InstanceInfo, *cmd.XbeeError) {
-	ctx := context.Background()
-	var result []*provider.InstanceInfo
-	if regions, err := regionsForHosts(ctx); err != nil {
+	ctx, stop := commandContext()
+	defer stop()
+	if regions, failed, err := regionsForHosts(ctx); err != nil {
 		return nil, err
 	} else {
-		for _, r := range regions {
-			for _, info := range r.instanceInfos() {
-				result = append(result, info)
-			}
+		for _, e := range encryptionReport(regions) {
+			e.log()
+		}
+		for _, d := range volumeDevices(regions) {
+			log2.Infof("host %s volume %s is %s, device %s, found as %s", d.Host, d.Volume, d.VolumeId, d.Device, d.DiskById)
+		}
+		return instanceInfos(regions), failed.XbeeError()
+	}
+}
+
+func instanceInfos(regions map[string]*Region2) (result []*provider.InstanceInfo) {
+	for _, r := range regions {
+		for _, info := range r.instanceInfos() {
+			result = append(result, info)
 		}
-		return result, nil
 	}
+	return
 }
 
 func (pv Provider) Image() *cmd.XbeeError {
-	ctx := context.Background()
+	ctx, stop := commandContext()
+	defer stop()
+	j := &journal{}
+	err := pv.image(ctx, j)
+	if ctx.Err() != nil {
+		return j.interrupted("image")
+	}
+	return err
+}
 
-	if regions, err := regionsForHosts(ctx); err != nil {
+func (pv Provider) image(ctx context.Context, j *journal) *cmd.XbeeError {
+	if regions, failed, err := regionsForHosts(ctx); err != nil {
 		return err
 	} else {
 		var channels []<-chan *OperationStatus
 		for _, r := range regions {
+			r.journal = j
 			channels = append(channels, r.PackInstancesGenerator(ctx))
 		}
 		ch := util.Multiplex(ctx, channels...)
@@ -164,6 +331,6 @@ func (pv Provider) Image() *cmd.XbeeError {
 		if inError {
 			return cmd.Error("AWS image creation operation failed")
 		}
-		return nil
+		return failed.XbeeError()
 	}
 }
@@ -0,0 +1,282 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/provider"
+	"testing"
+)
+
+const testAmi = "ami-0123456789abcdef0"
+
+// useFakeCloud runs the commands of the test against cloud, on the given hosts and volumes.
+func useFakeCloud(t *testing.T, cloud *awstest.FakeCloud, hosts []*Host, volumes []*Volume) {
+	newClient, hostsOf, volumesOf := NewEC2Client, envHosts, envVolumes
+	t.Cleanup(func() {
+		NewEC2Client, envHosts, envVolumes = newClient, hostsOf, volumesOf
+	})
+	NewEC2Client = func(ctx context.Context, region string) (EC2API, error) {
+		return cloud.Region(region), nil
+	}
+	envHosts = func() (map[string]map[string]*Host, *cmd.XbeeError) {
+		result := map[string]map[string]*Host{}
+		for _, h := range hosts {
+			if result[h.Specification.Region] == nil {
+				result[h.Specification.Region] = map[string]*Host{}
+			}
+			result[h.Specification.Region][h.Name] = h
+		}
+		return result, nil
+	}
+	envVolumes = func() (map[string]map[string]*Volume, *cmd.XbeeError) {
+		result := map[string]map[string]*Volume{}
+		for _, v := range volumes {
+			if result[v.Specification.Region] == nil {
+				result[v.Specification.Region] = map[string]*Volume{}
+			}
+			result[v.Specification.Region][v.Name] = v
+		}
+		return result, nil
+	}
+	t.Setenv(waitPollEnv, "1ms")
+}
+
+// fakeRegion returns a region of cloud with a default vpc, a subnet and the AMI of test hosts.
+func fakeRegion(cloud *awstest.FakeCloud, name string) *awstest.FakeEC2 {
+	fake := cloud.Region(name)
+	vpc := fake.AddDefaultVpc()
+	fake.AddSubnet(*vpc.VpcId, "a", "172.31.0.0/20")
+	fake.AddImage(testAmi, "/dev/xvda")
+	return fake
+}
+
+func testHost(name string, region string, volumes ...string) *Host {
+	return &Host{
+		XbeeHost: &provider.XbeeHost{
+			Name:         name,
+			User:         "xbee",
+			Volumes:      volumes,
+			SystemHash:   "system-" + name,
+			OsArch:       "linux_amd64",
+			SystemOrigin: &provider.Origin{Repo: "repo", Commit: "commit"},
+		},
+		Specification: &AwsHostData{
+			Region:       region,
+			InstanceType: "t3.micro",
+			Size:         8,
+			Ami:          testAmi,
+		},
+	}
+}
+
+func testVolume(name string, region string) *Volume {
+	return &Volume{
+		XbeeVolume:    &provider.XbeeVolume{Name: name, Size: 10},
+		Specification: &AwsVolumeData{Region: region},
+	}
+}
+
+// instancesOf returns the instances of fake which are not terminated, by host name.
+func instancesOf(fake *awstest.FakeEC2) map[string]*types.Instance {
+	result := map[string]*types.Instance{}
+	for _, i := range fake.Instances {
+		if i.State.Name != types.InstanceStateNameTerminated {
+			result[TagValue(i.Tags, "xbee.name")] = i
+		}
+	}
+	return result
+}
+
+// volumesOf returns the volumes of fake by name.
+func volumesOf(fake *awstest.FakeEC2) map[string]*types.Volume {
+	result := map[string]*types.Volume{}
+	for _, v := range fake.Volumes {
+		if name := TagValue(v.Tags, "xbee.name"); name != "" {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+func TestUpCreatesHostsAndAttachesVolumes(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	fake.PageSize = 1
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a"), testHost("b", "eu-west-1", "data-b")},
+		[]*Volume{testVolume("data-a", "eu-west-1"), testVolume("data-b", "eu-west-1")})
+
+	infos, err := Provider{}.Up()
+	if err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("got %d instance infos, want 2", len(infos))
+	}
+	if got := fake.Calls["RunInstances"]; got != 2 {
+		t.Errorf("got %d RunInstances calls, want 2", got)
+	}
+	instances := instancesOf(fake)
+	volumes := volumesOf(fake)
+	for _, name := range []string{"a", "b"} {
+		i, ok := instances[name]
+		if !ok || i.State.Name != types.InstanceStateNameRunning {
+			t.Errorf("host %s should be running, got %v", name, i)
+			continue
+		}
+		v := volumes["data-"+name]
+		if v == nil || attachedInstanceId(v) != *i.InstanceId {
+			t.Errorf("volume data-%s should be attached to the instance of host %s, got %v", name, name, v)
+		}
+	}
+
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("second up failed : %v", err)
+	}
+	if got := fake.Calls["RunInstances"]; got != 2 {
+		t.Errorf("got %d RunInstances calls, existing hosts should not be created again", got)
+	}
+}
+
+func TestUpRollsBackHostsWhichFailed(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a"), testHost("b", "eu-west-1", "data-b")},
+		[]*Volume{testVolume("data-a", "eu-west-1"), testVolume("data-b", "eu-west-1")})
+	fake.FailNext("RunInstances", awstest.APIError("InvalidParameterValue", "injected"))
+
+	if _, err := (Provider{}).Up(); err == nil {
+		t.Fatal("up should fail when an instance cannot be created")
+	}
+	instances := instancesOf(fake)
+	if len(instances) != 1 {
+		t.Fatalf("got instances %v, want the one of the host which did not fail", instances)
+	}
+	volumes := volumesOf(fake)
+	for _, name := range []string{"a", "b"} {
+		_, created := instances[name]
+		if _, kept := volumes["data-"+name]; kept != created {
+			t.Errorf("volume data-%s should be kept only when host %s is created, got %v", name, name, volumes)
+		}
+	}
+}
+
+func TestDeleteDetachesVolumesBeforeTerminating(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a")},
+		[]*Volume{testVolume("data-a", "eu-west-1")})
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+
+	fake.FailNext("TerminateInstances", awstest.APIError("UnauthorizedOperation", "injected"))
+	if err := (Provider{}).Delete(); err == nil {
+		t.Fatal("delete should fail when instances cannot be terminated")
+	}
+	if got := fake.Calls["DetachVolume"]; got != 1 {
+		t.Errorf("got %d DetachVolume calls, want 1", got)
+	}
+	if v := volumesOf(fake)["data-a"]; v == nil || len(v.Attachments) != 0 {
+		t.Errorf("volume data-a should be detached before the termination, got %v", v)
+	}
+	if _, ok := instancesOf(fake)["a"]; !ok {
+		t.Error("the instance of host a should not be terminated")
+	}
+
+	if err := (Provider{}).Delete(); err != nil {
+		t.Fatalf("delete failed : %v", err)
+	}
+	if instances := instancesOf(fake); len(instances) != 0 {
+		t.Errorf("got instances %v, want none", instances)
+	}
+	if v := volumesOf(fake)["data-a"]; v == nil || v.State != types.VolumeStateAvailable {
+		t.Errorf("volume data-a should be kept available, got %v", v)
+	}
+}
+
+func TestImageCreatesAmiOfEachHost(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1"), testHost("b", "eu-west-1")}, nil)
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+
+	if err := (Provider{}).Image(); err != nil {
+		t.Fatalf("image failed : %v", err)
+	}
+	if got := fake.Calls["CreateImage"]; got != 2 {
+		t.Errorf("got %d CreateImage calls, want 2", got)
+	}
+	available := availableImagesOf(fake)
+	for _, name := range []string{"a", "b"} {
+		if !available["system-"+name] {
+			t.Errorf("the AMI of host %s should be tagged and available, got %v", name, available)
+		}
+	}
+}
+
+func TestImageReportsAmiWhichCannotBeTagged(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1")}, nil)
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+
+	fake.FailNext("CreateTags", awstest.APIError("UnauthorizedOperation", "injected"))
+	if err := (Provider{}).Image(); err == nil {
+		t.Fatal("image should fail when an AMI cannot be tagged")
+	}
+	if available := availableImagesOf(fake); available["system-a"] {
+		t.Error("the AMI of host a should not be found as packed")
+	}
+}
+
+// availableImagesOf returns whether each AMI packed in fake is available, by xbee id.
+func availableImagesOf(fake *awstest.FakeEC2) map[string]bool {
+	result := map[string]bool{}
+	for _, im := range fake.Images {
+		if id := TagValue(im.Tags, "xbee.id"); id != "" {
+			result[id] = im.State == types.ImageStateAvailable
+		}
+	}
+	return result
+}
+
+func TestDestroyVolumes(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	useFakeCloud(t, cloud,
+		[]*Host{testHost("a", "eu-west-1", "data-a", "data-b")},
+		[]*Volume{testVolume("data-a", "eu-west-1"), testVolume("data-b", "eu-west-1")})
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	if err := (Provider{}).Delete(); err != nil {
+		t.Fatalf("delete failed : %v", err)
+	}
+
+	fake.FailNext("DeleteVolume", awstest.APIError("VolumeInUse", "injected"))
+	if err := (Admin{}).DestroyVolumes([]string{"data-a"}); err == nil {
+		t.Fatal("destroy volumes should fail when a volume cannot be deleted")
+	}
+	if _, ok := volumesOf(fake)["data-a"]; !ok {
+		t.Error("volume data-a should be kept when its deletion fails")
+	}
+	if err := (Admin{}).DestroyVolumes([]string{"data-a", "missing"}); err != nil {
+		t.Fatalf("destroy volumes failed : %v", err)
+	}
+	volumes := volumesOf(fake)
+	if _, ok := volumes["data-a"]; ok {
+		t.Error("volume data-a should be destroyed")
+	}
+	if _, ok := volumes["data-b"]; !ok {
+		t.Error("volume data-b should be kept")
+	}
+}
@@ -2,6 +2,7 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -11,16 +12,18 @@ import (
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
-	"strconv"
-	"strings"
-	"time"
+	"sort"
+	"sync"
 )
 
 type Region2 struct {
 	Name     string
-	Svc      *ec2.Client
+	Svc      EC2API
 	VpcId    *string
-	EIps     []types.Address
+	Subnets  map[string]*types.Subnet
+	Network  *EnvNetwork
+	Zones    []string
+	EIps     []*types.Address
 	ImageMap map[string]string
 
 	//attached to server request
@@ -34,6 +37,11 @@ type Region2 struct {
 	//can be rebuilt at any time
 	Instances  map[string]*types.Instance
 	Ec2Volumes map[string]*types.Volume
+	//other non terminated instances sharing the xbee.name of the one kept in Instances
+	Duplicates map[string][]*types.Instance
+
+	//resources created by the running command, nil when not recorded
+	journal *journal
 }
 
 func (r *Region2) Filter(hosts map[string]*Host, volumes map[string]*Volume) *Region2 {
@@ -45,14 +53,19 @@ func (r *Region2) Filter(hosts map[string]*Host, volumes map[string]*Volume) *Re
 		Name:                r.Name,
 		Svc:                 r.Svc,
 		VpcId:               r.VpcId,
+		Subnets:             r.Subnets,
+		Network:             r.Network,
+		Zones:               r.Zones,
 		Volumes:             volumes,
 		Hosts:               hosts,
 		sshSecurityGroupId:  r.sshSecurityGroupId,
 		xbeeSecurityGroupId: r.xbeeSecurityGroupId,
 		Instances:           reducedInstances,
+		Duplicates:          r.Duplicates,
 		Ec2Volumes:          r.Ec2Volumes,
 		EIps:                r.EIps,
 		ImageMap:            r.ImageMap,
+		journal:             r.journal,
 	}
 }
 func (r *Region2) HostNames() (result []string) {
@@ -127,11 +140,16 @@ func (r *Region2) SplitInstancesByStateStoppedFor(names []string) (stopped map[s
 
 func (r *Region2) fillInstances(ctx context.Context) *cmd.XbeeError {
 	r.Instances = make(map[string]*types.Instance)
-	if out, err := r.Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+	r.Duplicates = make(map[string][]*types.Instance)
+	paginator := ec2.NewDescribeInstancesPaginator(r.Svc, &ec2.DescribeInstancesInput{
 		Filters: EnvFilters(),
+	})
+	if reservations, err := CollectPages(ctx, paginator, func(out *ec2.DescribeInstancesOutput) []types.Reservation {
+		return out.Reservations
 	}); err == nil {
-		for _, reservation := range out.Reservations {
-			for _, instance := range reservation.Instances {
+		for _, reservation := range reservations {
+			for index := range reservation.Instances {
+				instance := &reservation.Instances[index]
 				instanceState := instance.State.Name
 				if instanceState != "terminated" { // terminated should be scheduled by aws to be removed.
 					var hostName string
@@ -141,17 +159,15 @@ func (r *Region2) fillInstances(ctx context.Context) *cmd.XbeeError {
 							break
 						}
 					}
-					if aHost, ok := r.Hosts[hostName]; ok {
-						r.Instances[hostName] = &instance
-						if instance.State.Name == "running" && aHost.ExternalIp != "" && instance.PublicIpAddress != nil && *instance.PublicIpAddress != aHost.ExternalIp {
-							if _, err = r.Svc.AssociateAddress(ctx, &ec2.AssociateAddressInput{
-								InstanceId: instance.InstanceId,
-								PublicIp:   aws.String(aHost.ExternalIp),
-							}); err != nil {
-								return cmd.Error("cannot associate ip %s to instance %s: %v", aHost.ExternalIp, *instance.InstanceId, err)
+					if _, ok := r.Hosts[hostName]; ok {
+						if kept, ok := r.Instances[hostName]; ok {
+							if kept.LaunchTime != nil && instance.LaunchTime != nil && instance.LaunchTime.Before(*kept.LaunchTime) {
+								r.Instances[hostName], instance = instance, kept
 							}
-							instance.PublicIpAddress = &aHost.ExternalIp
+							r.Duplicates[hostName] = append(r.Duplicates[hostName], instance)
+							continue
 						}
+						r.Instances[hostName] = instance
 					}
 				}
 			}
@@ -162,19 +178,34 @@ func (r *Region2) fillInstances(ctx context.Context) *cmd.XbeeError {
 	}
 }
 
+// reportDuplicates logs hosts having several instances, the oldest one is kept in r.Instances.
+func (r *Region2) reportDuplicates() {
+	for name, duplicates := range r.Duplicates {
+		var ids []string
+		for _, instance := range duplicates {
+			ids = append(ids, *instance.InstanceId)
+		}
+		log2.Errorf("host %s has several instances in region %s: %s is used, %v are duplicates and will be removed by delete", name, r.Name, *r.Instances[name].InstanceId, ids)
+	}
+}
+
 func (r *Region2) fillVolumes(ctx context.Context) error {
 	result := make(map[string]*types.Volume)
-	out, err := r.Svc.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+	paginator := ec2.NewDescribeVolumesPaginator(r.Svc, &ec2.DescribeVolumesInput{
 		Filters: EnvFilters(),
 	})
+	volumes, err := CollectPages(ctx, paginator, func(out *ec2.DescribeVolumesOutput) []types.Volume {
+		return out.Volumes
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, vol := range out.Volumes {
+	for index := range volumes {
+		vol := &volumes[index]
 		for _, tag := range vol.Tags {
 			if *tag.Key == "xbee.name" {
-				result[*tag.Value] = &vol
+				result[*tag.Value] = vol
 				break
 			}
 		}
@@ -183,6 +214,15 @@ func (r *Region2) fillVolumes(ctx context.Context) error {
 	return nil
 }
 
+// forgetVolume removes the volume id from r.Ec2Volumes once deleted.
+func (r *Region2) forgetVolume(id string) {
+	for name, vol := range r.Ec2Volumes {
+		if aws.ToString(vol.VolumeId) == id {
+			delete(r.Ec2Volumes, name)
+		}
+	}
+}
+
 func (r *Region2) deviceNameForAmi(ctx context.Context, ami string) (*string, error) {
 	imagesOut, err := r.Svc.DescribeImages(ctx, &ec2.DescribeImagesInput{
 		ImageIds: []string{ami},
@@ -190,8 +230,10 @@ func (r *Region2) deviceNameForAmi(ctx context.Context, ami string) (*string, er
 	if err != nil {
 		return nil, fmt.Errorf("cannot get ami Infos for %s : %v", ami, err)
 	}
-	deviceName := imagesOut.Images[0].RootDeviceName
-	return deviceName, nil
+	if len(imagesOut.Images) == 0 {
+		return nil, fmt.Errorf("ami %s does not exist", ami)
+	}
+	return imagesOut.Images[0].RootDeviceName, nil
 }
 
 func (r *Region2) StartInstancesGenerator(ctx context.Context) <-chan *UpInstanceGeneratorResponse {
@@ -211,7 +253,25 @@ func (r *Region2) StartInstancesGenerator(ctx context.Context) <-chan *UpInstanc
 
 func (r *Region2) startInstances(ctx context.Context) (result []*UpInstanceGeneratorResponse) {
 
-	stopped, other := r.SplitInstancesByStateStoppedFor(r.HostNames())
+	var names []string
+	for _, name := range r.HostNames() {
+		if len(r.Duplicates[name]) > 0 {
+			log2.Errorf("host %s has several instances, run delete to clean it", name)
+			result = append(result, &UpInstanceGeneratorResponse{
+				Name:    name,
+				InError: true,
+			})
+		} else if err := r.reconcileSecurityGroup(ctx, r.Hosts[name]); err != nil {
+			log2.Errorf("%v", err)
+			result = append(result, &UpInstanceGeneratorResponse{
+				Name:    name,
+				InError: true,
+			})
+		} else {
+			names = append(names, name)
+		}
+	}
+	stopped, other := r.SplitInstancesByStateStoppedFor(names)
 	if len(other) > 0 {
 		for name := range other {
 			instance := other[name]
@@ -263,7 +323,88 @@ func (r *Region2) startInstances(ctx context.Context) (result []*UpInstanceGener
 	return
 }
 
-func (r *Region2) destroyInstances(ctx context.Context) {
+func (r *Region2) StopInstancesGenerator(ctx context.Context) <-chan *DownInstanceGeneratorResponse {
+	ch := make(chan *DownInstanceGeneratorResponse)
+	go func() {
+		defer close(ch)
+		for _, elt := range r.stopInstances(ctx) {
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- elt:
+			}
+		}
+	}()
+	return ch
+}
+
+// stopInstances stops the instances of the hosts, their duplicates too so that none is left running.
+func (r *Region2) stopInstances(ctx context.Context) (result []*DownInstanceGeneratorResponse) {
+	var names []string
+	var instanceIds []string
+	for _, name := range r.HostNames() {
+		for _, duplicate := range r.Duplicates[name] {
+			switch duplicate.State.Name {
+			case "running", "pending":
+				log2.Warnf("stopping instance %s, a duplicate of host %s, run delete to clean it", *duplicate.InstanceId, name)
+				instanceIds = append(instanceIds, *duplicate.InstanceId)
+			}
+		}
+		instance := r.Instances[name]
+		status := instance.State.Name
+		switch status {
+		case "running", "pending":
+			names = append(names, name)
+			instanceIds = append(instanceIds, *instance.InstanceId)
+		case "stopped":
+			log2.Infof("instance %s already in stopped state", name)
+			result = append(result, &DownInstanceGeneratorResponse{
+				Name:          name,
+				InitiallyDown: true,
+			})
+		case "stopping":
+			log2.Infof("instance %s already stopping", name)
+			result = append(result, &DownInstanceGeneratorResponse{
+				Name:        name,
+				InitiallyUp: true,
+			})
+		default:
+			log2.Infof("instance %s in %s state, can not be stopped", name, status)
+			result = append(result, &DownInstanceGeneratorResponse{
+				Name:    name,
+				InError: true,
+			})
+		}
+	}
+	if len(instanceIds) > 0 {
+		_, err := r.Svc.StopInstances(ctx, &ec2.StopInstancesInput{
+			InstanceIds: instanceIds,
+		})
+		if err == nil {
+			log2.Infof("successfully called stop on aws instances %v", names)
+			for _, name := range names {
+				result = append(result, &DownInstanceGeneratorResponse{
+					Name:        name,
+					InitiallyUp: true,
+				})
+			}
+		} else {
+			log2.Errorf("cannot stop aws instances %v for region %s : %v", names, r.Name, err)
+			for _, name := range names {
+				result = append(result, &DownInstanceGeneratorResponse{
+					Name:    name,
+					InError: true,
+				})
+			}
+		}
+	}
+	return
+}
+
+// destroyInstances terminates the instances of the region and deletes what the env no longer uses. It goes as far
+// as it can and returns every failure.
+func (r *Region2) destroyInstances(ctx context.Context) error {
+	var errs []error
 	notExisting, _ := r.NotExisting()
 	if len(notExisting) > 0 {
 		var names []string
@@ -271,6 +412,9 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 			names = append(names, name)
 		}
 		log2.Infof("instance %v already terminated or do not exist", names)
+		if err := r.releaseAddresses(ctx, names...); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	existing, _ := r.Existing()
 	if len(existing) > 0 {
@@ -280,6 +424,17 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 		for name := range existing {
 			names = append(names, name)
 			instanceIds = append(instanceIds, *r.Instances[name].InstanceId)
+			for _, duplicate := range r.Duplicates[name] {
+				instanceIds = append(instanceIds, *duplicate.InstanceId)
+			}
+		}
+		// data volumes are detached before the termination, so that they are ready for another host as soon as the
+		// command returns
+		dataVolumes := r.dataVolumesOf(instanceIds)
+		for _, volName := range dataVolumes {
+			if err := r.detachVolume(ctx, volName); err != nil {
+				errs = append(errs, err)
+			}
 		}
 		_, err := r.Svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
 			InstanceIds: instanceIds,
@@ -287,14 +442,20 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 		if err == nil {
 			log2.Infof("successfully called terminate for instances %v in region %s", names, r.Name)
 		} else {
-			log2.Errorf("cannot terminate aws instances %v for region %s : %v", names, r.Name, err)
-			return
+			return errors.Join(append(errs, fmt.Errorf("cannot terminate aws instances %v for region %s : %v", names, r.Name, err))...)
 		}
 		log2.Infof("transitioning instances from shutting-down to terminated, for %v, wait...", names)
-		err2 := r.waitUntilInstancesAreInState(ctx, "terminated", names...)
-		if err2 != nil {
-			log2.Errorf(err.Error())
-			return
+		if err := r.waitUntilInstancesAreInState(ctx, "terminated", names...); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		// a volume which failed to detach is detached by the termination
+		if err := r.waitForAvailableVolumes(ctx, dataVolumes...); err != nil {
+			errs = append(errs, err)
+		} else if len(dataVolumes) > 0 {
+			log2.Infof("volumes %v of hosts %v are detached", dataVolumes, names)
+		}
+		if err := r.releaseAddresses(ctx, names...); err != nil {
+			errs = append(errs, err)
 		}
 		for name := range existing {
 			instance := instances[name]
@@ -306,7 +467,7 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 					if err == nil {
 						log2.Infof("successfully deleted security group for %s", name)
 					} else {
-						log2.Errorf("could not delete security group for %s : %v", name, err)
+						errs = append(errs, fmt.Errorf("could not delete security group for %s : %v", name, err))
 					}
 				}
 			}
@@ -317,18 +478,17 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 		if err == nil {
 			log2.Infof("successfully deleted xbee tags for %s", names)
 		} else {
-			log2.Errorf("could not delete xbee tags for %s : %v", names, err)
+			errs = append(errs, fmt.Errorf("could not delete xbee tags for %s : %v", names, err))
 		}
 
-		err = r.deleteDefaultSecurityGroupsForEnvIfPossible(ctx)
-		if err != nil {
-			log2.Errorf("%v", err)
+		if err := r.deleteDefaultSecurityGroupsForEnvIfPossible(ctx); err != nil {
+			errs = append(errs, err)
 		}
 	} else {
 		if r.xbeeSecurityGroupId != "" || r.sshSecurityGroupId != "" {
 			err := r.deleteDefaultSecurityGroupsForEnvIfPossible(ctx)
 			if err != nil {
-				log2.Errorf("%v", err)
+				errs = append(errs, err)
 			} else {
 				envName := provider.EnvName()
 				if r.xbeeSecurityGroupId != "" {
@@ -340,7 +500,11 @@ func (r *Region2) destroyInstances(ctx context.Context) {
 			}
 		}
 	}
-
+	// the vpc cannot be deleted while security groups remain in it, its deletion then fails and is reported too
+	if err := r.deleteEnvNetworkIfPossible(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
 
 func (r *Region2) deleteDefaultSecurityGroupsForEnvIfPossible(ctx context.Context) (err error) {
@@ -395,26 +559,6 @@ func (r *Region2) deleteDefaultSecurityGroupsForEnv(ctx context.Context) error {
 	return nil
 }
 
-func (r *Region2) waitUntilInstancesAreInState(ctx context.Context, state types.InstanceStateName, names ...string) *cmd.XbeeError {
-
-	for {
-		select {
-		case <-ctx.Done():
-			return cmd.Error("an error occured while putting %v for region %s to %s: %v", names, r.Name, state, ctx.Err())
-		case <-time.After(500 * time.Millisecond):
-			err := r.fillInstances(ctx)
-			if err != nil {
-				return err
-			}
-			ok := r.areInstancesInState(state, names...)
-			if ok {
-				log2.Infof("aws instances are now %s", state)
-				return nil
-			}
-		}
-	}
-}
-
 func (r *Region2) areInstancesInState(state types.InstanceStateName, names ...string) bool {
 	for _, name := range names {
 		if instance, ok := r.Instances[name]; ok {
@@ -430,7 +574,70 @@ func (r *Region2) areInstancesInState(state types.InstanceStateName, names ...st
 	}
 	return true
 }
+
+// ensureVpc resolves the vpc of the region and the subnet of each host. All hosts of a region share one vpc,
+// the default one unless hosts specify a vpc or a subnet.
 func (r *Region2) ensureVpc(ctx context.Context) error {
+	r.Subnets = map[string]*types.Subnet{}
+	if managed, err := r.managedNetwork(); err != nil {
+		return err
+	} else if managed {
+		return r.placeInEnvNetwork(ctx)
+	}
+	var vpcId string
+	var vpcHost string
+	var createDefaultVpc bool
+	for _, name := range r.sortedHostNames() {
+		spec := r.Hosts[name].Specification
+		createDefaultVpc = createDefaultVpc || spec.CreateDefaultVpc
+		if spec.VpcId != "" {
+			if vpcId != "" && vpcId != spec.VpcId {
+				return fmt.Errorf("hosts %s and %s use vpcs %s and %s, hosts of a region must share one vpc", vpcHost, name, vpcId, spec.VpcId)
+			}
+			vpcId, vpcHost = spec.VpcId, name
+		}
+	}
+	for _, name := range r.sortedHostNames() {
+		h := r.Hosts[name]
+		if h.Specification.SubnetId == "" && len(h.Specification.SubnetTags) == 0 {
+			continue
+		}
+		subnet, err := r.findSubnet(ctx, h, vpcId)
+		if err != nil {
+			return err
+		}
+		if vpcId != "" && vpcId != *subnet.VpcId {
+			return fmt.Errorf("subnet %s of host %s is in vpc %s, but vpc %s is used by host %s", *subnet.SubnetId, name, *subnet.VpcId, vpcId, vpcHost)
+		}
+		vpcId, vpcHost = *subnet.VpcId, name
+		r.Subnets[name] = subnet
+	}
+	if vpcId != "" {
+		vpcs, err := CollectPages(ctx, ec2.NewDescribeVpcsPaginator(r.Svc, &ec2.DescribeVpcsInput{
+			VpcIds: []string{vpcId},
+		}), func(out *ec2.DescribeVpcsOutput) []types.Vpc {
+			return out.Vpcs
+		})
+		if err != nil {
+			return fmt.Errorf("cannot find vpc %s of host %s : %v", vpcId, vpcHost, err)
+		}
+		if len(vpcs) == 0 {
+			return fmt.Errorf("vpc %s of host %s does not exist in region %s", vpcId, vpcHost, r.Name)
+		}
+		r.VpcId = vpcs[0].VpcId
+		if !aws.ToBool(vpcs[0].IsDefault) {
+			for _, name := range r.sortedHostNames() {
+				if _, ok := r.Subnets[name]; !ok {
+					subnet, err := r.findSubnet(ctx, r.Hosts[name], vpcId)
+					if err != nil {
+						return err
+					}
+					r.Subnets[name] = subnet
+				}
+			}
+		}
+		return nil
+	}
 	input := &ec2.DescribeVpcsInput{
 		Filters: []types.Filter{
 			{
@@ -439,48 +646,171 @@ func (r *Region2) ensureVpc(ctx context.Context) error {
 			},
 		},
 	}
-	if out, err := r.Svc.DescribeVpcs(ctx, input); err != nil {
+	if vpcs, err := CollectPages(ctx, ec2.NewDescribeVpcsPaginator(r.Svc, input), func(out *ec2.DescribeVpcsOutput) []types.Vpc {
+		return out.Vpcs
+	}); err != nil {
 		return err
 	} else {
-		if len(out.Vpcs) == 0 {
+		if len(vpcs) == 0 {
+			if !createDefaultVpc {
+				return fmt.Errorf("no default vpc in region %s, set vpcId or subnetId for its hosts, or createDefaultVpc to create it", r.Name)
+			}
+			if dryRun() {
+				return nil
+			}
 			if out, err := r.Svc.CreateDefaultVpc(ctx, &ec2.CreateDefaultVpcInput{}); err != nil {
 				return err
 			} else {
+				log2.Infof("created default vpc %s in region %s", *out.Vpc.VpcId, r.Name)
 				r.VpcId = out.Vpc.VpcId
 			}
 
 		} else {
-			r.VpcId = out.Vpcs[0].VpcId
+			r.VpcId = vpcs[0].VpcId
+		}
+	}
+	return nil
+}
+
+func (r *Region2) sortedHostNames() []string {
+	names := r.HostNames()
+	sort.Strings(names)
+	return names
+}
+
+// findSubnet returns the subnet given by the specification of h, or the subnet of the vpc when h gives none.
+// When several subnets match, the one in the zone of h is chosen, h must then have a zone, given by its
+// availabilityZone or by its existing volumes.
+func (r *Region2) findSubnet(ctx context.Context, h *Host, vpcId string) (*types.Subnet, error) {
+	spec := h.Specification
+	input := &ec2.DescribeSubnetsInput{}
+	if spec.SubnetId != "" {
+		input.SubnetIds = []string{spec.SubnetId}
+	}
+	for key, value := range spec.SubnetTags {
+		input.Filters = append(input.Filters, types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{value},
+		})
+	}
+	if vpcId != "" {
+		input.Filters = append(input.Filters, types.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []string{vpcId},
+		})
+	}
+	subnets, err := CollectPages(ctx, ec2.NewDescribeSubnetsPaginator(r.Svc, input), func(out *ec2.DescribeSubnetsOutput) []types.Subnet {
+		return out.Subnets
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot find subnet for host %s in region %s : %v", h.Name, r.Name, err)
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("no subnet found for host %s in region %s", h.Name, r.Name)
+	}
+	sort.Slice(subnets, func(i, j int) bool {
+		return *subnets[i].SubnetId < *subnets[j].SubnetId
+	})
+	if len(subnets) == 1 {
+		return &subnets[0], nil
+	}
+	if placement, err := r.availabilityZoneFor(h); err == nil && placement != nil {
+		for index := range subnets {
+			if *subnets[index].AvailabilityZone == *placement.AvailabilityZone {
+				return &subnets[index], nil
+			}
+		}
+		return nil, fmt.Errorf("no subnet found for host %s in zone %s", h.Name, *placement.AvailabilityZone)
+	}
+	if len(spec.SubnetTags) > 0 {
+		var ids []string
+		for _, subnet := range subnets {
+			ids = append(ids, *subnet.SubnetId)
 		}
+		return nil, fmt.Errorf("subnet tags of host %s match several subnets %v, set its availabilityZone", h.Name, ids)
+	}
+	var ids []string
+	for _, subnet := range subnets {
+		ids = append(ids, *subnet.SubnetId)
+	}
+	return nil, fmt.Errorf("vpc %s of host %s has several subnets %v, set its subnetId, subnetTags or availabilityZone", vpcId, h.Name, ids)
+}
+
+func (r *Region2) subnetIdFor(h *Host) *string {
+	if subnet, ok := r.Subnets[h.Name]; ok {
+		return subnet.SubnetId
 	}
 	return nil
 }
 
+// CreateInstancesGenerator creates the instances of the hosts of the region. As hosts share r.Ec2Volumes, their
+// volumes are created one host at a time first, instances are then created in parallel, and the hosts which failed are
+// rolled back one at a time, a rollback updating r.Ec2Volumes and r.EIps too.
 func (r *Region2) CreateInstancesGenerator(ctx context.Context) <-chan *UpInstanceGeneratorResponse {
-	var channels []<-chan *UpInstanceGeneratorResponse
-	for _, h := range r.Hosts {
-		ch := make(chan *UpInstanceGeneratorResponse)
-		channels = append(channels, ch)
-		go func(h *Host) {
-			defer close(ch)
-			if err := r.createOneInstance(ctx, h); err != nil {
-				log2.Errorf(err.Error())
-				ch <- &UpInstanceGeneratorResponse{
-					Name:    h.Name,
+	ch := make(chan *UpInstanceGeneratorResponse)
+	go func() {
+		defer close(ch)
+		names := r.sortedHostNames()
+		errs := make([]error, len(names))
+		placements := make([]*types.Placement, len(names))
+		for index, name := range names {
+			placements[index], errs[index] = r.createVolumesOfHost(ctx, r.Hosts[name])
+		}
+		var wg sync.WaitGroup
+		for index, name := range names {
+			if errs[index] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(index int, h *Host) {
+				defer wg.Done()
+				errs[index] = r.createOneInstance(ctx, h, placements[index])
+			}(index, r.Hosts[name])
+		}
+		wg.Wait()
+		for index, name := range names {
+			resp := &UpInstanceGeneratorResponse{
+				Name:                 name,
+				InitiallyNotExisting: true,
+			}
+			if errs[index] != nil {
+				log2.Errorf(errs[index].Error())
+				r.rollbackHost(ctx, r.Hosts[name])
+				resp = &UpInstanceGeneratorResponse{
+					Name:    name,
 					InError: true,
 				}
-			} else {
-				ch <- &UpInstanceGeneratorResponse{
-					Name:                 h.Name,
-					InitiallyNotExisting: true,
-				}
 			}
-		}(h)
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- resp:
+			}
+		}
+	}()
+	return ch
+}
+
+// createVolumesOfHost creates the missing volumes of h and assigns their devices, it returns the placement of the
+// instance of h.
+func (r *Region2) createVolumesOfHost(ctx context.Context, h *Host) (*types.Placement, error) {
+	placement, err := r.availabilityZoneFor(h)
+	if err != nil {
+		return nil, err
 	}
-	return util.Multiplex(ctx, channels...)
+	amiToUse, _ := r.amiFor(h)
+	// volumes are created first, so that the userdata knows their ids
+	if placement, err = r.createVolumesOf(ctx, h, placement); err != nil {
+		return nil, err
+	}
+	if err := r.assignDevices(ctx, h, amiToUse); err != nil {
+		return nil, err
+	}
+	return placement, nil
 }
 
-func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
+// createOneInstance creates the instance of h once its volumes are created, it does not change r.Ec2Volumes.
+func (r *Region2) createOneInstance(ctx context.Context, h *Host, placement *types.Placement) error {
 	secGroupIds := []string{r.sshSecurityGroupId, r.xbeeSecurityGroupId}
 	if len(h.Ports) > 0 {
 		secGroupId, err := r.createSecurityGroup(ctx, h)
@@ -489,36 +819,18 @@ func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
 		}
 		secGroupIds = append(secGroupIds, *secGroupId)
 	}
-	deviceName, err := r.deviceNameForAmi(ctx, h.Specification.Ami)
-	if err != nil {
-		return err
-	}
-	placement, err := r.availabilityZoneFor(h)
+	amiToUse, _ := r.amiFor(h)
+	deviceName, err := r.deviceNameForAmi(ctx, amiToUse)
 	if err != nil {
 		return err
 	}
 	tags := TagsForResource(h.Name)
-	userData, err := UserDataBase64(h.User)
+	userData, err := UserDataBase64(h, r.mountedVolumes(h))
 	if err != nil {
 		return err
 	}
 
-	var amiToUse string
-	if h.PackOrigin != nil {
-		if builtAmi, ok := r.ImageMap[h.PackHash]; ok {
-			amiToUse = builtAmi
-		}
-	}
-	if amiToUse == "" {
-		if builtAmi, ok := r.ImageMap[h.SystemHash]; ok {
-			amiToUse = builtAmi
-		}
-	}
-	if amiToUse == "" {
-		amiToUse = h.Specification.Ami
-	}
-
-	out, err := r.Svc.RunInstances(ctx, &ec2.RunInstancesInput{
+	instance, err := r.runInstance(ctx, h.Name, &ec2.RunInstancesInput{
 		Placement: placement,
 		BlockDeviceMappings: []types.BlockDeviceMapping{
 			{
@@ -526,6 +838,11 @@ func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
 				Ebs: &types.EbsBlockDevice{
 					VolumeSize:          aws.Int32(int32(h.Specification.Size)),
 					DeleteOnTermination: aws.Bool(true),
+					VolumeType:          types.VolumeType(h.Specification.RootVolumeType),
+					Iops:                optionalInt32(h.Specification.RootIops),
+					Throughput:          optionalInt32(h.Specification.RootThroughput),
+					Encrypted:           encryptedFlag(h.Specification.Encrypted),
+					KmsKeyId:            kmsKeyId(h.Specification.Encrypted, h.Specification.KmsKeyId),
 				},
 			},
 		},
@@ -535,6 +852,7 @@ func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
 		MinCount:         aws.Int32(1),
 		MaxCount:         aws.Int32(1),
 		SecurityGroupIds: secGroupIds,
+		SubnetId:         r.subnetIdFor(h),
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
@@ -550,14 +868,7 @@ func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
 	if err != nil {
 		return fmt.Errorf("cannot create aws instance for %s : %v", h.Name, err)
 	}
-	az := out.Instances[0].Placement.AvailabilityZone
-	for _, volName := range h.Volumes {
-		if !r.HasVolume(volName) {
-			if err := r.createVolume(ctx, volName, az); err != nil {
-				return err
-			}
-		}
-	}
+	r.journal.record(r, resourceInstance, *instance.InstanceId, h.Name)
 	//publicIp := *out.Instances[0].PublicIpAddress
 	//if publicIp != h.ExternalIp {
 	//	if _, err = r.Svc.AssociateAddress(ctx, &ec2.AssociateAddressInput{
@@ -570,16 +881,37 @@ func (r *Region2) createOneInstance(ctx context.Context, h *Host) error {
 	return nil
 }
 
+// amiFor returns the AMI used to create the instance for h, and whether it comes from the pack, the system or the host specification.
+func (r *Region2) amiFor(h *Host) (string, string) {
+	if h.PackOrigin != nil {
+		if builtAmi, ok := r.ImageMap[h.PackHash]; ok {
+			return builtAmi, "pack"
+		}
+	}
+	if builtAmi, ok := r.ImageMap[h.SystemHash]; ok {
+		return builtAmi, "system"
+	}
+	return h.Specification.Ami, "specification"
+}
+
+// createSecurityGroup creates the security group of host in the vpc of its instance, or in the vpc of the region
+// when the host is to be created.
 func (r *Region2) createSecurityGroup(ctx context.Context, host *Host) (*string, error) {
 	var secGroupId *string
+	vpcId := r.VpcId
+	if instance := r.Instances[host.Name]; instance != nil && instance.VpcId != nil {
+		vpcId = instance.VpcId
+	}
 	if res, err := r.Svc.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
-		VpcId:       r.VpcId,
+		VpcId:       vpcId,
 		Description: aws.String("created by aws provider for XBEE"),
 		GroupName:   aws.String(host.Name),
 	}); err != nil {
 		return nil, fmt.Errorf("cannot create security group for host %s in region %s : %v", host.Name, r.Name, err)
 	} else {
 		secGroupId = res.GroupId
+		r.journal.record(r, resourceSecurityGroup, *secGroupId, host.Name)
+		ctx = afterCreate(ctx)
 		tags := TagsForResource(host.Name)
 		if _, err := r.Svc.CreateTags(ctx, &ec2.CreateTagsInput{
 			Tags:      tags,
@@ -588,33 +920,9 @@ func (r *Region2) createSecurityGroup(ctx context.Context, host *Host) (*string,
 			return nil, fmt.Errorf("cannot tag security group for host %s in region %s : %v", host.Name, r.Name, err)
 		}
 	}
-	var fromPorts []int64
-	var toPorts []int64
-	for _, portMapping := range host.Ports {
-		index := strings.Index(portMapping, ":")
-		var fromPort, toPort int
-		if index != -1 {
-			toPort, _ = strconv.Atoi(portMapping[:index])     //format error should not occur at this stage
-			fromPort, _ = strconv.Atoi(portMapping[index+1:]) //format error should not occur at this stage
-		} else {
-			fromPort, _ = strconv.Atoi(portMapping) //format error should not occur at this stage
-			toPort = fromPort
-		}
-		fromPorts = append(fromPorts, int64(fromPort))
-		toPorts = append(toPorts, int64(toPort))
-	}
-	var ipPermissions []types.IpPermission
-	for index, port := range fromPorts {
-		ipPermissions = append(ipPermissions,
-			types.IpPermission{
-				IpProtocol: aws.String("tcp"),
-				FromPort:   aws.Int32(int32(port)),
-				ToPort:     aws.Int32(int32(toPorts[index])),
-				IpRanges: []types.IpRange{
-					{CidrIp: aws.String("0.0.0.0/0")},
-				},
-			})
-
+	ipPermissions, err := host.ingressPermissions(ctx)
+	if err != nil {
+		return nil, err
 	}
 	if _, err := r.Svc.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId:       secGroupId,
@@ -626,34 +934,55 @@ func (r *Region2) createSecurityGroup(ctx context.Context, host *Host) (*string,
 	return secGroupId, nil
 }
 
+// findDefaultEnvSecurityGroups looks for the SSH and XBEE groups of the env, in the vpc of the region once it is known.
 func (r *Region2) findDefaultEnvSecurityGroups(ctx context.Context) (string, string, error) {
 	var sshSecurityGroupId, xbeeSecurityGroupId string
 	envName := provider.EnvName()
-	out, err := r.Svc.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
-		Filters: EnvFiltersForResource("SSH"),
-	})
+	inVpc := func(filters []types.Filter) []types.Filter {
+		if r.VpcId == nil {
+			return filters
+		}
+		return append(filters, types.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []string{*r.VpcId},
+		})
+	}
+	groups, err := r.describeSecurityGroups(ctx, inVpc(EnvFiltersForResource("SSH")))
 	if err != nil {
 		return "", "", fmt.Errorf("unexpected error when looking for existing SSH security group for env %s in region %s : %v", envName, r.Name, err)
 	}
-	if len(out.SecurityGroups) > 0 {
-		sshSecurityGroupId = *out.SecurityGroups[0].GroupId
+	if len(groups) > 0 {
+		sshSecurityGroupId = *groups[0].GroupId
 	}
-	out, err = r.Svc.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
-		Filters: EnvFiltersForResource("XBEE"),
-	})
+	groups, err = r.describeSecurityGroups(ctx, inVpc(EnvFiltersForResource("XBEE")))
 	if err != nil {
 		return "", "", fmt.Errorf("unexpected error when looking for existing XBEE security group for env %s in region %s : %v", envName, r.Name, err)
 	}
-	if len(out.SecurityGroups) > 0 {
-		xbeeSecurityGroupId = *out.SecurityGroups[0].GroupId
+	if len(groups) > 0 {
+		xbeeSecurityGroupId = *groups[0].GroupId
 	}
 	return sshSecurityGroupId, xbeeSecurityGroupId, nil
 }
 
+func (r *Region2) describeSecurityGroups(ctx context.Context, filters []types.Filter) ([]types.SecurityGroup, error) {
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(r.Svc, &ec2.DescribeSecurityGroupsInput{
+		Filters: filters,
+	})
+	return CollectPages(ctx, paginator, func(out *ec2.DescribeSecurityGroupsOutput) []types.SecurityGroup {
+		return out.SecurityGroups
+	})
+}
+
 // port 22, 9801 and self security group
 func (r *Region2) ensureDefaultEnvSecurityGroups(ctx context.Context) (bool, bool, error) {
 	var sshCreated, xbeeCreated bool
 	var err error
+	if r.VpcId != nil {
+		// groups found before the vpc was resolved may belong to another vpc
+		if r.sshSecurityGroupId, r.xbeeSecurityGroupId, err = r.findDefaultEnvSecurityGroups(ctx); err != nil {
+			return false, false, err
+		}
+	}
 	if r.sshSecurityGroupId == "" {
 		r.sshSecurityGroupId, err = r.createSSHSecurityGroup(ctx)
 		if err != nil {
@@ -684,6 +1013,8 @@ func (r *Region2) createSSHSecurityGroup(ctx context.Context) (string, error) {
 		return "", fmt.Errorf("cannot create security group for env %s in region %s : %v", envName, r.Name, err)
 	} else {
 		secGroupId = *res.GroupId
+		r.journal.record(r, resourceSecurityGroup, secGroupId, "SSH")
+		ctx = afterCreate(ctx)
 		tags := TagsForResource("SSH")
 		if _, err := r.Svc.CreateTags(ctx, &ec2.CreateTagsInput{
 			Tags:      tags,
@@ -692,20 +1023,11 @@ func (r *Region2) createSSHSecurityGroup(ctx context.Context) (string, error) {
 			return "", fmt.Errorf("cannot tag security group SSH for env %s in region %s : %v", envName, r.Name, err)
 		}
 	}
-	fromPorts := []int64{22}
-	toPorts := []int64{22}
-	var ipPermissions []types.IpPermission
-	for index, port := range fromPorts {
-		ipPermissions = append(ipPermissions,
-			types.IpPermission{
-				IpProtocol: aws.String("tcp"),
-				FromPort:   aws.Int32(int32(port)),
-				ToPort:     aws.Int32(int32(toPorts[index])),
-				IpRanges: []types.IpRange{
-					{CidrIp: aws.String("0.0.0.0/0")},
-				},
-			})
+	permission, err := r.sshIngress().permission(ctx, "tcp", 22, 22)
+	if err != nil {
+		return "", fmt.Errorf("cannot build inbound rules for SSH security group for env %s : %v", envName, err)
 	}
+	ipPermissions := []types.IpPermission{permission}
 	if _, err := r.Svc.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId:       &secGroupId,
 		IpPermissions: ipPermissions,
@@ -726,6 +1048,8 @@ func (r *Region2) createXbeeSecurityGroup(ctx context.Context) (string, error) {
 		return "", fmt.Errorf("cannot create xbee security group for env %s in region %s : %v", envName, r.Name, err)
 	} else {
 		secGroupId = *res.GroupId
+		r.journal.record(r, resourceSecurityGroup, secGroupId, "XBEE")
+		ctx = afterCreate(ctx)
 		tags := TagsForResource("XBEE")
 		if _, err := r.Svc.CreateTags(ctx, &ec2.CreateTagsInput{
 			Tags:      tags,
@@ -772,6 +1096,12 @@ func (r *Region2) availabilityZoneFor(h *Host) (*types.Placement, error) {
 	} else {
 		az = h.Specification.AvailabilityZone
 	}
+	if subnet, ok := r.Subnets[h.Name]; ok {
+		if az != "" && az != *subnet.AvailabilityZone {
+			return nil, fmt.Errorf("subnet %s of host %s is in zone %s, but instance must be created in zone %s", *subnet.SubnetId, h.Name, *subnet.AvailabilityZone, az)
+		}
+		az = *subnet.AvailabilityZone
+	}
 	if az != "" {
 		placement := &types.Placement{
 			AvailabilityZone: &az,
@@ -781,10 +1111,42 @@ func (r *Region2) availabilityZoneFor(h *Host) (*types.Placement, error) {
 	return nil, nil
 }
 
-func (r *Region2) createVolume(ctx context.Context, volName string, az *string) error {
+// createVolumesOf creates the missing volumes of h in the zone of placement, the first zone of the region when
+// nothing places h. It returns the placement of the instance of h, in the zone of its volumes.
+func (r *Region2) createVolumesOf(ctx context.Context, h *Host, placement *types.Placement) (*types.Placement, error) {
+	var missing []string
+	for _, volName := range h.Volumes {
+		if !r.HasVolume(volName) {
+			missing = append(missing, volName)
+		}
+	}
+	if len(missing) == 0 {
+		return placement, nil
+	}
+	if placement == nil {
+		if len(r.Zones) == 0 {
+			return nil, fmt.Errorf("cannot choose the zone of volumes %v of host %s, no zone is known in region %s", missing, h.Name, r.Name)
+		}
+		placement = &types.Placement{AvailabilityZone: aws.String(r.Zones[0])}
+	}
+	for _, volName := range missing {
+		if err := r.createVolume(ctx, h, volName, placement.AvailabilityZone); err != nil {
+			return nil, err
+		}
+	}
+	return placement, nil
+}
+
+func (r *Region2) createVolume(ctx context.Context, h *Host, volName string, az *string) error {
 	vol := r.Volumes[volName]
-	v, err := r.Svc.CreateVolume(ctx, &ec2.CreateVolumeInput{
+	encrypted, keyId := vol.encryption(h)
+	snapshotId, err := r.snapshotIdFor(ctx, vol)
+	if err != nil {
+		return fmt.Errorf("cannot create volume %s : %v", vol.Name, err)
+	}
+	v, err := r.createVolumeIdempotent(ctx, vol.Name, &ec2.CreateVolumeInput{
 		AvailabilityZone: az,
+		SnapshotId:       snapshotId,
 		Size:             aws.Int32(int32(vol.Size)),
 		TagSpecifications: []types.TagSpecification{
 			{
@@ -793,11 +1155,16 @@ func (r *Region2) createVolume(ctx context.Context, volName string, az *string)
 			},
 		},
 		VolumeType: types.VolumeType(vol.Specification.VolumeType),
+		Iops:       optionalInt32(vol.Specification.Iops),
+		Throughput: optionalInt32(vol.Specification.Throughput),
+		Encrypted:  encryptedFlag(encrypted),
+		KmsKeyId:   kmsKeyId(encrypted, keyId),
 	})
 	if err != nil {
 		return fmt.Errorf("cannot create volume %s : %v", vol.Name, err)
 	}
-	r.Ec2Volumes[vol.Name] = toVolume(v)
+	r.journal.record(r, resourceVolume, *v.VolumeId, vol.Name)
+	r.Ec2Volumes[vol.Name] = v
 	return nil
 }
 
@@ -823,27 +1190,97 @@ func toVolume(output *ec2.CreateVolumeOutput) *types.Volume {
 	return v
 }
 
+// attachedInstanceId returns the instance v is attached or being attached to, empty when it is not.
+func attachedInstanceId(v *types.Volume) string {
+	for _, att := range v.Attachments {
+		switch att.State {
+		case types.VolumeAttachmentStateAttaching, types.VolumeAttachmentStateAttached:
+			return aws.ToString(att.InstanceId)
+		}
+	}
+	return ""
+}
+
+// AttachVolumes creates the missing volumes of the host in the zone of its instance, and attaches those which are not
+// attached yet, so that volumes added to an existing host or deleted since are attached too. Each volume keeps the
+// device it was first attached under, unless the instance or its AMI uses it.
 func (r *Region2) AttachVolumes(ctx context.Context, hostName string) error {
-	toto := "efghijklmn"
-	volumeCount := 0
-	instance := r.Instances[hostName]
+	instance, ok := r.Instances[hostName]
+	if !ok {
+		return fmt.Errorf("cannot attach volumes of host %s, it has no instance", hostName)
+	}
 	h := r.Hosts[hostName]
+	az := instance.Placement.AvailabilityZone
 	for _, volume := range h.Volumes {
-		ec2Vol := r.Ec2Volumes[volume]
-		volumeCount++
-		if attachment, err := r.Svc.AttachVolume(ctx, &ec2.AttachVolumeInput{
-			Device:     aws.String(fmt.Sprintf("/dev/sd%c", toto[volumeCount])),
-			InstanceId: instance.InstanceId,
-			VolumeId:   ec2Vol.VolumeId,
-		}); err != nil {
-			return fmt.Errorf("cannot attach volume %s to instance %s : %v", volume, h.Name, err)
-		} else {
-			log2.Infof("Volume %s is attached under device %s", volume, *attachment.Device)
+		if !r.HasVolume(volume) {
+			if err := r.createVolume(ctx, h, volume, az); err != nil {
+				return err
+			}
+			log2.Infof("created volume %s of host %s in zone %s", volume, hostName, *az)
+		}
+	}
+	if err := r.waitUntilVolumesAreAvailable(ctx, h.Volumes...); err != nil {
+		return err
+	}
+	var toAttach []string
+	for _, volume := range h.Volumes {
+		switch attachedTo := attachedInstanceId(r.Ec2Volumes[volume]); attachedTo {
+		case *instance.InstanceId:
+		case "":
+			toAttach = append(toAttach, volume)
+		default:
+			return fmt.Errorf("cannot attach volume %s to host %s, it is attached to instance %s", volume, hostName, attachedTo)
+		}
+	}
+	if len(toAttach) == 0 {
+		return nil
+	}
+	used, err := r.usedDevices(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("cannot attach volumes %v to host %s : %v", toAttach, hostName, err)
+	}
+	for _, volume := range toAttach {
+		if err := r.attachVolume(ctx, hostName, volume, used); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// attachVolume attaches the available volume volName to the instance of hostName, under a device not in used.
+func (r *Region2) attachVolume(ctx context.Context, hostName string, volume string, used map[byte]bool) error {
+	instance := r.Instances[hostName]
+	ec2Vol := r.Ec2Volumes[volume]
+	az := instance.Placement.AvailabilityZone
+	if aws.ToString(ec2Vol.AvailabilityZone) != aws.ToString(az) {
+		return fmt.Errorf("cannot attach volume %s to host %s, the volume is in zone %s and the host in zone %s", volume, hostName, aws.ToString(ec2Vol.AvailabilityZone), aws.ToString(az))
+	}
+	device, err := allocateDevice(used, TagValue(ec2Vol.Tags, deviceTag))
+	if err != nil {
+		return fmt.Errorf("cannot attach volume %s to host %s : %v", volume, hostName, err)
+	}
+	attachment, err := r.Svc.AttachVolume(ctx, &ec2.AttachVolumeInput{
+		Device:     aws.String(device),
+		InstanceId: instance.InstanceId,
+		VolumeId:   ec2Vol.VolumeId,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot attach volume %s to instance %s : %v", volume, hostName, err)
+	}
+	log2.Infof("Volume %s is attached under device %s", volume, *attachment.Device)
+	ec2Vol.Attachments = append(ec2Vol.Attachments, types.VolumeAttachment{
+		Device:     attachment.Device,
+		InstanceId: attachment.InstanceId,
+		VolumeId:   attachment.VolumeId,
+		State:      attachment.State,
+	})
+	// the volume is attached, only its next attachment may get another device
+	if err := r.tagDevice(ctx, volume, ec2Vol, device); err != nil {
+		log2.Warnf("%v", err)
+	}
+	return nil
+}
+
 func (r *Region2) instanceInfos() map[string]*provider.InstanceInfo {
 	result := map[string]*provider.InstanceInfo{}
 	for hostName, instance := range r.Instances {
@@ -864,7 +1301,7 @@ func (r *Region2) instanceInfos() map[string]*provider.InstanceInfo {
 		}
 		result[hostName] = info
 		if info.State == constants.State.Up {
-			info.ExternalIp = *instance.PublicIpAddress
+			info.ExternalIp = aws.ToString(instance.PublicIpAddress)
 			info.SSHPort = "22"
 			for _, ifeth := range instance.NetworkInterfaces { //Warn only last private ip is returned
 				info.Ip = *ifeth.PrivateIpAddress
@@ -907,19 +1344,28 @@ type ImageId struct {
 	OsArch string
 }
 
+// ensureImages fills ImageMap with the AMIs packed for the hosts of the region. A region without hosts, as found by
+// regionsOfAccount, has no AMI to look for, and EC2 refuses a filter without values.
 func (r *Region2) ensureImages(ctx context.Context) error {
-	out, err := r.Svc.DescribeImages(ctx, &ec2.DescribeImagesInput{
+	packIds := r.packIds()
+	if len(packIds) == 0 {
+		return nil
+	}
+	paginator := ec2.NewDescribeImagesPaginator(r.Svc, &ec2.DescribeImagesInput{
 		Filters: []types.Filter{
 			{
 				Name:   aws.String("tag:xbee.id"),
-				Values: r.packIds(),
+				Values: packIds,
 			},
 		},
 	})
+	images, err := CollectPages(ctx, paginator, func(out *ec2.DescribeImagesOutput) []types.Image {
+		return out.Images
+	})
 	if err != nil {
 		return err
 	}
-	for _, im := range out.Images {
+	for _, im := range images {
 		for _, tag := range im.Tags {
 			key := *tag.Key
 			if key == "xbee.id" {
@@ -956,16 +1402,16 @@ func (r *Region2) PackInstancesGenerator(ctx context.Context) <-chan *OperationS
 		channels = append(channels, ch)
 		go func(h *Host) {
 			defer close(ch)
-			if err := r.packInstance(ctx, h); err != nil {
-				ch <- &OperationStatus{
-					Host:    h,
-					InError: true,
-				}
-			} else {
-				ch <- &OperationStatus{
-					Host:    h,
-					InError: false,
-				}
+			err := r.packInstance(ctx, h)
+			if err != nil {
+				log2.Errorf("%v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case ch <- &OperationStatus{
+				Host:    h,
+				InError: err != nil,
+			}:
 			}
 		}(h)
 	}
@@ -989,6 +1435,7 @@ func (r *Region2) packInstance(ctx context.Context, h *Host) error {
 	if err != nil {
 		return err
 	}
+	r.journal.record(r, resourceImage, *result.ImageId, h.Name)
 	tags := []types.Tag{
 		{
 			Key:   aws.String("xbee.id"),
@@ -1027,32 +1474,13 @@ func (r *Region2) packInstance(ctx context.Context, h *Host) error {
 			},
 		)
 	}
+	ctx = afterCreate(ctx)
 	if _, err := r.Svc.CreateTags(ctx, &ec2.CreateTagsInput{
 		Tags:      tags,
 		Resources: []string{*result.ImageId},
 	}); err != nil {
-		fmt.Println(err)
+		// an untagged AMI is not found by ensureImages, the host is reported in error by PackInstancesGenerator
+		return fmt.Errorf("cannot tag AMI %s of host %s : %v", *result.ImageId, h.Name, err)
 	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(30 * time.Second):
-			describeInput := &ec2.DescribeImagesInput{
-				ImageIds: []string{*result.ImageId},
-			}
-			describeResult, _ := r.Svc.DescribeImages(ctx, describeInput)
-			if len(describeResult.Images) > 0 {
-				state := describeResult.Images[0].State
-				if state == "available" {
-					return nil
-				}
-				if state == "failed" {
-					return fmt.Errorf("creation of AMI %s failed", h.EffectivePackName())
-				}
-			}
-		}
-	}
-
+	return r.waitUntilImageIsAvailable(ctx, h, *result.ImageId)
 }
@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+)
+
+// fakeRegion2 initializes the region eu-west-1 of cloud through newRegion, as commands do.
+func fakeRegion2(t *testing.T, cloud *awstest.FakeCloud, hosts []*Host, volumes []*Volume) *Region2 {
+	useFakeCloud(t, cloud, hosts, volumes)
+	regions, _, err := regionsForHosts(context.Background())
+	if err != nil {
+		t.Fatalf("cannot initialize regions : %v", err)
+	}
+	r, ok := regions["eu-west-1"]
+	if !ok {
+		t.Fatalf("got regions %v, want eu-west-1", regions)
+	}
+	r.journal = &journal{}
+	return r
+}
+
+func TestCreateInstancesGeneratorSharesVolumesOfHosts(t *testing.T) {
+	ctx := context.Background()
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	var hosts []*Host
+	var volumes []*Volume
+	for index := 0; index < 6; index++ {
+		name := fmt.Sprintf("h%d", index)
+		hosts = append(hosts, testHost(name, "eu-west-1", name+"-data", name+"-logs"))
+		volumes = append(volumes, testVolume(name+"-data", "eu-west-1"), testVolume(name+"-logs", "eu-west-1"))
+	}
+	r := fakeRegion2(t, cloud, hosts, volumes)
+	if err := r.ensureVpc(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.fillZones(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ensureDefaultEnvSecurityGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fake.FailNext("RunInstances", awstest.APIError("InvalidParameterValue", "injected"), awstest.APIError("InvalidParameterValue", "injected"))
+
+	var failed []string
+	for resp := range r.CreateInstancesGenerator(ctx) {
+		if resp.InError {
+			failed = append(failed, resp.Name)
+		}
+	}
+	if len(failed) != 2 {
+		t.Fatalf("got hosts %v in error, want 2", failed)
+	}
+	if got, want := len(r.Ec2Volumes), 2*(len(hosts)-len(failed)); got != want {
+		t.Errorf("got %d volumes known by the region, want %d", got, want)
+	}
+	for _, name := range failed {
+		for _, volName := range []string{name + "-data", name + "-logs"} {
+			if _, ok := r.Ec2Volumes[volName]; ok {
+				t.Errorf("volume %s of host %s in error should be forgotten", volName, name)
+			}
+			if _, ok := volumesOf(fake)[volName]; ok {
+				t.Errorf("volume %s of host %s in error should be deleted", volName, name)
+			}
+		}
+	}
+	if got := fake.Calls["CreateVolume"]; got != 2*len(hosts) {
+		t.Errorf("got %d CreateVolume calls, want %d", got, 2*len(hosts))
+	}
+}
+
+func TestEnsureImagesWithoutHosts(t *testing.T) {
+	fake := fakeRegion(awstest.NewFakeCloud(), "eu-west-1")
+	r := &Region2{Name: "eu-west-1", Svc: fake, Hosts: map[string]*Host{}, ImageMap: map[string]string{}}
+	if err := r.ensureImages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Calls["DescribeImages"]; got != 0 {
+		t.Errorf("got %d DescribeImages calls, want none for a region without hosts", got)
+	}
+}
+
+func TestUpMapsRootDeviceOfAmiInUse(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	// the system AMI of the host has another root device than the AMI of its specification
+	fake.AddImage("ami-0000000000000system", "/dev/sda1", types.Tag{Key: aws.String("xbee.id"), Value: aws.String("system-a")})
+	h := testHost("a", "eu-west-1")
+	h.Specification.Size = 20
+	useFakeCloud(t, cloud, []*Host{h}, nil)
+
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	i := instancesOf(fake)["a"]
+	if i == nil || aws.ToString(i.ImageId) != "ami-0000000000000system" {
+		t.Fatalf("host a should be created from its system AMI, got %v", i)
+	}
+	root := fake.Volumes[*i.BlockDeviceMappings[0].Ebs.VolumeId]
+	if got := aws.ToInt32(root.Size); got != 20 {
+		t.Errorf("got a root volume of %d GiB, the size of the host should apply to the root device of the AMI in use", got)
+	}
+}
+
+// noImagesEC2 describes no AMI, as EC2 does for some deregistered ones.
+type noImagesEC2 struct {
+	*awstest.FakeEC2
+}
+
+func (noImagesEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	return &ec2.DescribeImagesOutput{}, nil
+}
+
+func TestDeviceNameForMissingAmi(t *testing.T) {
+	r := &Region2{Name: "eu-west-1", Svc: noImagesEC2{fakeRegion(awstest.NewFakeCloud(), "eu-west-1")}}
+	if _, err := r.deviceNameForAmi(context.Background(), testAmi); err == nil {
+		t.Error("an AMI which is not described should be reported")
+	}
+}
@@ -0,0 +1,235 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"strings"
+	"time"
+)
+
+// XBEE_AWS_WAIT_MODIFICATION is the max wait for a volume modification to reach optimizing, 10m by default.
+const waitModificationEnv = "XBEE_AWS_WAIT_MODIFICATION"
+
+// volumeModification returns the ModifyVolume input bringing ec2Vol to the specification of vol, nil when it already
+// matches. Settings the specification leaves empty are kept as they are. EBS volumes cannot shrink, a smaller size
+// is an error.
+func volumeModification(vol *Volume, ec2Vol *types.Volume) (*ec2.ModifyVolumeInput, error) {
+	in := &ec2.ModifyVolumeInput{VolumeId: ec2Vol.VolumeId}
+	modified := false
+	if size := int32(vol.Size); size != 0 && size != aws.ToInt32(ec2Vol.Size) {
+		if size < aws.ToInt32(ec2Vol.Size) {
+			return nil, fmt.Errorf("volume %s is %d GiB and cannot shrink to %d GiB, EBS volumes only grow : create a smaller volume and copy the data to it instead", vol.Name, aws.ToInt32(ec2Vol.Size), size)
+		}
+		in.Size, modified = aws.Int32(size), true
+	}
+	if volumeType := types.VolumeType(vol.Specification.VolumeType); volumeType != "" && volumeType != ec2Vol.VolumeType {
+		in.VolumeType, modified = volumeType, true
+	}
+	if iops := int32(vol.Specification.Iops); iops != 0 && iops != aws.ToInt32(ec2Vol.Iops) {
+		in.Iops, modified = aws.Int32(iops), true
+	}
+	if throughput := int32(vol.Specification.Throughput); throughput != 0 && throughput != aws.ToInt32(ec2Vol.Throughput) {
+		in.Throughput, modified = aws.Int32(throughput), true
+	}
+	if !modified {
+		return nil, nil
+	}
+	return in, nil
+}
+
+// describeModification tells what in changes on ec2Vol, e.g. "size 10 -> 20 GiB".
+func describeModification(in *ec2.ModifyVolumeInput, ec2Vol *types.Volume) string {
+	var changes []string
+	if in.Size != nil {
+		changes = append(changes, fmt.Sprintf("size %d -> %d GiB", aws.ToInt32(ec2Vol.Size), *in.Size))
+	}
+	if in.VolumeType != "" {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", ec2Vol.VolumeType, in.VolumeType))
+	}
+	if in.Iops != nil {
+		changes = append(changes, fmt.Sprintf("iops %d -> %d", aws.ToInt32(ec2Vol.Iops), *in.Iops))
+	}
+	if in.Throughput != nil {
+		changes = append(changes, fmt.Sprintf("throughput %d -> %d MiB/s", aws.ToInt32(ec2Vol.Throughput), *in.Throughput))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// modificationCooldown is the delay EBS requires between two modifications of a volume.
+const modificationCooldown = 6 * time.Hour
+
+// checkVolumeModifications fails when the specification of an existing volume cannot be applied, because it shrinks
+// the volume or because the volume is still being modified or was modified less than 6 hours ago, so that Up fails
+// before changing anything.
+func (r *Region2) checkVolumeModifications(ctx context.Context) (errs []error) {
+	names := map[string]string{}
+	var ids []string
+	for _, name := range r.sortedHostNames() {
+		for _, volName := range r.Hosts[name].Volumes {
+			ec2Vol, ok := r.Ec2Volumes[volName]
+			vol, declared := r.Volumes[volName]
+			if !ok || !declared {
+				continue
+			}
+			if in, err := volumeModification(vol, ec2Vol); err != nil {
+				errs = append(errs, err)
+			} else if in != nil {
+				names[*ec2Vol.VolumeId] = volName
+				ids = append(ids, *ec2Vol.VolumeId)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	modifications, err := CollectPages(ctx, ec2.NewDescribeVolumesModificationsPaginator(r.Svc, &ec2.DescribeVolumesModificationsInput{
+		VolumeIds: ids,
+	}), func(out *ec2.DescribeVolumesModificationsOutput) []types.VolumeModification {
+		return out.VolumesModifications
+	})
+	if err != nil {
+		if apiErrorCode(err) == "InvalidVolumeModification.NotFound" {
+			return
+		}
+		return append(errs, fmt.Errorf("cannot get the modifications of volumes %v in region %s : %v", ids, r.Name, err))
+	}
+	latest := map[string]types.VolumeModification{}
+	for _, m := range modifications {
+		id := aws.ToString(m.VolumeId)
+		if previous, ok := latest[id]; !ok || aws.ToTime(m.StartTime).After(aws.ToTime(previous.StartTime)) {
+			latest[id] = m
+		}
+	}
+	for _, id := range ids {
+		m, ok := latest[id]
+		if !ok {
+			continue
+		}
+		switch {
+		case m.ModificationState == types.VolumeModificationStateModifying || m.ModificationState == types.VolumeModificationStateOptimizing:
+			errs = append(errs, fmt.Errorf("volume %s is still being modified, %s %d%%, apply its new specification once completed", names[id], m.ModificationState, aws.ToInt64(m.Progress)))
+		case m.StartTime != nil && time.Since(*m.StartTime) < modificationCooldown:
+			errs = append(errs, fmt.Errorf("volume %s was modified at %s, EBS allows its next modification from %s", names[id], m.StartTime.Format(time.RFC3339), m.StartTime.Add(modificationCooldown).Format(time.RFC3339)))
+		}
+	}
+	return
+}
+
+// resizeVolumes brings the existing volumes of the named hosts to their specification, one status per host. Every
+// modification is started before waiting for them.
+func (r *Region2) resizeVolumes(ctx context.Context, names ...string) (result []*OperationStatus) {
+	statuses := map[string]*OperationStatus{}
+	var started []*startedModification
+	for _, name := range names {
+		h := r.Hosts[name]
+		status := &OperationStatus{Host: h}
+		statuses[name] = status
+		result = append(result, status)
+		for _, volName := range h.Volumes {
+			m, err := r.modifyVolume(ctx, h, volName)
+			if err != nil {
+				log2.Errorf("%v", err)
+				status.InError = true
+			} else if m != nil {
+				started = append(started, m)
+			}
+		}
+	}
+	for _, m := range started {
+		if err := r.completeModification(ctx, m); err != nil {
+			log2.Errorf("%v", err)
+			statuses[m.h.Name].InError = true
+		}
+	}
+	return
+}
+
+// startedModification is a volume modification started by modifyVolume.
+type startedModification struct {
+	h       *Host
+	volName string
+	in      *ec2.ModifyVolumeInput
+	out     *ec2.ModifyVolumeOutput
+}
+
+// modifyVolume starts the modification of the volume volName of h when its specification changed, nil when none is
+// needed.
+func (r *Region2) modifyVolume(ctx context.Context, h *Host, volName string) (*startedModification, error) {
+	ec2Vol, ok := r.Ec2Volumes[volName]
+	vol, declared := r.Volumes[volName]
+	if !ok || !declared {
+		return nil, nil
+	}
+	in, err := volumeModification(vol, ec2Vol)
+	if err != nil || in == nil {
+		return nil, err
+	}
+	changes := describeModification(in, ec2Vol)
+	out, err := r.Svc.ModifyVolume(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot modify volume %s of host %s (%s) : %v", volName, h.Name, changes, err)
+	}
+	log2.Infof("modifying volume %s of host %s : %s", volName, h.Name, changes)
+	return &startedModification{h: h, volName: volName, in: in, out: out}, nil
+}
+
+// completeModification waits until the new size and performance of the volume are usable, which happens once the
+// modification is optimizing.
+func (r *Region2) completeModification(ctx context.Context, m *startedModification) error {
+	ec2Vol := r.Ec2Volumes[m.volName]
+	if err := r.waitUntilVolumeIsModified(ctx, m.volName, *ec2Vol.VolumeId); err != nil {
+		return err
+	}
+	if vm := m.out.VolumeModification; vm != nil {
+		ec2Vol.Size, ec2Vol.VolumeType, ec2Vol.Iops, ec2Vol.Throughput = vm.TargetSize, vm.TargetVolumeType, vm.TargetIops, vm.TargetThroughput
+	}
+	if m.in.Size != nil {
+		if m.h.Specification.GrowFilesystems {
+			log2.Infof("the filesystem of volume %s grows on next boot of host %s", m.volName, m.h.Name)
+		} else {
+			log2.Warnf("volume %s of host %s is now %d GiB, grow its filesystem, e.g. with resize2fs or xfs_growfs", m.volName, m.h.Name, *m.in.Size)
+		}
+	}
+	return nil
+}
+
+// waitUntilVolumeIsModified polls the last modification of the volume until it is optimizing or completed.
+func (r *Region2) waitUntilVolumeIsModified(ctx context.Context, volName string, volumeId string) error {
+	maxWait := durationOption(waitModificationEnv, 10*time.Minute)
+	delay, maxDelay := waitDelays()
+	deadline := time.Now().Add(maxWait)
+	for {
+		out, err := r.Svc.DescribeVolumesModifications(ctx, &ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []string{volumeId},
+		})
+		if err != nil {
+			return fmt.Errorf("cannot get the modification of volume %s in region %s : %v", volName, r.Name, err)
+		}
+		for _, m := range out.VolumesModifications {
+			switch m.ModificationState {
+			case types.VolumeModificationStateOptimizing, types.VolumeModificationStateCompleted:
+				log2.Infof("volume %s is modified, %s", volName, m.ModificationState)
+				return nil
+			case types.VolumeModificationStateFailed:
+				return fmt.Errorf("modification of volume %s failed : %s", volName, aws.ToString(m.StatusMessage))
+			default:
+				log2.Infof("waiting for modification of volume %s, %s %d%%", volName, m.ModificationState, aws.ToInt64(m.Progress))
+			}
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for modification of volume %s in region %s, set %s to wait longer", maxWait, volName, r.Name, waitModificationEnv)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"github.com/iodasolutions/xbee-common/provider"
+	"testing"
+	"time"
+)
+
+func resizeRegion(t *testing.T, fake *awstest.FakeEC2, size int) *Region2 {
+	ctx := context.Background()
+	out, err := fake.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone:  aws.String("eu-west-1a"),
+		Size:              aws.Int32(10),
+		VolumeType:        types.VolumeTypeGp3,
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeVolume, "data"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec2Vol := *fake.Volumes[*out.VolumeId]
+	return &Region2{
+		Name: "eu-west-1",
+		Svc:  fake,
+		Hosts: map[string]*Host{
+			"h": {XbeeHost: &provider.XbeeHost{Name: "h", Volumes: []string{"data"}}, Specification: &AwsHostData{}},
+		},
+		Volumes: map[string]*Volume{
+			"data": {XbeeVolume: &provider.XbeeVolume{Name: "data", Size: size}, Specification: &AwsVolumeData{}},
+		},
+		Ec2Volumes: map[string]*types.Volume{"data": &ec2Vol},
+	}
+}
+
+func TestCheckVolumeModificationsReportsRecentModifications(t *testing.T) {
+	ctx := context.Background()
+	fake := awstest.NewFakeEC2("eu-west-1")
+	r := resizeRegion(t, fake, 20)
+	if errs := r.checkVolumeModifications(ctx); len(errs) != 0 {
+		t.Fatalf("a volume never modified can grow : %v", errs)
+	}
+	volumeId := *r.Ec2Volumes["data"].VolumeId
+	if _, err := fake.ModifyVolume(ctx, &ec2.ModifyVolumeInput{VolumeId: aws.String(volumeId), Size: aws.Int32(15)}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := r.checkVolumeModifications(ctx); len(errs) != 1 {
+		t.Errorf("got %v, the modification in progress should be reported", errs)
+	}
+	m := fake.Modifications[volumeId]
+	m.ModificationState = types.VolumeModificationStateCompleted
+	if errs := r.checkVolumeModifications(ctx); len(errs) != 1 {
+		t.Errorf("got %v, the modification of less than 6 hours should be reported", errs)
+	}
+	m.StartTime = aws.Time(time.Now().Add(-7 * time.Hour))
+	if errs := r.checkVolumeModifications(ctx); len(errs) != 0 {
+		t.Errorf("got %v, the volume can be modified again", errs)
+	}
+}
+
+func TestResizeVolumes(t *testing.T) {
+	t.Setenv(waitPollEnv, "1ms")
+	fake := awstest.NewFakeEC2("eu-west-1")
+	r := resizeRegion(t, fake, 20)
+	for _, status := range r.resizeVolumes(context.Background(), "h") {
+		if status.InError {
+			t.Fatalf("host %s in error", status.Host.Name)
+		}
+	}
+	if got := aws.ToInt32(r.Ec2Volumes["data"].Size); got != 20 {
+		t.Errorf("volume is %d GiB, want 20", got)
+	}
+}
@@ -0,0 +1,513 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+	"github.com/iodasolutions/xbee-common/log2"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// XBEE_AWS_RETRY_MAX_ATTEMPTS is the number of attempts for one EC2 call, 8 by default.
+	retryMaxAttemptsEnv = "XBEE_AWS_RETRY_MAX_ATTEMPTS"
+	// XBEE_AWS_RETRY_BUDGET is the maximum time spent waiting between attempts of one EC2 call, 2m by default.
+	retryBudgetEnv = "XBEE_AWS_RETRY_BUDGET"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Budget bounds the total time slept for one call.
+	Budget time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: intOption(retryMaxAttemptsEnv, 8),
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    20 * time.Second,
+		Budget:      durationOption(retryBudgetEnv, 2*time.Minute),
+	}
+}
+
+// delay returns a full jitter exponential backoff for the given attempt, starting at 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := p.BaseDelay << uint(attempt-1)
+	if ceiling > p.MaxDelay || ceiling <= 0 {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
+
+var throttlingCodes = map[string]bool{
+	"RequestLimitExceeded":      true,
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"RequestThrottled":          true,
+	"RequestThrottledException": true,
+	"TooManyRequestsException":  true,
+}
+
+var serverCodes = map[string]bool{
+	"InternalError":      true,
+	"InternalFailure":    true,
+	"ServiceUnavailable": true,
+	"Unavailable":        true,
+}
+
+var capacityCodes = map[string]bool{
+	"InsufficientInstanceCapacity":         true,
+	"InsufficientHostCapacity":             true,
+	"InsufficientReservedInstanceCapacity": true,
+	"InsufficientCapacity":                 true,
+	"InsufficientVolumeCapacity":           true,
+	"InsufficientAddressCapacity":          true,
+}
+
+// creations without a client token: when a server or capacity error hides a resource created anyway, a retry would
+// create a second one, only throttled calls are known not to have been run
+var untokenedCreates = map[string]bool{
+	"CreateSnapshot":        true,
+	"CreateImage":           true,
+	"CreateVpc":             true,
+	"CreateSubnet":          true,
+	"CreateInternetGateway": true,
+	"CreateRouteTable":      true,
+	"CreateSecurityGroup":   true,
+	"AllocateAddress":       true,
+}
+
+// eventual consistency: a resource just created may not be visible yet to the next call
+var notFoundCodes = map[string]bool{
+	"InvalidInstanceID.NotFound":        true,
+	"InvalidVolume.NotFound":            true,
+	"InvalidGroup.NotFound":             true,
+	"InvalidAMIID.NotFound":             true,
+	"InvalidAllocationID.NotFound":      true,
+	"InvalidSnapshot.NotFound":          true,
+	"InvalidVpcID.NotFound":             true,
+	"InvalidSubnetID.NotFound":          true,
+	"InvalidInternetGatewayID.NotFound": true,
+	"InvalidRouteTableID.NotFound":      true,
+}
+
+type afterCreateKey struct{}
+
+// afterCreate marks ctx for the calls made on resources the command has just created, their not found errors are
+// then retried. Elsewhere a not found error is final, e.g. for a wrong AMI or snapshot id.
+func afterCreate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, afterCreateKey{}, true)
+}
+
+func isAfterCreate(ctx context.Context) bool {
+	marked, _ := ctx.Value(afterCreateKey{}).(bool)
+	return marked
+}
+
+// isRetryable classifies err for the operation op, justCreated telling whether op acts on resources just created.
+// Not found errors are not retried by delete operations, the resource is then already gone. Server and capacity errors
+// are retried by reads, deletes and creations carrying a client token only.
+func isRetryable(op string, err error, justCreated bool) (bool, string) {
+	code := apiErrorCode(err)
+	switch {
+	case throttlingCodes[code]:
+		return true, "throttling"
+	case (serverCodes[code] || capacityCodes[code]) && untokenedCreates[op]:
+		return false, ""
+	case serverCodes[code]:
+		return true, "server error"
+	case capacityCodes[code]:
+		return true, "capacity"
+	case notFoundCodes[code]:
+		if !justCreated || strings.HasPrefix(op, "Delete") || strings.HasPrefix(op, "Terminate") {
+			return false, ""
+		}
+		return true, "eventual consistency"
+	case dependencyCodes[code]:
+		if strings.HasPrefix(op, "Delete") || strings.HasPrefix(op, "Detach") {
+			return true, "dependency release"
+		}
+	}
+	return false, ""
+}
+
+// dependencies of a deleted resource, such as the network interfaces of a terminated instance, are released asynchronously
+var dependencyCodes = map[string]bool{
+	"DependencyViolation": true,
+}
+
+// apiErrorCode returns the EC2 error code of err, empty if err is not an API error.
+func apiErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// isNotFound tells whether err reports a missing resource.
+func isNotFound(err error) bool {
+	return strings.HasSuffix(apiErrorCode(err), ".NotFound")
+}
+
+func retryCall[O any](ctx context.Context, p RetryPolicy, op string, call func() (O, error)) (O, error) {
+	var slept time.Duration
+	for attempt := 1; ; attempt++ {
+		out, err := call()
+		if err == nil {
+			return out, nil
+		}
+		retryable, reason := isRetryable(op, err, isAfterCreate(ctx))
+		if !retryable || attempt >= p.MaxAttempts {
+			return out, err
+		}
+		d := p.delay(attempt)
+		if slept+d > p.Budget {
+			return out, err
+		}
+		slept += d
+		log2.Warnf("%s failed (%s), attempt %d/%d, retrying in %v : %v", op, reason, attempt, p.MaxAttempts, d.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(d):
+		}
+	}
+}
+
+// retryClient retries EC2 calls failing with throttling, server, capacity or eventual consistency errors. It is the
+// only retry layer, NewEC2Client disables the one of the SDK.
+type retryClient struct {
+	api    EC2API
+	policy RetryPolicy
+}
+
+func WithRetry(api EC2API, policy RetryPolicy) EC2API {
+	return &retryClient{api: api, policy: policy}
+}
+
+func (c *retryClient) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeRegions", func() (*ec2.DescribeRegionsOutput, error) {
+		return c.api.DescribeRegions(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeInstances", func() (*ec2.DescribeInstancesOutput, error) {
+		return c.api.DescribeInstances(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	return retryCall(ctx, c.policy, "RunInstances", func() (*ec2.RunInstancesOutput, error) {
+		return c.api.RunInstances(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	return retryCall(ctx, c.policy, "StartInstances", func() (*ec2.StartInstancesOutput, error) {
+		return c.api.StartInstances(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	return retryCall(ctx, c.policy, "StopInstances", func() (*ec2.StopInstancesOutput, error) {
+		return c.api.StopInstances(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	return retryCall(ctx, c.policy, "TerminateInstances", func() (*ec2.TerminateInstancesOutput, error) {
+		return c.api.TerminateInstances(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	return retryCall(ctx, c.policy, "ModifyInstanceAttribute", func() (*ec2.ModifyInstanceAttributeOutput, error) {
+		return c.api.ModifyInstanceAttribute(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeVolumes", func() (*ec2.DescribeVolumesOutput, error) {
+		return c.api.DescribeVolumes(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	return retryCall(ctx, c.policy, "CreateVolume", func() (*ec2.CreateVolumeOutput, error) {
+		return c.api.CreateVolume(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	return retryCall(ctx, c.policy, "AttachVolume", func() (*ec2.AttachVolumeOutput, error) {
+		return c.api.AttachVolume(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DetachVolume(ctx context.Context, params *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error) {
+	return retryCall(ctx, c.policy, "DetachVolume", func() (*ec2.DetachVolumeOutput, error) {
+		return c.api.DetachVolume(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteVolume", func() (*ec2.DeleteVolumeOutput, error) {
+		return c.api.DeleteVolume(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) ModifyVolume(ctx context.Context, params *ec2.ModifyVolumeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVolumeOutput, error) {
+	return retryCall(ctx, c.policy, "ModifyVolume", func() (*ec2.ModifyVolumeOutput, error) {
+		return c.api.ModifyVolume(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeVolumesModifications(ctx context.Context, params *ec2.DescribeVolumesModificationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesModificationsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeVolumesModifications", func() (*ec2.DescribeVolumesModificationsOutput, error) {
+		return c.api.DescribeVolumesModifications(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateSnapshot(ctx context.Context, params *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error) {
+	return retryCall(ctx, c.policy, "CreateSnapshot", func() (*ec2.CreateSnapshotOutput, error) {
+		return c.api.CreateSnapshot(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeSnapshots", func() (*ec2.DescribeSnapshotsOutput, error) {
+		return c.api.DescribeSnapshots(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteSnapshot", func() (*ec2.DeleteSnapshotOutput, error) {
+		return c.api.DeleteSnapshot(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeImages", func() (*ec2.DescribeImagesOutput, error) {
+		return c.api.DescribeImages(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error) {
+	return retryCall(ctx, c.policy, "CreateImage", func() (*ec2.CreateImageOutput, error) {
+		return c.api.CreateImage(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	return retryCall(ctx, c.policy, "DeregisterImage", func() (*ec2.DeregisterImageOutput, error) {
+		return c.api.DeregisterImage(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeVpcs(ctx context.Context, params *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeVpcs", func() (*ec2.DescribeVpcsOutput, error) {
+		return c.api.DescribeVpcs(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateDefaultVpc(ctx context.Context, params *ec2.CreateDefaultVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateDefaultVpcOutput, error) {
+	return retryCall(ctx, c.policy, "CreateDefaultVpc", func() (*ec2.CreateDefaultVpcOutput, error) {
+		return c.api.CreateDefaultVpc(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeSubnets", func() (*ec2.DescribeSubnetsOutput, error) {
+		return c.api.DescribeSubnets(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateVpc(ctx context.Context, params *ec2.CreateVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateVpcOutput, error) {
+	return retryCall(ctx, c.policy, "CreateVpc", func() (*ec2.CreateVpcOutput, error) {
+		return c.api.CreateVpc(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteVpc(ctx context.Context, params *ec2.DeleteVpcInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVpcOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteVpc", func() (*ec2.DeleteVpcOutput, error) {
+		return c.api.DeleteVpc(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) ModifyVpcAttribute(ctx context.Context, params *ec2.ModifyVpcAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVpcAttributeOutput, error) {
+	return retryCall(ctx, c.policy, "ModifyVpcAttribute", func() (*ec2.ModifyVpcAttributeOutput, error) {
+		return c.api.ModifyVpcAttribute(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeAvailabilityZones(ctx context.Context, params *ec2.DescribeAvailabilityZonesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeAvailabilityZones", func() (*ec2.DescribeAvailabilityZonesOutput, error) {
+		return c.api.DescribeAvailabilityZones(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateSubnet(ctx context.Context, params *ec2.CreateSubnetInput, optFns ...func(*ec2.Options)) (*ec2.CreateSubnetOutput, error) {
+	return retryCall(ctx, c.policy, "CreateSubnet", func() (*ec2.CreateSubnetOutput, error) {
+		return c.api.CreateSubnet(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteSubnet(ctx context.Context, params *ec2.DeleteSubnetInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSubnetOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteSubnet", func() (*ec2.DeleteSubnetOutput, error) {
+		return c.api.DeleteSubnet(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) ModifySubnetAttribute(ctx context.Context, params *ec2.ModifySubnetAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySubnetAttributeOutput, error) {
+	return retryCall(ctx, c.policy, "ModifySubnetAttribute", func() (*ec2.ModifySubnetAttributeOutput, error) {
+		return c.api.ModifySubnetAttribute(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeInternetGateways(ctx context.Context, params *ec2.DescribeInternetGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInternetGatewaysOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeInternetGateways", func() (*ec2.DescribeInternetGatewaysOutput, error) {
+		return c.api.DescribeInternetGateways(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateInternetGateway(ctx context.Context, params *ec2.CreateInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateInternetGatewayOutput, error) {
+	return retryCall(ctx, c.policy, "CreateInternetGateway", func() (*ec2.CreateInternetGatewayOutput, error) {
+		return c.api.CreateInternetGateway(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AttachInternetGateway(ctx context.Context, params *ec2.AttachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.AttachInternetGatewayOutput, error) {
+	return retryCall(ctx, c.policy, "AttachInternetGateway", func() (*ec2.AttachInternetGatewayOutput, error) {
+		return c.api.AttachInternetGateway(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DetachInternetGateway(ctx context.Context, params *ec2.DetachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DetachInternetGatewayOutput, error) {
+	return retryCall(ctx, c.policy, "DetachInternetGateway", func() (*ec2.DetachInternetGatewayOutput, error) {
+		return c.api.DetachInternetGateway(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteInternetGateway(ctx context.Context, params *ec2.DeleteInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteInternetGatewayOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteInternetGateway", func() (*ec2.DeleteInternetGatewayOutput, error) {
+		return c.api.DeleteInternetGateway(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeRouteTables(ctx context.Context, params *ec2.DescribeRouteTablesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeRouteTables", func() (*ec2.DescribeRouteTablesOutput, error) {
+		return c.api.DescribeRouteTables(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateRouteTable(ctx context.Context, params *ec2.CreateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteTableOutput, error) {
+	return retryCall(ctx, c.policy, "CreateRouteTable", func() (*ec2.CreateRouteTableOutput, error) {
+		return c.api.CreateRouteTable(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteRouteTable(ctx context.Context, params *ec2.DeleteRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.DeleteRouteTableOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteRouteTable", func() (*ec2.DeleteRouteTableOutput, error) {
+		return c.api.DeleteRouteTable(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateRoute(ctx context.Context, params *ec2.CreateRouteInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	return retryCall(ctx, c.policy, "CreateRoute", func() (*ec2.CreateRouteOutput, error) {
+		return c.api.CreateRoute(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AssociateRouteTable(ctx context.Context, params *ec2.AssociateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.AssociateRouteTableOutput, error) {
+	return retryCall(ctx, c.policy, "AssociateRouteTable", func() (*ec2.AssociateRouteTableOutput, error) {
+		return c.api.AssociateRouteTable(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeSecurityGroups", func() (*ec2.DescribeSecurityGroupsOutput, error) {
+		return c.api.DescribeSecurityGroups(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	return retryCall(ctx, c.policy, "CreateSecurityGroup", func() (*ec2.CreateSecurityGroupOutput, error) {
+		return c.api.CreateSecurityGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteSecurityGroup", func() (*ec2.DeleteSecurityGroupOutput, error) {
+		return c.api.DeleteSecurityGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	return retryCall(ctx, c.policy, "AuthorizeSecurityGroupIngress", func() (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+		return c.api.AuthorizeSecurityGroupIngress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	return retryCall(ctx, c.policy, "RevokeSecurityGroupIngress", func() (*ec2.RevokeSecurityGroupIngressOutput, error) {
+		return c.api.RevokeSecurityGroupIngress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeSecurityGroupRules(ctx context.Context, params *ec2.DescribeSecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeSecurityGroupRules", func() (*ec2.DescribeSecurityGroupRulesOutput, error) {
+		return c.api.DescribeSecurityGroupRules(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	return retryCall(ctx, c.policy, "DescribeAddresses", func() (*ec2.DescribeAddressesOutput, error) {
+		return c.api.DescribeAddresses(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error) {
+	return retryCall(ctx, c.policy, "AssociateAddress", func() (*ec2.AssociateAddressOutput, error) {
+		return c.api.AssociateAddress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	return retryCall(ctx, c.policy, "AllocateAddress", func() (*ec2.AllocateAddressOutput, error) {
+		return c.api.AllocateAddress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	return retryCall(ctx, c.policy, "ReleaseAddress", func() (*ec2.ReleaseAddressOutput, error) {
+		return c.api.ReleaseAddress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DisassociateAddress(ctx context.Context, params *ec2.DisassociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateAddressOutput, error) {
+	return retryCall(ctx, c.policy, "DisassociateAddress", func() (*ec2.DisassociateAddressOutput, error) {
+		return c.api.DisassociateAddress(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	return retryCall(ctx, c.policy, "CreateTags", func() (*ec2.CreateTagsOutput, error) {
+		return c.api.CreateTags(ctx, params, optFns...)
+	})
+}
+
+func (c *retryClient) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	return retryCall(ctx, c.policy, "DeleteTags", func() (*ec2.DeleteTagsOutput, error) {
+		return c.api.DeleteTags(ctx, params, optFns...)
+	})
+}
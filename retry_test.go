@@ -0,0 +1,139 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+	"time"
+)
+
+func fastRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    2 * time.Millisecond,
+		Budget:      time.Second,
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		op          string
+		code        string
+		justCreated bool
+		retryable   bool
+		reason      string
+	}{
+		{"DescribeInstances", "RequestLimitExceeded", false, true, "throttling"},
+		{"RunInstances", "InternalError", false, true, "server error"},
+		{"DescribeVolumes", "ServiceUnavailable", false, true, "server error"},
+		{"RunInstances", "InsufficientInstanceCapacity", false, true, "capacity"},
+		{"CreateTags", "InvalidInstanceID.NotFound", true, true, "eventual consistency"},
+		{"CreateTags", "InvalidInstanceID.NotFound", false, false, ""},
+		{"DescribeImages", "InvalidAMIID.NotFound", false, false, ""},
+		{"TerminateInstances", "InvalidInstanceID.NotFound", true, false, ""},
+		{"DeleteVolume", "InvalidVolume.NotFound", true, false, ""},
+		{"DeleteSecurityGroup", "DependencyViolation", false, true, "dependency release"},
+		{"CreateSecurityGroup", "DependencyViolation", false, false, ""},
+		{"RunInstances", "InvalidParameterValue", false, false, ""},
+		{"CreateVolume", "InternalError", false, true, "server error"},
+		{"CreateVpc", "InternalError", false, false, ""},
+		{"AllocateAddress", "InsufficientAddressCapacity", false, false, ""},
+		{"CreateSecurityGroup", "RequestLimitExceeded", false, true, "throttling"},
+		{"CreateSubnet", "InvalidVpcID.NotFound", true, true, "eventual consistency"},
+	}
+	for _, test := range tests {
+		retryable, reason := isRetryable(test.op, awstest.APIError(test.code, "injected"), test.justCreated)
+		if retryable != test.retryable || reason != test.reason {
+			t.Errorf("%s failing with %s (just created %v): got %v %q, want %v %q", test.op, test.code, test.justCreated, retryable, reason, test.retryable, test.reason)
+		}
+	}
+}
+
+func TestRetryThrottling(t *testing.T) {
+	fake := awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("DescribeInstances", awstest.APIError("RequestLimitExceeded", "slow down"), awstest.APIError("RequestLimitExceeded", "slow down"))
+	svc := WithRetry(fake, fastRetryPolicy())
+	if _, err := svc.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{}); err != nil {
+		t.Fatalf("throttled call should succeed once retried : %v", err)
+	}
+	if got := fake.Calls["DescribeInstances"]; got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+}
+
+func TestRetryDoesNotRepeatCreationWithoutToken(t *testing.T) {
+	fake := awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("CreateVpc", awstest.APIError("InternalError", "injected"))
+	svc := WithRetry(fake, fastRetryPolicy())
+	if _, err := svc.CreateVpc(context.Background(), &ec2.CreateVpcInput{CidrBlock: aws.String("10.0.0.0/16")}); err == nil {
+		t.Fatal("the server error should be returned")
+	}
+	if got := fake.Calls["CreateVpc"]; got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+	if len(fake.Vpcs) != 0 {
+		t.Errorf("got vpcs %v, want none", fake.Vpcs)
+	}
+}
+
+func TestRetryCapacityStopsAtMaxAttempts(t *testing.T) {
+	fake := awstest.NewFakeEC2("eu-west-1")
+	policy := fastRetryPolicy()
+	for i := 0; i < policy.MaxAttempts+1; i++ {
+		fake.FailNext("RunInstances", awstest.APIError("InsufficientInstanceCapacity", "no capacity"))
+	}
+	_, err := WithRetry(fake, policy).RunInstances(context.Background(), &ec2.RunInstancesInput{})
+	if apiErrorCode(err) != "InsufficientInstanceCapacity" {
+		t.Fatalf("got %v, want the capacity error", err)
+	}
+	if got := fake.Calls["RunInstances"]; got != policy.MaxAttempts {
+		t.Errorf("got %d attempts, want %d", got, policy.MaxAttempts)
+	}
+}
+
+func TestRetryStopsWhenBudgetIsSpent(t *testing.T) {
+	fake := awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("RunInstances", awstest.APIError("InsufficientInstanceCapacity", "no capacity"), awstest.APIError("InsufficientInstanceCapacity", "no capacity"))
+	policy := fastRetryPolicy()
+	policy.Budget = 0
+	if _, err := WithRetry(fake, policy).RunInstances(context.Background(), &ec2.RunInstancesInput{}); err == nil {
+		t.Fatal("call should fail, no retry fits in the budget")
+	}
+	if got := fake.Calls["RunInstances"]; got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+func TestRetryNotFoundOnlyAfterCreate(t *testing.T) {
+	notFound := awstest.APIError("InvalidInstanceID.NotFound", "The instance ID 'i-1' does not exist")
+
+	fake := awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("DescribeInstances", notFound)
+	if _, err := WithRetry(fake, fastRetryPolicy()).DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{}); err == nil {
+		t.Error("not found should be final outside of afterCreate")
+	}
+	if got := fake.Calls["DescribeInstances"]; got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+
+	fake = awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("DescribeInstances", notFound, notFound)
+	if _, err := WithRetry(fake, fastRetryPolicy()).DescribeInstances(afterCreate(context.Background()), &ec2.DescribeInstancesInput{}); err != nil {
+		t.Errorf("not found should be retried after create : %v", err)
+	}
+	if got := fake.Calls["DescribeInstances"]; got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+
+	fake = awstest.NewFakeEC2("eu-west-1")
+	fake.FailNext("TerminateInstances", notFound)
+	if _, err := WithRetry(fake, fastRetryPolicy()).TerminateInstances(afterCreate(context.Background()), &ec2.TerminateInstancesInput{}); err == nil {
+		t.Error("terminate of a missing instance should not be retried")
+	}
+	if got := fake.Calls["TerminateInstances"]; got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
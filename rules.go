@@ -0,0 +1,280 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sort"
+)
+
+const (
+	// descriptions of the inbound rules created by xbee, only those and undescribed rules are revoked once no longer
+	// wanted
+	ruleDescription       = "xbee"
+	callerRuleDescription = "xbee caller ip"
+)
+
+// ingressRule is an inbound rule with a single source, the way EC2 stores rules.
+type ingressRule struct {
+	Protocol string
+	From     int32
+	To       int32
+	Cidr     string
+	GroupId  string
+}
+
+func (rule ingressRule) String() string {
+	source := rule.Cidr
+	if rule.GroupId != "" {
+		source = rule.GroupId
+	}
+	if rule.From == -1 {
+		return fmt.Sprintf("%s from %s", rule.Protocol, source)
+	}
+	ports := fmt.Sprintf("%d-%d", rule.From, rule.To)
+	if rule.From == rule.To {
+		ports = fmt.Sprintf("%d", rule.From)
+	}
+	return fmt.Sprintf("%s/%s from %s", ports, rule.Protocol, source)
+}
+
+func (rule ingressRule) permission(description string) types.IpPermission {
+	result := types.IpPermission{
+		IpProtocol: aws.String(rule.Protocol),
+		FromPort:   aws.Int32(rule.From),
+		ToPort:     aws.Int32(rule.To),
+	}
+	switch {
+	case rule.GroupId != "":
+		result.UserIdGroupPairs = []types.UserIdGroupPair{{GroupId: aws.String(rule.GroupId), Description: aws.String(description)}}
+	case isIpv6Cidr(rule.Cidr):
+		result.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(rule.Cidr), Description: aws.String(description)}}
+	default:
+		result.IpRanges = []types.IpRange{{CidrIp: aws.String(rule.Cidr), Description: aws.String(description)}}
+	}
+	return result
+}
+
+// ports returns the rule without its source.
+func (rule ingressRule) ports() ingressRule {
+	return ingressRule{Protocol: rule.Protocol, From: rule.From, To: rule.To}
+}
+
+// rulesOfPermission splits p in single source rules, with their description.
+func rulesOfPermission(p types.IpPermission) map[ingressRule]string {
+	result := map[ingressRule]string{}
+	base := ingressRule{
+		Protocol: aws.ToString(p.IpProtocol),
+		From:     -1,
+		To:       -1,
+	}
+	if p.FromPort != nil {
+		base.From = *p.FromPort
+	}
+	if p.ToPort != nil {
+		base.To = *p.ToPort
+	}
+	for _, r := range p.IpRanges {
+		rule := base
+		rule.Cidr = aws.ToString(r.CidrIp)
+		result[rule] = aws.ToString(r.Description)
+	}
+	for _, r := range p.Ipv6Ranges {
+		rule := base
+		rule.Cidr = aws.ToString(r.CidrIpv6)
+		result[rule] = aws.ToString(r.Description)
+	}
+	for _, pair := range p.UserIdGroupPairs {
+		rule := base
+		rule.GroupId = aws.ToString(pair.GroupId)
+		result[rule] = aws.ToString(pair.Description)
+	}
+	return result
+}
+
+func ruleOf(r types.SecurityGroupRule) ingressRule {
+	rule := ingressRule{
+		Protocol: aws.ToString(r.IpProtocol),
+		From:     aws.ToInt32(r.FromPort),
+		To:       aws.ToInt32(r.ToPort),
+		Cidr:     aws.ToString(r.CidrIpv4),
+	}
+	if r.CidrIpv6 != nil {
+		rule.Cidr = *r.CidrIpv6
+	}
+	if r.ReferencedGroupInfo != nil {
+		rule.GroupId = aws.ToString(r.ReferencedGroupInfo.GroupId)
+	}
+	return rule
+}
+
+func sortRules(rules []ingressRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].String() < rules[j].String()
+	})
+}
+
+func rulesAsStrings(rules []ingressRule) (result []string) {
+	for _, rule := range rules {
+		result = append(result, rule.String())
+	}
+	return
+}
+
+// securityGroupChanges is what reconcileSecurityGroup does to the security group of an existing host.
+type securityGroupChanges struct {
+	// empty when the host has no group yet
+	GroupId string
+	Missing []ingressRule
+	Stale   []ingressRule
+	// descriptions of the missing rules
+	descriptions map[ingressRule]string
+	staleIds     []string
+}
+
+func (c *securityGroupChanges) isEmpty() bool {
+	return len(c.Missing) == 0 && len(c.Stale) == 0
+}
+
+// securityGroupChangesFor compares the security group of h with its ports. Only rules created by xbee are stale, rules
+// added by other means are kept when they have a description of their own. Undescribed rules are the ones of groups
+// created before rules were described, the group being created by xbee for the host they are its own. A caller ip rule is kept while its port still asks for the caller ip, it may be the
+// one of another operator.
+func (r *Region2) securityGroupChangesFor(ctx context.Context, h *Host) (*securityGroupChanges, error) {
+	permissions, err := h.ingressPermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &securityGroupChanges{descriptions: map[ingressRule]string{}}
+	callerPorts := map[ingressRule]bool{}
+	for _, permission := range permissions {
+		for rule, description := range rulesOfPermission(permission) {
+			result.descriptions[rule] = description
+			if description == callerRuleDescription {
+				callerPorts[rule.ports()] = true
+			}
+		}
+	}
+	groups, err := r.describeSecurityGroups(ctx, EnvFiltersForResource(h.Name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot look for security group of host %s : %v", h.Name, err)
+	}
+	existing := map[ingressRule]bool{}
+	if len(groups) > 0 {
+		result.GroupId = *groups[0].GroupId
+		rules, err := CollectPages(ctx, ec2.NewDescribeSecurityGroupRulesPaginator(r.Svc, &ec2.DescribeSecurityGroupRulesInput{
+			Filters: []types.Filter{
+				{
+					Name:   aws.String("group-id"),
+					Values: []string{result.GroupId},
+				},
+			},
+		}), func(out *ec2.DescribeSecurityGroupRulesOutput) []types.SecurityGroupRule {
+			return out.SecurityGroupRules
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot describe rules of security group %s of host %s : %v", result.GroupId, h.Name, err)
+		}
+		for _, sgr := range rules {
+			if aws.ToBool(sgr.IsEgress) {
+				continue
+			}
+			rule := ruleOf(sgr)
+			existing[rule] = true
+			if _, ok := result.descriptions[rule]; ok {
+				continue
+			}
+			switch aws.ToString(sgr.Description) {
+			case ruleDescription, "":
+			case callerRuleDescription:
+				if callerPorts[rule.ports()] {
+					continue
+				}
+			default:
+				continue
+			}
+			result.staleIds = append(result.staleIds, *sgr.SecurityGroupRuleId)
+			result.Stale = append(result.Stale, rule)
+		}
+	}
+	for rule := range result.descriptions {
+		if !existing[rule] {
+			result.Missing = append(result.Missing, rule)
+		}
+	}
+	sortRules(result.Missing)
+	sortRules(result.Stale)
+	return result, nil
+}
+
+// reconcileSecurityGroup brings the security group of an existing host in line with its ports: missing rules are
+// authorized, stale ones revoked, and the group is created and attached when the host gained ports after creation.
+func (r *Region2) reconcileSecurityGroup(ctx context.Context, h *Host) error {
+	changes, err := r.securityGroupChangesFor(ctx, h)
+	if err != nil {
+		return err
+	}
+	if changes.GroupId == "" {
+		if len(changes.Missing) == 0 {
+			return nil
+		}
+		groupId, err := r.createSecurityGroup(ctx, h)
+		if err != nil {
+			return err
+		}
+		return r.attachSecurityGroup(afterCreate(ctx), h, *groupId)
+	}
+	groupId := changes.GroupId
+	if len(changes.Missing) > 0 {
+		var added []types.IpPermission
+		for _, rule := range changes.Missing {
+			added = append(added, rule.permission(changes.descriptions[rule]))
+		}
+		if _, err := r.Svc.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupId),
+			IpPermissions: added,
+		}); err != nil {
+			return fmt.Errorf("cannot authorize inbound rules %v for host %s : %v", changes.Missing, h.Name, err)
+		}
+		for _, rule := range changes.Missing {
+			log2.Infof("authorized inbound rule %s for host %s", rule, h.Name)
+		}
+	}
+	if len(changes.staleIds) > 0 {
+		if _, err := r.Svc.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:              aws.String(groupId),
+			SecurityGroupRuleIds: changes.staleIds,
+		}); err != nil {
+			return fmt.Errorf("cannot revoke inbound rules %v for host %s : %v", changes.Stale, h.Name, err)
+		}
+		for _, rule := range changes.Stale {
+			log2.Infof("revoked inbound rule %s for host %s", rule, h.Name)
+		}
+	}
+	return r.attachSecurityGroup(ctx, h, groupId)
+}
+
+// attachSecurityGroup adds the group to the instance of h when it is not already attached.
+func (r *Region2) attachSecurityGroup(ctx context.Context, h *Host, groupId string) error {
+	instance := r.Instances[h.Name]
+	var groupIds []string
+	for _, group := range instance.SecurityGroups {
+		if *group.GroupId == groupId {
+			return nil
+		}
+		groupIds = append(groupIds, *group.GroupId)
+	}
+	groupIds = append(groupIds, groupId)
+	if _, err := r.Svc.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId: instance.InstanceId,
+		Groups:     groupIds,
+	}); err != nil {
+		return fmt.Errorf("cannot attach security group %s to host %s : %v", groupId, h.Name, err)
+	}
+	instance.SecurityGroups = append(instance.SecurityGroups, types.GroupIdentifier{GroupId: aws.String(groupId)})
+	log2.Infof("attached security group %s to host %s", groupId, h.Name)
+	return nil
+}
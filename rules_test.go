@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"github.com/iodasolutions/xbee-common/provider"
+	"reflect"
+	"testing"
+)
+
+func TestSecurityGroupChangesRevokeOnlyXbeeRules(t *testing.T) {
+	t.Setenv(callerIpEnv, "203.0.113.7")
+	detectedCallerIp.Lock()
+	detectedCallerIp.cidr = ""
+	detectedCallerIp.Unlock()
+	ctx := context.Background()
+	fake := awstest.NewFakeEC2("eu-west-1")
+	out, err := fake.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:         aws.String("h"),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeSecurityGroup, "h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := func(port int32, cidr string, description string) types.IpPermission {
+		permission := ingressRule{Protocol: "tcp", From: port, To: port, Cidr: cidr}.permission(description)
+		if description == "" {
+			permission.IpRanges[0].Description = nil
+		}
+		return permission
+	}
+	if _, err := fake.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: out.GroupId,
+		IpPermissions: []types.IpPermission{
+			// caller ip of another operator, port 80 still asks for the caller ip
+			rule(80, "198.51.100.9/32", callerRuleDescription),
+			// port no longer declared
+			rule(443, "0.0.0.0/0", ruleDescription),
+			// added by hand
+			rule(22, "10.1.0.0/16", "bastion"),
+			// created by xbee before rules were described
+			rule(8080, "0.0.0.0/0", ""),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := &Region2{Name: "eu-west-1", Svc: fake}
+	h := &Host{
+		XbeeHost:      &provider.XbeeHost{Name: "h", Ports: []string{"80"}},
+		Specification: &AwsHostData{Ingress: &IngressSources{CallerIp: true}},
+	}
+	changes, err := r.securityGroupChangesFor(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"80/tcp from 203.0.113.7/32"}; !reflect.DeepEqual(rulesAsStrings(changes.Missing), want) {
+		t.Errorf("authorized %v, want %v", rulesAsStrings(changes.Missing), want)
+	}
+	if want := []string{"443/tcp from 0.0.0.0/0", "8080/tcp from 0.0.0.0/0"}; !reflect.DeepEqual(rulesAsStrings(changes.Stale), want) {
+		t.Errorf("revoked %v, want %v", rulesAsStrings(changes.Stale), want)
+	}
+
+	h.Specification.Ingress = &IngressSources{Cidrs: []string{"10.0.0.0/8"}}
+	if changes, err = r.securityGroupChangesFor(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"443/tcp from 0.0.0.0/0", "80/tcp from 198.51.100.9/32", "8080/tcp from 0.0.0.0/0"}; !reflect.DeepEqual(rulesAsStrings(changes.Stale), want) {
+		t.Errorf("revoked %v once the caller ip is no longer asked, want %v", rulesAsStrings(changes.Stale), want)
+	}
+}
+
+func TestSecurityGroupChangesKeepWantedUndescribedRules(t *testing.T) {
+	ctx := context.Background()
+	fake := awstest.NewFakeEC2("eu-west-1")
+	out, err := fake.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:         aws.String("h"),
+		TagSpecifications: TagSpecificationsForResource(types.ResourceTypeSecurityGroup, "h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := func(port int32) types.IpPermission {
+		return types.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int32(port),
+			ToPort:     aws.Int32(port),
+			IpRanges:   []types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+		}
+	}
+	if _, err := fake.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       out.GroupId,
+		IpPermissions: []types.IpPermission{legacy(80), legacy(443)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := &Region2{Name: "eu-west-1", Svc: fake}
+	h := &Host{
+		XbeeHost:      &provider.XbeeHost{Name: "h", Ports: []string{"80"}},
+		Specification: &AwsHostData{},
+	}
+	changes, err := r.securityGroupChangesFor(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Missing) != 0 {
+		t.Errorf("authorized %v, the legacy rule of port 80 is still wanted", rulesAsStrings(changes.Missing))
+	}
+	if want := []string{"443/tcp from 0.0.0.0/0"}; !reflect.DeepEqual(rulesAsStrings(changes.Stale), want) {
+		t.Errorf("revoked %v, want %v", rulesAsStrings(changes.Stale), want)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	xaws "github.com/iodasolutions/aws"
 	"github.com/iodasolutions/xbee-common/util"
 	"log"
 	"strings"
@@ -14,18 +14,16 @@ import (
 
 type Region struct {
 	Name string
-	Svc  *ec2.Client
+	Svc  xaws.EC2API
 }
 
 func AllRegions(ctx context.Context) map[string]*Region {
 	result := map[string]*Region{}
-	cfg, err := config.LoadDefaultConfig(ctx)
+	client, err := xaws.NewEC2Client(ctx, "")
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	client := ec2.NewFromConfig(cfg)
-	regRes, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{
+	regRes, err := xaws.WithRetry(client, xaws.DefaultRetryPolicy()).DescribeRegions(ctx, &ec2.DescribeRegionsInput{
 		AllRegions: aws.Bool(true),
 	})
 	if err != nil {
@@ -33,15 +31,13 @@ func AllRegions(ctx context.Context) map[string]*Region {
 	}
 	for _, r := range regRes.Regions {
 		name := *r.RegionName
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithRegion(name),
-		)
+		svc, err := xaws.NewEC2Client(ctx, name)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		result[name] = &Region{
 			Name: name,
-			Svc:  ec2.NewFromConfig(cfg),
+			Svc:  xaws.WithRetry(svc, xaws.DefaultRetryPolicy()),
 		}
 	}
 	return result
@@ -61,7 +57,7 @@ func (r *Region) AmiFor(ctx context.Context, owner string, name string, archi st
 			d.End(fmt.Sprintf("AmiFor %s", r.Name))
 		}()
 		defer close(amiCh)
-		imRes, err := r.Svc.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		paginator := ec2.NewDescribeImagesPaginator(r.Svc, &ec2.DescribeImagesInput{
 			Filters: []types.Filter{
 				{
 					Name:   aws.String("owner-id"),
@@ -77,14 +73,15 @@ func (r *Region) AmiFor(ctx context.Context, owner string, name string, archi st
 				},
 			},
 		})
+		images, err := xaws.CollectPages(ctx, paginator, func(out *ec2.DescribeImagesOutput) []types.Image {
+			return out.Images
+		})
 		var imagesWithName []types.Image
-		if imRes != nil {
-			for _, im := range imRes.Images {
-				//strings.Contains(*image.Description, "20.04") {
-				if im.Description != nil {
-					if strings.Contains(*im.Description, name) {
-						imagesWithName = append(imagesWithName, im)
-					}
+		for _, im := range images {
+			//strings.Contains(*image.Description, "20.04") {
+			if im.Description != nil {
+				if strings.Contains(*im.Description, name) {
+					imagesWithName = append(imagesWithName, im)
 				}
 			}
 		}
@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+	"sort"
+	"time"
+)
+
+const (
+	// XBEE_AWS_SNAPSHOT_KEEP is how many snapshots of each volume prune keeps, 7 by default.
+	snapshotKeepEnv = "XBEE_AWS_SNAPSHOT_KEEP"
+	// XBEE_AWS_SNAPSHOT_MAX_AGE makes prune delete older snapshots, e.g. 720h. No limit by default.
+	snapshotMaxAgeEnv = "XBEE_AWS_SNAPSHOT_MAX_AGE"
+
+	// snapshotLatest as snapshotId restores a volume from its latest completed snapshot.
+	snapshotLatest = "latest"
+	// tag holding the UTC time a snapshot was taken at
+	snapshotTimeTag = "xbee.timestamp"
+)
+
+// createSnapshot snapshots the volume named volName, tagged with its name and the time it was taken at.
+func (r *Region2) createSnapshot(ctx context.Context, volName string) (*ec2.CreateSnapshotOutput, error) {
+	vol, ok := r.Ec2Volumes[volName]
+	if !ok {
+		return nil, fmt.Errorf("volume %s does not exist in region %s", volName, r.Name)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	tags := append(TagsForResource(volName), types.Tag{
+		Key:   aws.String(snapshotTimeTag),
+		Value: aws.String(now),
+	})
+	out, err := r.Svc.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    vol.VolumeId,
+		Description: aws.String(fmt.Sprintf("xbee backup of volume %s of env %s at %s", volName, provider.EnvName(), now)),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags:         tags,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot snapshot volume %s in region %s : %v", volName, r.Name, err)
+	}
+	return out, nil
+}
+
+// snapshots returns the snapshots of the env volumes named volNames, every volume when none is given, newest first.
+func (r *Region2) snapshots(ctx context.Context, volNames ...string) ([]types.Snapshot, error) {
+	filters := EnvFilters()
+	if len(volNames) > 0 {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("tag:xbee.name"),
+			Values: volNames,
+		})
+	}
+	paginator := ec2.NewDescribeSnapshotsPaginator(r.Svc, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters:  filters,
+	})
+	result, err := CollectPages(ctx, paginator, func(out *ec2.DescribeSnapshotsOutput) []types.Snapshot {
+		return out.Snapshots
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe snapshots in region %s : %v", r.Name, err)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return aws.ToTime(result[i].StartTime).After(aws.ToTime(result[j].StartTime))
+	})
+	return result, nil
+}
+
+// snapshotIdFor resolves the snapshot the volume is created from, none when it asks for the latest one but has none yet.
+func (r *Region2) snapshotIdFor(ctx context.Context, vol *Volume) (*string, error) {
+	switch vol.Specification.SnapshotId {
+	case "":
+		return nil, nil
+	case snapshotLatest:
+		snapshots, err := r.snapshots(ctx, vol.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snapshots {
+			if snap.State == types.SnapshotStateCompleted {
+				log2.Infof("restoring volume %s from its latest snapshot %s of %s", vol.Name, *snap.SnapshotId, TagValue(snap.Tags, snapshotTimeTag))
+				return snap.SnapshotId, nil
+			}
+		}
+		log2.Warnf("volume %s has no completed snapshot to restore, it is created empty", vol.Name)
+		return nil, nil
+	default:
+		log2.Infof("restoring volume %s from snapshot %s", vol.Name, vol.Specification.SnapshotId)
+		return aws.String(vol.Specification.SnapshotId), nil
+	}
+}
+
+// prunedSnapshots returns the snapshots beyond the keep newest ones of their volume, or older than maxAge when not
+// zero. The latest completed snapshot of a volume is always kept.
+func prunedSnapshots(snapshots []types.Snapshot, keep int, maxAge time.Duration, now time.Time) (result []types.Snapshot) {
+	byVolume := map[string][]types.Snapshot{}
+	for _, snap := range snapshots {
+		name := TagValue(snap.Tags, "xbee.name")
+		byVolume[name] = append(byVolume[name], snap)
+	}
+	for _, volSnapshots := range byVolume {
+		latestKept := false
+		for index, snap := range volSnapshots {
+			tooOld := maxAge > 0 && now.Sub(aws.ToTime(snap.StartTime)) > maxAge
+			if snap.State == types.SnapshotStateCompleted && !latestKept {
+				latestKept = true
+				continue
+			}
+			if index >= keep || tooOld {
+				result = append(result, snap)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/iodasolutions/aws/awstest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testSnapshot(id string, volName string, state types.SnapshotState, startTime time.Time) types.Snapshot {
+	return types.Snapshot{
+		SnapshotId: aws.String(id),
+		State:      state,
+		StartTime:  aws.Time(startTime),
+		VolumeSize: aws.Int32(10),
+		Tags: append(TagsForResource(volName), types.Tag{
+			Key:   aws.String(snapshotTimeTag),
+			Value: aws.String(startTime.UTC().Format(time.RFC3339)),
+		}),
+	}
+}
+
+func TestPrunedSnapshots(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	// newest first, as returned by snapshots
+	snapshots := []types.Snapshot{
+		testSnapshot("a5", "a", types.SnapshotStatePending, now.Add(-30*time.Minute)),
+		testSnapshot("a4", "a", types.SnapshotStateCompleted, now.Add(-2*day)),
+		testSnapshot("a3", "a", types.SnapshotStateError, now.Add(-3*day)),
+		testSnapshot("a2", "a", types.SnapshotStateCompleted, now.Add(-10*day)),
+		testSnapshot("a1", "a", types.SnapshotStateCompleted, now.Add(-40*day)),
+		testSnapshot("b1", "b", types.SnapshotStateCompleted, now.Add(-40*day)),
+	}
+	tests := []struct {
+		keep   int
+		maxAge time.Duration
+		pruned []string
+	}{
+		{7, 0, nil},
+		{2, 0, []string{"a1", "a2", "a3"}},
+		// the latest completed snapshot of each volume is kept
+		{0, 0, []string{"a1", "a2", "a3", "a5"}},
+		{7, 7 * day, []string{"a1", "a2"}},
+		{7, time.Hour, []string{"a1", "a2", "a3"}},
+		{3, 30 * day, []string{"a1", "a2"}},
+		{0, 30 * day, []string{"a1", "a2", "a3", "a5"}},
+	}
+	for _, test := range tests {
+		var pruned []string
+		for _, snap := range prunedSnapshots(snapshots, test.keep, test.maxAge, now) {
+			pruned = append(pruned, *snap.SnapshotId)
+		}
+		sort.Strings(pruned)
+		if !reflect.DeepEqual(pruned, test.pruned) {
+			t.Errorf("keep %d, max age %v: got pruned snapshots %v, want %v", test.keep, test.maxAge, pruned, test.pruned)
+		}
+	}
+}
+
+func TestUpRestoresVolumeFromLatestSnapshot(t *testing.T) {
+	cloud := awstest.NewFakeCloud()
+	fake := fakeRegion(cloud, "eu-west-1")
+	now := time.Now()
+	for _, snap := range []types.Snapshot{
+		testSnapshot("snap-old", "data-a", types.SnapshotStateCompleted, now.Add(-48*time.Hour)),
+		testSnapshot("snap-latest", "data-a", types.SnapshotStateCompleted, now.Add(-24*time.Hour)),
+		testSnapshot("snap-failed", "data-a", types.SnapshotStateError, now.Add(-time.Hour)),
+		testSnapshot("snap-other", "data-b", types.SnapshotStateCompleted, now),
+	} {
+		snap := snap
+		fake.Snapshots[*snap.SnapshotId] = &snap
+	}
+	vol := testVolume("data-a", "eu-west-1")
+	vol.Specification.SnapshotId = snapshotLatest
+	useFakeCloud(t, cloud, []*Host{testHost("a", "eu-west-1", "data-a")}, []*Volume{vol})
+
+	if _, err := (Provider{}).Up(); err != nil {
+		t.Fatalf("up failed : %v", err)
+	}
+	if v := volumesOf(fake)["data-a"]; v == nil || aws.ToString(v.SnapshotId) != "snap-latest" {
+		t.Errorf("volume data-a should be restored from snap-latest, got %v", v)
+	}
+}
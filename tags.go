@@ -45,3 +45,22 @@ func TagsForResource(name string) []types.Tag {
 		},
 	}
 }
+
+func TagSpecificationsForResource(resourceType types.ResourceType, name string) []types.TagSpecification {
+	return []types.TagSpecification{
+		{
+			ResourceType: resourceType,
+			Tags:         TagsForResource(name),
+		},
+	}
+}
+
+// TagValue returns the value of the tag key, empty when absent.
+func TagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
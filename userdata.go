@@ -3,18 +3,98 @@ package aws
 import (
 	"bytes"
 	"encoding/base64"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/template"
+	"strings"
 )
 
 var userdata = `#!/bin/bash
 {{ .authorized }}
+{{- if .growFilesystems }}
+mkdir -p /var/lib/cloud/scripts/per-boot
+cat > /var/lib/cloud/scripts/per-boot/xbee-grow-filesystems.sh <<'XBEE_EOF'
+#!/bin/bash
+# grows the filesystems made on whole EBS disks, i.e. data volumes, up to the size of their volume
+lsblk -rnpo NAME,TYPE,FSTYPE,MOUNTPOINT | while read -r name type fstype mountpoint; do
+  [ "$type" = disk ] && [ -n "$mountpoint" ] || continue
+  case "$fstype" in
+    ext2|ext3|ext4) resize2fs "$name" ;;
+    xfs) xfs_growfs "$mountpoint" ;;
+  esac
+done
+XBEE_EOF
+chmod +x /var/lib/cloud/scripts/per-boot/xbee-grow-filesystems.sh
+{{- end }}
+{{- if .volumes }}
+# waits for a data volume to be attached, formats it when blank and mounts it through fstab
+xbee_mount() {
+  local serial="$1" device="$2" mountpoint="$3" fstype="$4" options="$5" disk="" candidate attempt
+  for attempt in $(seq 1 120); do
+    # Nitro instances expose EBS volumes as NVMe disks whose serial is the volume id, Xen ones under their device
+    for candidate in "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_$serial" "$device" "${device/\/dev\/sd//dev/xvd}"; do
+      if [ -b "$candidate" ]; then
+        disk=$(readlink -f "$candidate")
+        break 2
+      fi
+    done
+    sleep 5
+  done
+  if [ -z "$disk" ]; then
+    echo "xbee: volume $serial is not attached, $mountpoint is not mounted" >&2
+    return 1
+  fi
+  if ! blkid -p "$disk" >/dev/null 2>&1; then
+    mkfs -t "$fstype" "$disk" || return 1
+  fi
+  local uuid
+  uuid=$(blkid -s UUID -o value "$disk")
+  mkdir -p "$mountpoint"
+  grep -q "^UUID=$uuid " /etc/fstab || echo "UUID=$uuid $mountpoint $fstype $options 0 2" >> /etc/fstab
+  mount "$mountpoint"
+}
+{{- range .volumes }}
+xbee_mount '{{ .Serial }}' '{{ .Device }}' '{{ .MountPoint }}' '{{ .FsType }}' '{{ .Options }}' &
+{{- end }}
+wait
+{{- end }}
 `
 
-func UserDataBase64(user string) (*string, error) {
+// mountedVolume is a data volume the userdata of its host formats and mounts.
+type mountedVolume struct {
+	// volume id without its dash, the serial of the NVMe disk
+	Serial     string
+	Device     string
+	MountPoint string
+	FsType     string
+	Options    string
+}
+
+// mountedVolumes returns the volumes of h having a mount point, they must exist and have their device assigned.
+func (r *Region2) mountedVolumes(h *Host) (result []*mountedVolume) {
+	for _, volName := range h.Volumes {
+		vol, declared := r.Volumes[volName]
+		v, ok := r.Ec2Volumes[volName]
+		if !declared || !ok || vol.Specification.MountPoint == "" {
+			continue
+		}
+		result = append(result, &mountedVolume{
+			Serial:     strings.Replace(aws.ToString(v.VolumeId), "-", "", 1),
+			Device:     TagValue(v.Tags, deviceTag),
+			MountPoint: vol.Specification.MountPoint,
+			FsType:     vol.Specification.fsType(),
+			Options:    vol.Specification.mountOptions(),
+		})
+	}
+	return
+}
+
+func UserDataBase64(h *Host, volumes []*mountedVolume) (*string, error) {
 	model := map[string]interface{}{
-		"authorized": provider.AuthorizedKeyScript(user),
+		"authorized":      provider.AuthorizedKeyScript(h.User),
+		"growFilesystems": h.Specification.GrowFilesystems,
+		"volumes":         volumes,
 	}
 	w := &bytes.Buffer{}
 	if err := template.OutputWithTemplate(userdata, w, model, nil); err != nil {
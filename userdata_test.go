@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"strings"
+	"testing"
+)
+
+func TestUserDataMountsVolumes(t *testing.T) {
+	h := testHost("a", "eu-west-1", "data", "logs", "raw")
+	h.Specification.GrowFilesystems = true
+	r := &Region2{
+		Volumes: map[string]*Volume{
+			"data": {Specification: &AwsVolumeData{MountPoint: "/data"}},
+			"logs": {Specification: &AwsVolumeData{MountPoint: "/var/log/app", FsType: "xfs", MountOptions: "noatime"}},
+			"raw":  {Specification: &AwsVolumeData{}},
+		},
+		Ec2Volumes: map[string]*types.Volume{
+			"data": {VolumeId: aws.String("vol-0123456789abcdef0"), Tags: []types.Tag{{Key: aws.String(deviceTag), Value: aws.String("/dev/sdf")}}},
+			"logs": {VolumeId: aws.String("vol-0fedcba9876543210"), Tags: []types.Tag{{Key: aws.String(deviceTag), Value: aws.String("/dev/sdg")}}},
+			"raw":  {VolumeId: aws.String("vol-00000000000000001"), Tags: []types.Tag{{Key: aws.String(deviceTag), Value: aws.String("/dev/sdh")}}},
+		},
+	}
+	userData64, err := UserDataBase64(h, r.mountedVolumes(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(*userData64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userData := string(data)
+	for _, line := range []string{
+		"xbee_mount 'vol0123456789abcdef0' '/dev/sdf' '/data' 'ext4' 'defaults,nofail' &",
+		"xbee_mount 'vol0fedcba9876543210' '/dev/sdg' '/var/log/app' 'xfs' 'noatime,nofail' &",
+		"cat > /var/lib/cloud/scripts/per-boot/xbee-grow-filesystems.sh <<'XBEE_EOF'",
+		"    xfs) xfs_growfs \"$mountpoint\" ;;",
+	} {
+		if !strings.Contains(userData, line+"\n") {
+			t.Errorf("userdata should contain the line %q, got:\n%s", line, userData)
+		}
+	}
+	if strings.Contains(userData, "vol00000000000000001") {
+		t.Error("a volume without mount point should not be mounted")
+	}
+
+	h.Specification.GrowFilesystems = false
+	userData64, err = UserDataBase64(h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = base64.StdEncoding.DecodeString(*userData64)
+	if strings.Contains(string(data), "xbee-grow-filesystems") || strings.Contains(string(data), "xbee_mount") {
+		t.Errorf("got userdata growing or mounting filesystems, want none:\n%s", data)
+	}
+}
+
+func TestValidateMount(t *testing.T) {
+	tests := []struct {
+		data *AwsVolumeData
+		ok   bool
+	}{
+		{&AwsVolumeData{}, true},
+		{&AwsVolumeData{MountPoint: "/data", FsType: "xfs", MountOptions: "noatime,nofail"}, true},
+		{&AwsVolumeData{FsType: "xfs"}, false},
+		{&AwsVolumeData{MountOptions: "noatime"}, false},
+		{&AwsVolumeData{MountPoint: "data"}, false},
+		{&AwsVolumeData{MountPoint: "/"}, false},
+		{&AwsVolumeData{MountPoint: "/data", FsType: "btrfs"}, false},
+		{&AwsVolumeData{MountPoint: "/my data"}, false},
+		{&AwsVolumeData{MountPoint: "/data'; reboot; '"}, false},
+		{&AwsVolumeData{MountPoint: "/data$HOME"}, false},
+		{&AwsVolumeData{MountPoint: "/data", MountOptions: "defaults' &&'"}, false},
+		{&AwsVolumeData{MountPoint: "/data", MountOptions: "noatime nodev"}, false},
+	}
+	for _, test := range tests {
+		if err := test.data.validateMount(); (err == nil) != test.ok {
+			t.Errorf("%+v: got %v, want valid %v", test.data, err, test.ok)
+		}
+	}
+}
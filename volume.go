@@ -2,15 +2,76 @@ package aws
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
+	"strings"
 )
 
 type AwsVolumeData struct {
 	Size       int    `json:"size"`
 	VolumeType string `json:"volumeType"`
 	Region     string `json:"region"`
+	// provisioned performance, for gp3, io1 and io2 volumes only. io1 and io2 require iops.
+	Iops       int `json:"iops"`
+	Throughput int `json:"throughput"`
+	// snapshot the volume is created from, "latest" for its latest completed snapshot taken by SnapshotVolumes
+	SnapshotId string `json:"snapshotId"`
+	// encrypts the volume, it follows the host it is attached to when not given
+	Encrypted *bool `json:"encrypted"`
+	// KMS key id, alias or arn, the one of the host when empty
+	KmsKeyId string `json:"kmsKeyId"`
+	// where the userdata of the host mounts the volume, formatting it first when blank. Not mounted when empty.
+	MountPoint string `json:"mountPoint"`
+	// filesystem made on a blank volume, ext4 by default
+	FsType string `json:"fsType"`
+	// fstab options of the mount, defaults by default, nofail is always added
+	MountOptions string `json:"mountOptions"`
+}
+
+// filesystems the userdata of a host can make on a blank volume
+var volumeFsTypes = []string{"ext4", "xfs"}
+
+func (d *AwsVolumeData) fsType() string {
+	if d.FsType == "" {
+		return "ext4"
+	}
+	return d.FsType
+}
+
+// mountOptions returns the fstab options of the volume, nofail being added so that a host whose volume is missing
+// still boots.
+func (d *AwsVolumeData) mountOptions() string {
+	options := d.MountOptions
+	if options == "" {
+		options = "defaults"
+	}
+	for _, option := range strings.Split(options, ",") {
+		if option == "nofail" {
+			return options
+		}
+	}
+	return options + ",nofail"
+}
+
+func (d *AwsVolumeData) validateMount() error {
+	if d.MountPoint == "" {
+		if d.FsType != "" || d.MountOptions != "" {
+			return fmt.Errorf("fsType and mountOptions require mountPoint")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(d.MountPoint, "/") || d.MountPoint == "/" || strings.ContainsAny(d.MountPoint, " \t\n'\"\\$`") {
+		return fmt.Errorf("mountPoint %q must be an absolute path other than /, without spaces nor quotes", d.MountPoint)
+	}
+	if !containsString(volumeFsTypes, d.fsType()) {
+		return fmt.Errorf("fsType %s is not one of %v", d.FsType, volumeFsTypes)
+	}
+	if strings.ContainsAny(d.MountOptions, " \t\n'\"\\$`") {
+		return fmt.Errorf("mountOptions %q must be a comma separated list, without spaces nor quotes", d.MountOptions)
+	}
+	return nil
 }
 
 type Volume struct {
@@ -27,12 +88,42 @@ func volumeFrom(req *provider.XbeeVolume) (*Volume, *cmd.XbeeError) {
 	if err := json.Unmarshal(data, &result); err != nil {
 		panic(cmd.Error("unexpected error when deserializing data provider : %v", err))
 	}
+	if err := validateEbs(result.VolumeType, req.Size, result.Iops, result.Throughput); err != nil {
+		return nil, cmd.Error("volume %s : %v", req.Name, err)
+	}
+	if id := result.SnapshotId; id != "" && id != snapshotLatest && !strings.HasPrefix(id, "snap-") {
+		return nil, cmd.Error("volume %s : snapshotId %s is neither a snapshot id nor %s", req.Name, id, snapshotLatest)
+	}
+	if result.KmsKeyId != "" && result.Encrypted != nil && !*result.Encrypted {
+		return nil, cmd.Error("volume %s : kmsKeyId %s requires encrypted", req.Name, result.KmsKeyId)
+	}
+	if err := result.validateMount(); err != nil {
+		return nil, cmd.Error("volume %s : %v", req.Name, err)
+	}
 	return &Volume{
 		XbeeVolume:    req,
 		Specification: &result,
 	}, nil
 }
 
+// encryption returns whether the volume is encrypted when attached to h, and with which KMS key. A volume which does
+// not say follows h, so that XBEE_AWS_ENCRYPTED and XBEE_AWS_KMS_KEY_ID, applied to hosts, apply to their volumes too.
+func (v *Volume) encryption(h *Host) (bool, string) {
+	encrypted := h.Specification.Encrypted
+	if v.Specification.Encrypted != nil {
+		encrypted = *v.Specification.Encrypted
+	} else if v.Specification.KmsKeyId != "" {
+		encrypted = true
+	}
+	if !encrypted {
+		return false, ""
+	}
+	if v.Specification.KmsKeyId != "" {
+		return true, v.Specification.KmsKeyId
+	}
+	return true, h.Specification.KmsKeyId
+}
+
 func VolumesFrom() (map[string]map[string]*Volume, *cmd.XbeeError) {
 	volumes := provider.VolumesForEnv()
 	result := make(map[string]map[string]*Volume)
@@ -0,0 +1,230 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sort"
+	"time"
+)
+
+const (
+	// XBEE_AWS_WAIT_RUNNING is the max wait for instances to be running, 10m by default.
+	waitRunningEnv = "XBEE_AWS_WAIT_RUNNING"
+	// XBEE_AWS_WAIT_STOPPED is the max wait for instances to be stopped, 10m by default.
+	waitStoppedEnv = "XBEE_AWS_WAIT_STOPPED"
+	// XBEE_AWS_WAIT_TERMINATED is the max wait for instances to be terminated, 10m by default.
+	waitTerminatedEnv = "XBEE_AWS_WAIT_TERMINATED"
+	// XBEE_AWS_WAIT_IMAGE is the max wait for a packed AMI to be available, 1h by default.
+	waitImageEnv = "XBEE_AWS_WAIT_IMAGE"
+	// XBEE_AWS_WAIT_VOLUME is the max wait for volumes to be available, 5m by default.
+	waitVolumeEnv = "XBEE_AWS_WAIT_VOLUME"
+	// XBEE_AWS_WAIT_POLL is the first delay between two polls of a waiter, which then backs off up to 30s. 2s by default.
+	waitPollEnv = "XBEE_AWS_WAIT_POLL"
+)
+
+type instancesRetryable func(context.Context, *ec2.DescribeInstancesInput, *ec2.DescribeInstancesOutput, error) (bool, error)
+
+func waitDelays() (time.Duration, time.Duration) {
+	minDelay := durationOption(waitPollEnv, 2*time.Second)
+	maxDelay := 30 * time.Second
+	if minDelay > maxDelay {
+		maxDelay = minDelay
+	}
+	return minDelay, maxDelay
+}
+
+// waitTimedOut tells whether err, returned by a waiter started at start, comes from exceeding maxWait. The SDK waiter
+// gives up once less than minDelay remains, with an error which is neither an API error nor the one of ctx.
+func waitTimedOut(ctx context.Context, err error, start time.Time, maxWait time.Duration, minDelay time.Duration) bool {
+	var apiErr smithy.APIError
+	if err == nil || ctx.Err() != nil || errors.As(err, &apiErr) {
+		return false
+	}
+	return time.Since(start)+minDelay >= maxWait
+}
+
+// pendingHosts returns the named hosts whose instance is not in state yet, a missing instance counting as terminated.
+func (r *Region2) pendingHosts(state types.InstanceStateName, names ...string) (result []string) {
+	for _, name := range names {
+		if !r.areInstancesInState(state, name) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// waitUntilInstancesAreInState waits with the SDK waiter of state for the instances of the named hosts only, and
+// refreshes r.Instances once done. It fails when the max wait of state is exceeded, naming the hosts still pending.
+func (r *Region2) waitUntilInstancesAreInState(ctx context.Context, state types.InstanceStateName, names ...string) *cmd.XbeeError {
+	if err := r.fillInstances(ctx); err != nil {
+		return err
+	}
+	pending := r.pendingHosts(state, names...)
+	if len(pending) == 0 {
+		return nil
+	}
+	idNames := map[string]string{}
+	var ids []string
+	for _, name := range pending {
+		instance, ok := r.Instances[name]
+		if !ok {
+			return cmd.Error("hosts %v in region %s cannot be %s, they have no instance", pending, r.Name, state)
+		}
+		instances := []*types.Instance{instance}
+		// duplicates are terminated by delete and stopped by down along with the instance of the host
+		for _, duplicate := range r.Duplicates[name] {
+			switch state {
+			case types.InstanceStateNameTerminated:
+				instances = append(instances, duplicate)
+			case types.InstanceStateNameStopped:
+				if duplicate.State.Name != types.InstanceStateNameShuttingDown {
+					instances = append(instances, duplicate)
+				}
+			}
+		}
+		for _, i := range instances {
+			ids = append(ids, *i.InstanceId)
+			idNames[*i.InstanceId] = name
+		}
+	}
+	envName, maxWait := waitRunningEnv, durationOption(waitRunningEnv, 10*time.Minute)
+	switch state {
+	case types.InstanceStateNameStopped:
+		envName, maxWait = waitStoppedEnv, durationOption(waitStoppedEnv, 10*time.Minute)
+	case types.InstanceStateNameTerminated:
+		envName, maxWait = waitTerminatedEnv, durationOption(waitTerminatedEnv, 10*time.Minute)
+	}
+	minDelay, maxDelay := waitDelays()
+	progress := func(retryable instancesRetryable) instancesRetryable {
+		return func(ctx context.Context, in *ec2.DescribeInstancesInput, out *ec2.DescribeInstancesOutput, err error) (bool, error) {
+			retry, err := retryable(ctx, in, out, err)
+			if retry && out != nil {
+				var waiting []string
+				for _, reservation := range out.Reservations {
+					for _, instance := range reservation.Instances {
+						if instance.State.Name != state {
+							waiting = append(waiting, fmt.Sprintf("%s (%s)", idNames[*instance.InstanceId], instance.State.Name))
+						}
+					}
+				}
+				sort.Strings(waiting)
+				log2.Infof("waiting for hosts %v in region %s to be %s", waiting, r.Name, state)
+			}
+			return retry, err
+		}
+	}
+	in := &ec2.DescribeInstancesInput{InstanceIds: ids}
+	log2.Infof("waiting up to %s for hosts %v in region %s to be %s", maxWait, pending, r.Name, state)
+	start := time.Now()
+	var err error
+	switch state {
+	case types.InstanceStateNameRunning:
+		err = ec2.NewInstanceRunningWaiter(r.Svc, func(o *ec2.InstanceRunningWaiterOptions) {
+			o.MinDelay, o.MaxDelay = minDelay, maxDelay
+			o.Retryable = progress(o.Retryable)
+		}).Wait(ctx, in, maxWait)
+	case types.InstanceStateNameStopped:
+		err = ec2.NewInstanceStoppedWaiter(r.Svc, func(o *ec2.InstanceStoppedWaiterOptions) {
+			o.MinDelay, o.MaxDelay = minDelay, maxDelay
+			o.Retryable = progress(o.Retryable)
+		}).Wait(ctx, in, maxWait)
+	case types.InstanceStateNameTerminated:
+		err = ec2.NewInstanceTerminatedWaiter(r.Svc, func(o *ec2.InstanceTerminatedWaiterOptions) {
+			o.MinDelay, o.MaxDelay = minDelay, maxDelay
+			o.Retryable = progress(o.Retryable)
+		}).Wait(ctx, in, maxWait)
+	default:
+		return cmd.Error("no waiter for instance state %s", state)
+	}
+	if refreshErr := r.fillInstances(ctx); refreshErr != nil {
+		return refreshErr
+	}
+	if err != nil {
+		pending = r.pendingHosts(state, names...)
+		if waitTimedOut(ctx, err, start, maxWait, minDelay) {
+			return cmd.Error("timed out after %s waiting for hosts %v in region %s to be %s, set %s to wait longer", maxWait, pending, r.Name, state, envName)
+		}
+		return cmd.Error("an error occured while waiting for hosts %v in region %s to be %s : %v", pending, r.Name, state, err)
+	}
+	log2.Infof("aws instances are now %s", state)
+	return nil
+}
+
+// waitUntilImageIsAvailable waits with the ImageAvailable waiter for the AMI packed from h.
+func (r *Region2) waitUntilImageIsAvailable(ctx context.Context, h *Host, imageId string) error {
+	maxWait := durationOption(waitImageEnv, time.Hour)
+	minDelay, maxDelay := waitDelays()
+	log2.Infof("waiting up to %s for AMI %s of host %s to be available", maxWait, imageId, h.Name)
+	start := time.Now()
+	err := ec2.NewImageAvailableWaiter(r.Svc, func(o *ec2.ImageAvailableWaiterOptions) {
+		o.MinDelay, o.MaxDelay = minDelay, maxDelay
+		retryable := o.Retryable
+		o.Retryable = func(ctx context.Context, in *ec2.DescribeImagesInput, out *ec2.DescribeImagesOutput, err error) (bool, error) {
+			retry, err := retryable(ctx, in, out, err)
+			if retry && out != nil && len(out.Images) > 0 {
+				log2.Infof("AMI %s of host %s is %s", imageId, h.Name, out.Images[0].State)
+			}
+			return retry, err
+		}
+	}).Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{imageId}}, maxWait)
+	if err == nil {
+		log2.Infof("AMI %s of host %s is available", imageId, h.Name)
+		return nil
+	}
+	if waitTimedOut(ctx, err, start, maxWait, minDelay) {
+		return fmt.Errorf("timed out after %s waiting for AMI %s of host %s to be available, set %s to wait longer", maxWait, imageId, h.Name, waitImageEnv)
+	}
+	return fmt.Errorf("creation of AMI %s failed : %v", h.EffectivePackName(), err)
+}
+
+// waitUntilVolumesAreAvailable waits for the named volumes still being created.
+func (r *Region2) waitUntilVolumesAreAvailable(ctx context.Context, volNames ...string) error {
+	var creating []string
+	for _, volName := range volNames {
+		if v, ok := r.Ec2Volumes[volName]; ok && v.State == types.VolumeStateCreating {
+			creating = append(creating, volName)
+		}
+	}
+	return r.waitForAvailableVolumes(afterCreate(ctx), creating...)
+}
+
+// waitForAvailableVolumes waits with the VolumeAvailable waiter for the named volumes, being created or detached, and
+// refreshes them in r.Ec2Volumes once done.
+func (r *Region2) waitForAvailableVolumes(ctx context.Context, volNames ...string) error {
+	var ids []string
+	for _, volName := range volNames {
+		if v, ok := r.Ec2Volumes[volName]; ok {
+			ids = append(ids, *v.VolumeId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	maxWait := durationOption(waitVolumeEnv, 5*time.Minute)
+	minDelay, maxDelay := waitDelays()
+	log2.Infof("waiting up to %s for volumes %v in region %s to be available", maxWait, volNames, r.Name)
+	start := time.Now()
+	out, err := ec2.NewVolumeAvailableWaiter(r.Svc, func(o *ec2.VolumeAvailableWaiterOptions) {
+		o.MinDelay, o.MaxDelay = minDelay, maxDelay
+	}).WaitForOutput(ctx, &ec2.DescribeVolumesInput{VolumeIds: ids}, maxWait)
+	if err != nil {
+		if waitTimedOut(ctx, err, start, maxWait, minDelay) {
+			return fmt.Errorf("timed out after %s waiting for volumes %v in region %s to be available, set %s to wait longer", maxWait, volNames, r.Name, waitVolumeEnv)
+		}
+		return fmt.Errorf("an error occured while waiting for volumes %v in region %s to be available : %v", volNames, r.Name, err)
+	}
+	for index := range out.Volumes {
+		v := &out.Volumes[index]
+		if name := TagValue(v.Tags, "xbee.name"); name != "" {
+			r.Ec2Volumes[name] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"github.com/iodasolutions/aws/awstest"
+	"testing"
+	"time"
+)
+
+func TestWaitTimedOut(t *testing.T) {
+	ctx := context.Background()
+	timeout := errors.New("exceeded max wait time for InstanceRunning waiter")
+	start := time.Now().Add(-time.Minute)
+	if !waitTimedOut(ctx, timeout, start, time.Minute, time.Second) {
+		t.Error("a plain error once the max wait is spent is a timeout")
+	}
+	if waitTimedOut(ctx, timeout, time.Now(), time.Minute, time.Second) {
+		t.Error("an error well before the max wait is not a timeout")
+	}
+	if waitTimedOut(ctx, awstest.APIError("UnauthorizedOperation", "denied"), start, time.Minute, time.Second) {
+		t.Error("an API error is not a timeout")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if waitTimedOut(canceled, canceled.Err(), start, time.Minute, time.Second) {
+		t.Error("an interruption is not a timeout")
+	}
+}